@@ -0,0 +1,62 @@
+package main
+
+import (
+    "errors"
+    "math/big"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var base58Index = func() [256]int {
+    var index [256]int
+    for i := range index {
+        index[i] = -1
+    }
+    for i, c := range base58Alphabet {
+        index[c] = i
+    }
+    return index
+}()
+
+// Base58Decode decodes a Bitcoin-alphabet base58 string, as used for Solana
+// public keys, signatures and instruction data.
+func Base58Decode(s string) ([]byte, error) {
+    value := new(big.Int)
+    radix := big.NewInt(58)
+    zeros := 0
+    for zeros < len(s) && s[zeros] == '1' {
+        zeros++
+    }
+
+    for i := 0; i < len(s); i++ {
+        digit := base58Index[s[i]]
+        if digit < 0 {
+            return nil, errors.New("invalid base58 character")
+        }
+        value.Mul(value, radix)
+        value.Add(value, big.NewInt(int64(digit)))
+    }
+
+    return append(make([]byte, zeros), value.Bytes()...), nil
+}
+
+// Base58Encode is the inverse of Base58Decode
+func Base58Encode(b []byte) string {
+    value := new(big.Int).SetBytes(b)
+    radix := big.NewInt(58)
+    mod := new(big.Int)
+
+    var out []byte
+    for value.Sign() > 0 {
+        value.DivMod(value, radix, mod)
+        out = append(out, base58Alphabet[mod.Int64()])
+    }
+    for i := 0; i < len(b) && b[i] == 0; i++ {
+        out = append(out, '1')
+    }
+
+    for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+        out[i], out[j] = out[j], out[i]
+    }
+    return string(out)
+}
@@ -3,14 +3,16 @@ package main
 import (
     "log"
     "os"
+    "sort"
     "strconv"
+    "strings"
+    "time"
 
     "github.com/joho/godotenv"
 )
 
 type Config struct {
     SolanaRPCURL  string
-    SerumAPIKey   string
     DBHost        string
     DBPort        string
     DBUser        string
@@ -18,6 +20,103 @@ type Config struct {
     DBName        string
     TargetWinRate float64
     MaxDrawdown   float64
+    CostBasis     CostBasisMethod
+
+    // Wallet selection by win-rate trend. With SELECTION_TREND_DAYS set,
+    // wallets whose win rate fell faster than SelectionMaxDecayPerDay points
+    // a day over that window are dropped and the rest ranked by slope.
+    // Metrics snapshots older than MetricsHistoryFullDays are thinned to the
+    // last one of each wallet per day; 0, the default, keeps them all.
+    SelectionTrendWindow    time.Duration
+    SelectionMaxDecayPerDay float64
+    MetricsHistoryFullDays  int
+
+    // Consensus: copy a buy only once ConsensusMinWallets distinct top
+    // wallets (or, if ConsensusMinScore > 0, wallets whose win rates sum to
+    // that score) bought the mint within ConsensusWindow
+    ConsensusMinWallets int
+    ConsensusMinScore   float64
+    ConsensusWindow     time.Duration
+
+    // Latency guard for copied buys
+    MaxSignalAge    time.Duration
+    MaxPriceMovePct float64
+
+    // Token vetting of copied buys; reports are cached for TokenSafetyTTL
+    TokenSafety    TokenSafetyRules
+    TokenSafetyTTL time.Duration
+
+    // Execution backend: "paper", or "live" to swap through the Jupiter API
+    // with WALLET_KEYPAIR (solana-keygen JSON array or base58 secret key)
+    ExecutionMode  string
+    JupiterAPIURL  string
+    WalletKeypair  string
+    SlippageBps    int
+    PriorityFee    string
+    ConfirmTimeout time.Duration
+
+    // Paper fill simulation
+    PaperSwapFeeBps          float64
+    PaperPriorityFeeLamports uint64
+    PaperLatencyMin          time.Duration
+    PaperLatencyMax          time.Duration
+
+    // Exits of open lots, checked every PositionCheckInterval.
+    // TAKE_PROFIT_TIERS takes a comma separated list of gain%:sell%.
+    ExitRules             ExitRules
+    PositionCheckInterval time.Duration
+
+    // Token pricing: quotes are cached for PriceCacheTTL and rejected when
+    // older than MaxPriceAge. The quote API is asked what PriceProbeSOL buys.
+    PriceCacheTTL time.Duration
+    MaxPriceAge   time.Duration
+    PriceProbeSOL float64
+
+    // SOL a new portfolio starts with. A restored portfolio keeps the
+    // capital it was created with.
+    InitialCapitalSOL float64
+
+    // Dashboard listen address. Deposits and withdrawals are only served
+    // when DASHBOARD_TOKEN is set, to requests bearing it.
+    DashboardAddr  string
+    DashboardToken string
+
+    // Position sizing. Caps and sizes are in SOL, percentages of equity.
+    SizingMode           SizingMode
+    SizingFixedSOL       float64
+    SizingEquityPct      float64
+    SizingMaxConviction  float64
+    SizingVolTargetPct   float64
+    MaxTokenExposureSOL  float64
+    MaxWalletExposureSOL float64
+    MinTradeSOL          float64
+
+    // RPC endpoints and client limits. SOLANA_RPC_URLS takes a comma
+    // separated list of url|weight; SOLANA_RPC_URL alone is one endpoint.
+    RPCEndpoints      []RPCEndpointConfig
+    RPCHedgeDelay     time.Duration
+    RPCHealthInterval time.Duration
+    RPCMaxSlotLag     uint64
+
+    // WebSocket streaming of tracked wallets. SOLANA_WS_URL defaults to the
+    // first RPC endpoint with a ws:// or wss:// scheme.
+    SolanaWSURL        string
+    StreamPingInterval time.Duration
+    StreamGapGrace     time.Duration
+
+    RPCTimeout    time.Duration
+    RPCMaxRetries int
+    RPCRateLimit  float64 // requests per second, 0 for unlimited
+    RPCBurst      int
+    RPCBatchSize  int
+
+    // Backfill horizon: walk history back to BackfillSince if set, otherwise
+    // BackfillHorizonDays before now, stopping early at BackfillUntilSignature
+    BackfillSince          time.Time
+    BackfillHorizonDays    int
+    BackfillUntilSignature string
+    BackfillPageSize       int
+    BackfillMaxPages       int
 }
 
 func LoadConfig() Config {
@@ -36,9 +135,261 @@ func LoadConfig() Config {
         maxDrawdown = 20.0 // default
     }
 
+    costBasis := CostBasisMethod(os.Getenv("COST_BASIS_METHOD"))
+    switch costBasis {
+    case CostBasisFIFO, CostBasisLIFO, CostBasisAverage:
+    default:
+        costBasis = CostBasisFIFO // default
+    }
+
+    selectionTrendDays, err := strconv.Atoi(os.Getenv("SELECTION_TREND_DAYS"))
+    if err != nil || selectionTrendDays < 0 {
+        selectionTrendDays = 0 // default: select on the latest metrics only
+    }
+
+    selectionMaxDecayPerDay := envFloat("SELECTION_MAX_DECAY_PER_DAY", 0.5)
+
+    metricsHistoryFullDays, err := strconv.Atoi(os.Getenv("METRICS_HISTORY_FULL_DAYS"))
+    if err != nil || metricsHistoryFullDays < 0 {
+        metricsHistoryFullDays = 0 // default
+    }
+
+    consensusMinWallets, err := strconv.Atoi(os.Getenv("CONSENSUS_MIN_WALLETS"))
+    if err != nil || consensusMinWallets < 1 {
+        consensusMinWallets = 1 // default: every buy is copied
+    }
+
+    consensusMinScore := envFloat("CONSENSUS_MIN_SCORE", 0)
+
+    consensusWindow, err := time.ParseDuration(os.Getenv("CONSENSUS_WINDOW"))
+    if err != nil || consensusWindow <= 0 {
+        consensusWindow = 10 * time.Minute // default
+    }
+
+    maxSignalAge, err := time.ParseDuration(os.Getenv("MAX_SIGNAL_AGE"))
+    if err != nil {
+        // default: a swap found by the polling loop can be up to a full
+        // cycle old, plus however long the cycle took to reach it
+        maxSignalAge = 2 * tradingCycleInterval
+    }
+
+    maxPriceMovePct := envFloat("MAX_PRICE_MOVE_PCT", 5.0)
+
+    requireMintRevoked, err := strconv.ParseBool(os.Getenv("REQUIRE_MINT_REVOKED"))
+    if err != nil {
+        requireMintRevoked = true // default
+    }
+
+    requireFreezeRevoked, err := strconv.ParseBool(os.Getenv("REQUIRE_FREEZE_REVOKED"))
+    if err != nil {
+        requireFreezeRevoked = true // default
+    }
+
+    maxTopHolderPct := envFloat("MAX_TOP_HOLDER_PCT", 30.0)
+
+    topHolders, err := strconv.Atoi(os.Getenv("TOP_HOLDERS"))
+    if err != nil || topHolders <= 0 || topHolders > 20 {
+        topHolders = 10 // default; getTokenLargestAccounts returns at most 20
+    }
+
+    minTokenAge, err := time.ParseDuration(os.Getenv("MIN_TOKEN_AGE"))
+    if err != nil {
+        minTokenAge = 30 * time.Minute // default
+    }
+
+    minLiquiditySOL := envFloat("MIN_LIQUIDITY_SOL", 20.0)
+
+    tokenSafetyTTL, err := time.ParseDuration(os.Getenv("TOKEN_SAFETY_TTL"))
+    if err != nil || tokenSafetyTTL <= 0 {
+        tokenSafetyTTL = 6 * time.Hour // default
+    }
+
+    executionMode := os.Getenv("EXECUTION_MODE")
+    if executionMode != ExecutionLive {
+        executionMode = ExecutionPaper // default
+    }
+
+    jupiterAPIURL := os.Getenv("JUPITER_API_URL")
+    if jupiterAPIURL == "" {
+        jupiterAPIURL = "https://quote-api.jup.ag/v6" // default
+    }
+
+    slippageBps, err := strconv.Atoi(os.Getenv("SLIPPAGE_BPS"))
+    if err != nil || slippageBps < 0 {
+        slippageBps = 100 // default
+    }
+
+    priorityFee := os.Getenv("PRIORITY_FEE_LAMPORTS")
+    if priorityFee == "" {
+        priorityFee = "auto" // default
+    }
+
+    confirmTimeout, err := time.ParseDuration(os.Getenv("CONFIRM_TIMEOUT"))
+    if err != nil || confirmTimeout <= 0 {
+        confirmTimeout = time.Minute // default
+    }
+
+    paperSwapFeeBps := envFloat("PAPER_SWAP_FEE_BPS", 25.0)
+
+    paperPriorityFeeLamports, err := strconv.ParseUint(os.Getenv("PAPER_PRIORITY_FEE_LAMPORTS"), 10, 64)
+    if err != nil {
+        paperPriorityFeeLamports = 100000 // default
+    }
+
+    paperLatencyMin, err := time.ParseDuration(os.Getenv("PAPER_LATENCY_MIN"))
+    if err != nil || paperLatencyMin < 0 {
+        paperLatencyMin = 400 * time.Millisecond // default
+    }
+
+    paperLatencyMax, err := time.ParseDuration(os.Getenv("PAPER_LATENCY_MAX"))
+    if err != nil || paperLatencyMax < paperLatencyMin {
+        paperLatencyMax = paperLatencyMin + 1600*time.Millisecond // default
+    }
+
+    takeProfitTiers := os.Getenv("TAKE_PROFIT_TIERS")
+    if takeProfitTiers == "" {
+        takeProfitTiers = "50:30,100:30,200:40" // default
+    }
+
+    positionCheckInterval, err := time.ParseDuration(os.Getenv("POSITION_CHECK_INTERVAL"))
+    if err != nil || positionCheckInterval <= 0 {
+        positionCheckInterval = 15 * time.Second // default
+    }
+
+    exitRules := ExitRules{
+        StopLossPct:           envFloat("STOP_LOSS_PCT", 30.0),
+        TakeProfit:            parseTakeProfitTiers(takeProfitTiers),
+        TrailingStopPct:       envFloat("TRAILING_STOP_PCT", 20.0),
+        TrailingActivationPct: envFloat("TRAILING_ACTIVATION_PCT", 30.0),
+    }
+
+    priceCacheTTL, err := time.ParseDuration(os.Getenv("PRICE_CACHE_TTL"))
+    if err != nil || priceCacheTTL < 0 {
+        priceCacheTTL = 10 * time.Second // default
+    }
+
+    maxPriceAge, err := time.ParseDuration(os.Getenv("MAX_PRICE_AGE"))
+    if err != nil || maxPriceAge < 0 {
+        maxPriceAge = 2 * time.Minute // default
+    }
+
+    priceProbeSOL := envFloat("PRICE_PROBE_SOL", 0.1)
+
+    initialCapitalSOL := envFloat("INITIAL_CAPITAL_SOL", 10.0)
+    if initialCapitalSOL <= 0 {
+        initialCapitalSOL = 10.0 // default
+    }
+
+    dashboardAddr := os.Getenv("DASHBOARD_ADDR")
+    if dashboardAddr == "" {
+        dashboardAddr = "127.0.0.1:8080" // default
+    }
+
+    sizingMode := SizingMode(os.Getenv("SIZING_MODE"))
+    switch sizingMode {
+    case SizingFixedSOL, SizingPercentEquity, SizingConviction, SizingVolatility:
+    default:
+        sizingMode = SizingFixedSOL // default
+    }
+
+    sizingFixedSOL := envFloat("SIZING_FIXED_SOL", 0.1)
+    sizingEquityPct := envFloat("SIZING_EQUITY_PCT", 2.0)
+    sizingMaxConviction := envFloat("SIZING_MAX_CONVICTION", 3.0)
+    sizingVolTargetPct := envFloat("SIZING_VOL_TARGET_PCT", 0.5)
+    maxTokenExposureSOL := envFloat("MAX_TOKEN_EXPOSURE_SOL", 1.0)
+    maxWalletExposureSOL := envFloat("MAX_WALLET_EXPOSURE_SOL", 2.0)
+    minTradeSOL := envFloat("MIN_TRADE_SOL", 0.01)
+
+    rpcEndpoints := parseRPCEndpoints(os.Getenv("SOLANA_RPC_URLS"))
+    if len(rpcEndpoints) == 0 && os.Getenv("SOLANA_RPC_URL") != "" {
+        rpcEndpoints = []RPCEndpointConfig{{URL: os.Getenv("SOLANA_RPC_URL"), Weight: 1}}
+    }
+
+    rpcHedgeDelay, err := time.ParseDuration(os.Getenv("RPC_HEDGE_DELAY"))
+    if err != nil {
+        rpcHedgeDelay = 2 * time.Second // default
+    }
+
+    rpcHealthInterval, err := time.ParseDuration(os.Getenv("RPC_HEALTH_INTERVAL"))
+    if err != nil || rpcHealthInterval <= 0 {
+        rpcHealthInterval = 30 * time.Second // default
+    }
+
+    rpcMaxSlotLag, err := strconv.ParseUint(os.Getenv("RPC_MAX_SLOT_LAG"), 10, 64)
+    if err != nil {
+        rpcMaxSlotLag = 50 // default
+    }
+
+    solanaWSURL := os.Getenv("SOLANA_WS_URL")
+    if solanaWSURL == "" && len(rpcEndpoints) > 0 {
+        solanaWSURL = rpcEndpoints[0].URL
+        if strings.HasPrefix(solanaWSURL, "https://") {
+            solanaWSURL = "wss://" + strings.TrimPrefix(solanaWSURL, "https://")
+        } else if strings.HasPrefix(solanaWSURL, "http://") {
+            solanaWSURL = "ws://" + strings.TrimPrefix(solanaWSURL, "http://")
+        }
+    }
+
+    streamPingInterval, err := time.ParseDuration(os.Getenv("STREAM_PING_INTERVAL"))
+    if err != nil || streamPingInterval <= 0 {
+        streamPingInterval = 30 * time.Second // default
+    }
+
+    streamGapGrace, err := time.ParseDuration(os.Getenv("STREAM_GAP_GRACE"))
+    if err != nil {
+        streamGapGrace = 5 * time.Second // default
+    }
+
+    rpcTimeout, err := time.ParseDuration(os.Getenv("RPC_TIMEOUT"))
+    if err != nil {
+        rpcTimeout = 30 * time.Second // default
+    }
+
+    rpcMaxRetries, err := strconv.Atoi(os.Getenv("RPC_MAX_RETRIES"))
+    if err != nil {
+        rpcMaxRetries = 5 // default
+    }
+
+    rpcRateLimit, err := strconv.ParseFloat(os.Getenv("RPC_RATE_LIMIT"), 64)
+    if err != nil {
+        rpcRateLimit = 10.0 // default
+    }
+
+    rpcBurst, err := strconv.Atoi(os.Getenv("RPC_BURST"))
+    if err != nil {
+        rpcBurst = int(rpcRateLimit) // default
+    }
+
+    rpcBatchSize, err := strconv.Atoi(os.Getenv("RPC_BATCH_SIZE"))
+    if err != nil || rpcBatchSize <= 0 {
+        rpcBatchSize = 20 // default
+    }
+
+    var backfillSince time.Time
+    if since := os.Getenv("BACKFILL_SINCE"); since != "" {
+        backfillSince, err = time.Parse("2006-01-02", since)
+        if err != nil {
+            log.Printf("Invalid BACKFILL_SINCE %q, using BACKFILL_HORIZON_DAYS instead: %v", since, err)
+        }
+    }
+
+    backfillHorizonDays, err := strconv.Atoi(os.Getenv("BACKFILL_HORIZON_DAYS"))
+    if err != nil {
+        backfillHorizonDays = 30 // default
+    }
+
+    backfillPageSize, err := strconv.Atoi(os.Getenv("BACKFILL_PAGE_SIZE"))
+    if err != nil || backfillPageSize <= 0 || backfillPageSize > 1000 {
+        backfillPageSize = 1000 // default, and the RPC maximum
+    }
+
+    backfillMaxPages, err := strconv.Atoi(os.Getenv("BACKFILL_MAX_PAGES"))
+    if err != nil || backfillMaxPages <= 0 {
+        backfillMaxPages = 10 // default, per wallet per cycle
+    }
+
     return Config{
         SolanaRPCURL:  os.Getenv("SOLANA_RPC_URL"),
-        SerumAPIKey:   os.Getenv("SERUM_API_KEY"),
         DBHost:        os.Getenv("DB_HOST"),
         DBPort:        os.Getenv("DB_PORT"),
         DBUser:        os.Getenv("DB_USER"),
@@ -46,5 +397,135 @@ func LoadConfig() Config {
         DBName:        os.Getenv("DB_NAME"),
         TargetWinRate: targetWinRate,
         MaxDrawdown:   maxDrawdown,
+        CostBasis:     costBasis,
+
+        SelectionTrendWindow:    time.Duration(selectionTrendDays) * 24 * time.Hour,
+        SelectionMaxDecayPerDay: selectionMaxDecayPerDay,
+        MetricsHistoryFullDays:  metricsHistoryFullDays,
+
+        ConsensusMinWallets: consensusMinWallets,
+        ConsensusMinScore:   consensusMinScore,
+        ConsensusWindow:     consensusWindow,
+
+        MaxSignalAge:    maxSignalAge,
+        MaxPriceMovePct: maxPriceMovePct,
+
+        TokenSafety: TokenSafetyRules{
+            RequireMintRevoked:   requireMintRevoked,
+            RequireFreezeRevoked: requireFreezeRevoked,
+            MaxTopHolderPct:      maxTopHolderPct,
+            TopHolders:           topHolders,
+            MinTokenAge:          minTokenAge,
+            MinLiquiditySOL:      minLiquiditySOL,
+        },
+        TokenSafetyTTL: tokenSafetyTTL,
+
+        ExecutionMode:  executionMode,
+        JupiterAPIURL:  jupiterAPIURL,
+        WalletKeypair:  os.Getenv("WALLET_KEYPAIR"),
+        SlippageBps:    slippageBps,
+        PriorityFee:    priorityFee,
+        ConfirmTimeout: confirmTimeout,
+
+        PaperSwapFeeBps:          paperSwapFeeBps,
+        PaperPriorityFeeLamports: paperPriorityFeeLamports,
+        PaperLatencyMin:          paperLatencyMin,
+        PaperLatencyMax:          paperLatencyMax,
+
+        ExitRules:             exitRules,
+        PositionCheckInterval: positionCheckInterval,
+
+        PriceCacheTTL: priceCacheTTL,
+        MaxPriceAge:   maxPriceAge,
+        PriceProbeSOL: priceProbeSOL,
+
+        InitialCapitalSOL: initialCapitalSOL,
+
+        DashboardAddr:  dashboardAddr,
+        DashboardToken: os.Getenv("DASHBOARD_TOKEN"),
+
+        SizingMode:           sizingMode,
+        SizingFixedSOL:       sizingFixedSOL,
+        SizingEquityPct:      sizingEquityPct,
+        SizingMaxConviction:  sizingMaxConviction,
+        SizingVolTargetPct:   sizingVolTargetPct,
+        MaxTokenExposureSOL:  maxTokenExposureSOL,
+        MaxWalletExposureSOL: maxWalletExposureSOL,
+        MinTradeSOL:          minTradeSOL,
+
+        RPCEndpoints:      rpcEndpoints,
+        RPCHedgeDelay:     rpcHedgeDelay,
+        RPCHealthInterval: rpcHealthInterval,
+        RPCMaxSlotLag:     rpcMaxSlotLag,
+
+        SolanaWSURL:        solanaWSURL,
+        StreamPingInterval: streamPingInterval,
+        StreamGapGrace:     streamGapGrace,
+
+        RPCTimeout:    rpcTimeout,
+        RPCMaxRetries: rpcMaxRetries,
+        RPCRateLimit:  rpcRateLimit,
+        RPCBurst:      rpcBurst,
+        RPCBatchSize:  rpcBatchSize,
+
+        BackfillSince:          backfillSince,
+        BackfillHorizonDays:    backfillHorizonDays,
+        BackfillUntilSignature: os.Getenv("BACKFILL_UNTIL_SIGNATURE"),
+        BackfillPageSize:       backfillPageSize,
+        BackfillMaxPages:       backfillMaxPages,
+    }
+}
+
+// envFloat reads a float environment variable, falling back to def when it
+// is unset or invalid
+func envFloat(name string, def float64) float64 {
+    value, err := strconv.ParseFloat(os.Getenv(name), 64)
+    if err != nil {
+        return def
+    }
+    return value
+}
+
+// parseRPCEndpoints parses "url|weight,url|weight". A missing or invalid
+// weight counts as 1.
+func parseRPCEndpoints(value string) []RPCEndpointConfig {
+    var endpoints []RPCEndpointConfig
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        endpoint := RPCEndpointConfig{URL: entry, Weight: 1}
+        if i := strings.LastIndex(entry, "|"); i >= 0 {
+            endpoint.URL = entry[:i]
+            if weight, err := strconv.Atoi(entry[i+1:]); err == nil && weight > 0 {
+                endpoint.Weight = weight
+            }
+        }
+        endpoints = append(endpoints, endpoint)
+    }
+    return endpoints
+}
+
+// parseTakeProfitTiers parses "gain%:sell%,gain%:sell%", skipping invalid
+// entries, and orders the tiers by gain
+func parseTakeProfitTiers(value string) []TakeProfitTier {
+    var tiers []TakeProfitTier
+    for _, entry := range strings.Split(value, ",") {
+        parts := strings.Split(strings.TrimSpace(entry), ":")
+        if len(parts) != 2 {
+            continue
+        }
+        gainPct, err := strconv.ParseFloat(parts[0], 64)
+        if err != nil || gainPct <= 0 {
+            continue
+        }
+        sellPct, err := strconv.ParseFloat(parts[1], 64)
+        if err != nil || sellPct <= 0 {
+            continue
+        }
+        tiers = append(tiers, TakeProfitTier{GainPct: gainPct, SellPct: sellPct})
     }
+    sort.Slice(tiers, func(i, j int) bool { return tiers[i].GainPct < tiers[j].GainPct })
+    return tiers
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "log"
+    "sort"
+    "time"
+)
+
+// consensusBuy is a top wallet's buy of a mint waiting for others to agree
+type consensusBuy struct {
+    leg SwapLeg
+    at  time.Time
+}
+
+// consensusEnabled reports whether buys need more than one wallet to agree
+func (tsm *TradeSignalModule) consensusEnabled() bool {
+    return tsm.Config.ConsensusMinWallets > 1 || tsm.Config.ConsensusMinScore > 0
+}
+
+// SetWalletMetrics refreshes the metrics used to weight consensus votes
+func (tsm *TradeSignalModule) SetWalletMetrics(wallets []WalletMetrics) {
+    tsm.mutex.Lock()
+    defer tsm.mutex.Unlock()
+    for _, wallet := range wallets {
+        tsm.walletMetrics[wallet.WalletAddress] = wallet
+    }
+}
+
+// aggregateBuy records a buy leg and returns a signal once enough distinct
+// top wallets have bought the same mint within ConsensusWindow: either
+// ConsensusMinWallets of them, or, when ConsensusMinScore is set, wallets
+// whose win rates (as fractions) add up to at least that score. Once a mint
+// has fired, further buys of it are ignored for the rest of the window.
+// Must be called with tsm.mutex held.
+func (tsm *TradeSignalModule) aggregateBuy(leg SwapLeg) (TradeSignal, bool) {
+    signal := signalFromLeg(leg)
+    if !tsm.consensusEnabled() {
+        return signal, true
+    }
+
+    mint := leg.Token()
+    at := leg.BlockTime
+    if at.IsZero() {
+        at = time.Now()
+    }
+    window := tsm.Config.ConsensusWindow
+
+    if fired, ok := tsm.consensusFired[mint]; ok && at.Sub(fired) < window {
+        return TradeSignal{}, false
+    }
+
+    for m, pending := range tsm.consensusPending {
+        if len(pending) > 0 && at.Sub(pending[len(pending)-1].at) >= window {
+            delete(tsm.consensusPending, m)
+        }
+    }
+
+    // Keep each wallet's latest buy within the window. Legs can arrive out
+    // of order, so an earlier buy counts as much as a later one.
+    var buys []consensusBuy
+    for _, buy := range tsm.consensusPending[mint] {
+        if withinWindow(at, buy.at, window) && buy.leg.Wallet != leg.Wallet {
+            buys = append(buys, buy)
+        }
+    }
+    buys = append(buys, consensusBuy{leg: leg, at: at})
+    tsm.consensusPending[mint] = buys
+
+    var score float64
+    wallets := make([]string, 0, len(buys))
+    for _, buy := range buys {
+        wallets = append(wallets, buy.leg.Wallet)
+        score += tsm.walletMetrics[buy.leg.Wallet].WinRate / 100
+    }
+
+    agreed := len(buys) >= tsm.Config.ConsensusMinWallets
+    if tsm.Config.ConsensusMinScore > 0 {
+        agreed = score >= tsm.Config.ConsensusMinScore
+    }
+    if !agreed {
+        return TradeSignal{}, false
+    }
+
+    sort.Strings(wallets)
+    log.Printf("Consensus buy of %s by %d wallets (score %.2f)\n", mint, len(wallets), score)
+    delete(tsm.consensusPending, mint)
+    tsm.consensusFired[mint] = at
+    for m, fired := range tsm.consensusFired {
+        if at.Sub(fired) >= window {
+            delete(tsm.consensusFired, m)
+        }
+    }
+
+    signal.ContributingWallets = wallets
+    return signal, true
+}
+
+// withinWindow reports whether a and b are less than window apart, in
+// either order
+func withinWindow(a, b time.Time, window time.Duration) bool {
+    apart := a.Sub(b)
+    if apart < 0 {
+        apart = -apart
+    }
+    return apart < window
+}
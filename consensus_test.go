@@ -0,0 +1,128 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// consensusLeg is a buy of a mint by a wallet at a number of seconds after
+// roundTripStart
+type consensusLeg struct {
+    wallet  string
+    mint    string
+    seconds uint64
+}
+
+func TestAggregateBuy(t *testing.T) {
+    metrics := []WalletMetrics{
+        {WalletAddress: "a", WinRate: 60},
+        {WalletAddress: "b", WinRate: 30},
+        {WalletAddress: "c", WinRate: 50},
+    }
+
+    tests := []struct {
+        name    string
+        minimum int
+        score   float64
+        legs    []consensusLeg
+        fired   []int // Indexes of the legs that produce a signal
+        wallets []string
+    }{
+        {
+            name:    "fires on the Nth distinct wallet",
+            minimum: 3,
+            legs:    []consensusLeg{{"a", "tok", 0}, {"b", "tok", 10}, {"c", "tok", 20}},
+            fired:   []int{2},
+            wallets: []string{"a", "b", "c"},
+        },
+        {
+            name:    "the same wallet buying twice counts once",
+            minimum: 2,
+            legs:    []consensusLeg{{"a", "tok", 0}, {"a", "tok", 10}, {"b", "tok", 20}},
+            fired:   []int{2},
+            wallets: []string{"a", "b"},
+        },
+        {
+            name:    "wallets buying different mints do not agree",
+            minimum: 2,
+            legs:    []consensusLeg{{"a", "tok", 0}, {"b", "other", 10}},
+        },
+        {
+            name:    "buys outside the window expire",
+            minimum: 2,
+            legs:    []consensusLeg{{"a", "tok", 0}, {"b", "tok", 120}, {"c", "tok", 150}},
+            fired:   []int{2},
+            wallets: []string{"b", "c"},
+        },
+        {
+            name:    "an earlier buy arriving late still agrees",
+            minimum: 2,
+            legs:    []consensusLeg{{"a", "tok", 50}, {"b", "tok", 20}},
+            fired:   []int{1},
+            wallets: []string{"a", "b"},
+        },
+        {
+            name:    "a late buy from before the window does not agree",
+            minimum: 2,
+            legs:    []consensusLeg{{"a", "tok", 200}, {"b", "tok", 20}},
+        },
+        {
+            name:    "win rates add up to the score",
+            minimum: 5,
+            score:   1.1,
+            legs:    []consensusLeg{{"b", "tok", 0}, {"c", "tok", 10}, {"a", "tok", 20}},
+            fired:   []int{2},
+            wallets: []string{"a", "b", "c"},
+        },
+        {
+            name:    "a fired mint is suppressed for the rest of the window",
+            minimum: 2,
+            legs: []consensusLeg{
+                {"a", "tok", 0}, {"b", "tok", 10}, {"c", "tok", 20},
+                {"a", "tok", 80}, {"b", "tok", 90},
+            },
+            fired:   []int{1, 4},
+            wallets: []string{"a", "b"},
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            tsm := InitializeTradeSignalModule(NewMemoryStore(), Config{
+                ConsensusMinWallets: test.minimum,
+                ConsensusMinScore:   test.score,
+                ConsensusWindow:     time.Minute,
+            }, nil)
+            tsm.SetWalletMetrics(metrics)
+
+            var fired []int
+            for i, l := range test.legs {
+                leg := buyLeg(fmt.Sprintf("sig-%d", i), l.seconds, l.mint, 100, 1)
+                leg.Wallet = l.wallet
+                signal, ok := tsm.SignalFromLeg(leg)
+                if !ok {
+                    continue
+                }
+                fired = append(fired, i)
+                if len(signal.ContributingWallets) != len(test.wallets) {
+                    t.Fatalf("leg %d fired for %v, want %v", i, signal.ContributingWallets, test.wallets)
+                }
+                for j, wallet := range test.wallets {
+                    if signal.ContributingWallets[j] != wallet {
+                        t.Fatalf("leg %d fired for %v, want %v", i, signal.ContributingWallets, test.wallets)
+                    }
+                }
+            }
+
+            if len(fired) != len(test.fired) {
+                t.Fatalf("legs %v fired, want %v", fired, test.fired)
+            }
+            for i := range fired {
+                if fired[i] != test.fired[i] {
+                    t.Fatalf("legs %v fired, want %v", fired, test.fired)
+                }
+            }
+        })
+    }
+}
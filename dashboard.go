@@ -1,16 +1,23 @@
 package main
 
 import (
+    "crypto/subtle"
     "encoding/json"
     "log"
     "net/http"
+    "strings"
+
+    "github.com/shopspring/decimal"
 )
 
 type DashboardMetrics struct {
     TotalSOL      string  `json:"total_sol"`
     TotalValueSOL string  `json:"total_value_sol"`
+    NetDepositsSOL string `json:"net_deposits_sol"`
     ProfitLossSOL string  `json:"profit_loss_sol"`
     ProfitLossPct float64 `json:"profit_loss_pct"`
+    RPCEndpoints  []EndpointStats `json:"rpc_endpoints"`
+    Rejections    map[string]int64 `json:"signal_rejections"`
 }
 
 func (mm *MonitoringModule) ServeDashboard(w http.ResponseWriter, r *http.Request) {
@@ -19,17 +26,80 @@ func (mm *MonitoringModule) ServeDashboard(w http.ResponseWriter, r *http.Reques
     dashboard := DashboardMetrics{
         TotalSOL:      metrics.TotalSOL.String(),
         TotalValueSOL: metrics.TotalValue.String(),
+        NetDepositsSOL: metrics.NetDeposits.String(),
         ProfitLossSOL: metrics.ProfitLossSOL.String(),
         ProfitLossPct: metrics.ProfitLossPct.InexactFloat64(),
+        RPCEndpoints:  metrics.RPCEndpoints,
+        Rejections:    metrics.Rejections,
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(dashboard)
 }
 
-func InitializeDashboard(monitoring *MonitoringModule) {
-    http.HandleFunc("/dashboard", monitoring.ServeDashboard)
+// ServeCashFlow deposits into or withdraws from the portfolio the SOL amount
+// given in the "amount" field of the form body, e.g.
+// curl -H "Authorization: Bearer $DASHBOARD_TOKEN" -d amount=5 localhost:8080/portfolio/deposit
+func (mm *MonitoringModule) ServeCashFlow(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    amount, err := decimal.NewFromString(r.PostFormValue("amount"))
+    if err != nil || !amount.IsPositive() {
+        http.Error(w, "amount must be a positive SOL amount", http.StatusBadRequest)
+        return
+    }
+
+    // Prices are fetched first; the portfolio is valued with them under the
+    // same lock that books the cash flow
+    prices := mm.HoldingPrices()
+    var flow CashFlow
+    success := false
+    if strings.HasSuffix(r.URL.Path, "/withdraw") {
+        flow, success = mm.Portfolio.Withdraw(amount, prices)
+    } else {
+        flow, success = mm.Portfolio.Deposit(amount, prices)
+    }
+    if !success {
+        http.Error(w, "cash flow not recorded - not enough balance", http.StatusConflict)
+        return
+    }
+    log.Printf("Cash flow on %s: %s SOL (portfolio value before %s SOL)\n", r.URL.Path, amount.String(), flow.ValueBefore.String())
+
+    mm.ServeDashboard(w, r)
+}
+
+// requireToken only lets through requests bearing token
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// NewDashboardHandler routes the dashboard, and the cash flow endpoints
+// behind token when one is set
+func NewDashboardHandler(monitoring *MonitoringModule, token string) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/dashboard", monitoring.ServeDashboard)
+    if token != "" {
+        mux.HandleFunc("/portfolio/deposit", requireToken(token, monitoring.ServeCashFlow))
+        mux.HandleFunc("/portfolio/withdraw", requireToken(token, monitoring.ServeCashFlow))
+    }
+    return mux
+}
+
+func InitializeDashboard(monitoring *MonitoringModule, config Config) {
+    if config.DashboardToken == "" {
+        log.Println("DASHBOARD_TOKEN is not set: deposits and withdrawals are disabled")
+    }
+    handler := NewDashboardHandler(monitoring, config.DashboardToken)
     go func() {
-        log.Fatal(http.ListenAndServe(":8080", nil))
+        log.Fatal(http.ListenAndServe(config.DashboardAddr, handler))
     }()
 }
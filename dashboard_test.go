@@ -0,0 +1,91 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestCashFlowEndpoints(t *testing.T) {
+    portfolio := NewPortfolio(decimal.NewFromInt(10))
+    // The held token is valued at the price fetched before the lock
+    portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(100), Price: decimal.NewFromFloat(0.01)})
+    prices := &fakePriceSource{price: decimal.NewFromFloat(0.03)}
+    monitoring := InitializeMonitoring(nil, portfolio, nil, prices)
+    server := httptest.NewServer(NewDashboardHandler(monitoring, "secret"))
+    defer server.Close()
+
+    post := func(path, token, query, amount string) int {
+        t.Helper()
+        req, err := http.NewRequest(http.MethodPost, server.URL+path+query, strings.NewReader(url.Values{"amount": {amount}}.Encode()))
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+
+    tests := []struct {
+        name   string
+        path   string
+        token  string
+        query  string
+        amount string
+        status int
+    }{
+        {"no token", "/portfolio/deposit", "", "", "5", http.StatusUnauthorized},
+        {"wrong token", "/portfolio/deposit", "guess", "", "5", http.StatusUnauthorized},
+        {"amount in the query string", "/portfolio/deposit", "secret", "?amount=5", "", http.StatusBadRequest},
+        {"deposit", "/portfolio/deposit", "secret", "", "5", http.StatusOK},
+        {"withdraw more than the balance", "/portfolio/withdraw", "secret", "", "50", http.StatusConflict},
+        {"withdraw", "/portfolio/withdraw", "secret", "", "2", http.StatusOK},
+    }
+    for _, test := range tests {
+        if status := post(test.path, test.token, test.query, test.amount); status != test.status {
+            t.Errorf("%s: status %d, want %d", test.name, status, test.status)
+        }
+    }
+
+    if balance := portfolio.GetBalance(); !balance.Equal(decimal.NewFromInt(12)) {
+        t.Errorf("balance %s, want 12", balance)
+    }
+    flows := portfolio.GetCashFlows()
+    if len(flows) != 2 || !flows[0].ValueBefore.Equal(decimal.NewFromInt(12)) || !flows[1].ValueBefore.Equal(decimal.NewFromInt(17)) {
+        t.Errorf("cash flows %+v, want values before of 12 and 17", flows)
+    }
+}
+
+func TestCashFlowDisabledWithoutToken(t *testing.T) {
+    monitoring := InitializeMonitoring(nil, NewPortfolio(decimal.NewFromInt(10)), nil, &fakePriceSource{})
+    server := httptest.NewServer(NewDashboardHandler(monitoring, ""))
+    defer server.Close()
+
+    resp, err := http.PostForm(server.URL+"/portfolio/deposit", url.Values{"amount": {"5"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("status %d, want deposits disabled", resp.StatusCode)
+    }
+    resp, err = http.Get(server.URL + "/dashboard")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Errorf("dashboard status %d", resp.StatusCode)
+    }
+}
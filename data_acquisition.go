@@ -1,157 +1,448 @@
 package main
 
 import (
-    "bytes"
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
-    "io/ioutil"
     "log"
-    "net/http"
+    "math"
+    "strconv"
     "time"
 )
 
 type SolanaTransaction struct {
-    // Define relevant fields based on Solana RPC API response
-    // This is a simplified placeholder
+    Slot        uint64           `json:"slot"`
+    BlockTime   *int64           `json:"blockTime"`
+    Meta        *TransactionMeta `json:"meta"`
     Transaction struct {
         Signatures []string `json:"signatures"`
         Message    struct {
-            Instructions []struct {
-                Parsed struct {
-                    Info struct {
-                        Source      string  `json:"source"`
-                        Destination string  `json:"destination"`
-                        TokenAmount float64 `json:"tokenAmount"`
-                        // Add more fields as necessary
-                    } `json:"info"`
-                    Type string `json:"type"`
-                } `json:"parsed"`
-            } `json:"instructions"`
+            AccountKeys  []AccountKey        `json:"accountKeys"`
+            Instructions []ParsedInstruction `json:"instructions"`
         } `json:"message"`
     } `json:"transaction"`
 }
 
-type DataAcquisitionModule struct {
-    RPCURL string
+// AccountKey is an entry of message.accountKeys in jsonParsed encoding
+type AccountKey struct {
+    Pubkey   string `json:"pubkey"`
+    Signer   bool   `json:"signer"`
+    Writable bool   `json:"writable"`
 }
 
-func InitializeDataAcquisition(config Config) *DataAcquisitionModule {
-    return &DataAcquisitionModule{
-        RPCURL: config.SolanaRPCURL,
+// ParsedInstruction is an instruction in jsonParsed encoding. Programs the
+// node knows how to parse (system, spl-token) fill Program and Parsed; all
+// others come back raw with Accounts and base58 Data.
+type ParsedInstruction struct {
+    ProgramID   string          `json:"programId"`
+    Program     string          `json:"program"`
+    Accounts    []string        `json:"accounts"`
+    Data        string          `json:"data"`
+    Parsed      json.RawMessage `json:"parsed"`
+    StackHeight *int            `json:"stackHeight"`
+}
+
+// stackHeight is 1 for top-level instructions; older transactions omit it
+func (ix ParsedInstruction) stackHeight() int {
+    if ix.StackHeight == nil {
+        return 2
     }
+    return *ix.StackHeight
 }
 
-func (dam *DataAcquisitionModule) FetchRecentTransactions(walletAddress string) ([]Trade, error) {
-    // Example RPC call to get confirmed transactions for a wallet
-    // Adjust the RPC method and parameters based on Solana's API
+type InnerInstructions struct {
+    Index        int                 `json:"index"`
+    Instructions []ParsedInstruction `json:"instructions"`
+}
+
+type TransactionMeta struct {
+    Err               interface{}         `json:"err"`
+    Fee               uint64              `json:"fee"`
+    PreBalances       []uint64            `json:"preBalances"`
+    PostBalances      []uint64            `json:"postBalances"`
+    PreTokenBalances  []TokenBalance      `json:"preTokenBalances"`
+    PostTokenBalances []TokenBalance      `json:"postTokenBalances"`
+    InnerInstructions []InnerInstructions `json:"innerInstructions"`
+}
+
+type TokenBalance struct {
+    AccountIndex  int    `json:"accountIndex"`
+    Mint          string `json:"mint"`
+    Owner         string `json:"owner"`
+    UITokenAmount struct {
+        Amount         string `json:"amount"`
+        Decimals       int    `json:"decimals"`
+        UIAmountString string `json:"uiAmountString"`
+    } `json:"uiTokenAmount"`
+}
+
+const (
+    wrappedSOLMint           = "So11111111111111111111111111111111111111112"
+    lamportsPerSOL           = 1e9
+    // Rent-exempt deposit of an SPL token account, paid when a swap opens one
+    tokenAccountRentLamports = 2039280
+)
+
+var (
+    errNotSwap           = errors.New("transaction is not a SOL-quoted swap")
+    errFailedTransaction = errors.New("transaction failed on-chain")
+)
 
-    // Placeholder: Replace with actual RPC method and parameters
-    rpcRequest := map[string]interface{}{
-        "jsonrpc": "2.0",
-        "id":      1,
-        "method":  "getSignaturesForAddress",
-        "params":  []interface{}{walletAddress, map[string]interface{}{"limit": 100}},
+// SignatureInfo is an entry of a getSignaturesForAddress result
+type SignatureInfo struct {
+    Signature string      `json:"signature"`
+    Slot      uint64      `json:"slot"`
+    Err       interface{} `json:"err"`
+    BlockTime *int64      `json:"blockTime"`
+}
+
+type DataAcquisitionModule struct {
+    RPC      SolanaRPC
+    DB       Store
+    Config   Config
+    Decoders *DecoderRegistry
+}
+
+func InitializeDataAcquisition(db Store, config Config, rpc SolanaRPC) *DataAcquisitionModule {
+    return &DataAcquisitionModule{
+        RPC:      rpc,
+        DB:       db,
+        Config:   config,
+        Decoders: DefaultDecoderRegistry(),
     }
+}
 
-    reqBody, err := json.Marshal(rpcRequest)
+// SyncWallet brings the wallet's swap history up to date and returns it
+// back to the backfill horizon. New signatures since the persisted cursor
+// are fetched first; then, if the backfill has not yet reached the
+// configured horizon, older pages are walked. Both walks share a budget of
+// BackfillMaxPages per call, and either one that runs out resumes where it
+// stopped on the next call. Each backfill page is stored together with the
+// cursor past it, and the history is read back from the store.
+//
+// The returned cursor includes the advance past the new signatures, which
+// is not saved here: the caller saves it with the metrics derived from the
+// history (WalletUpdate.Cursor), so a pass that fails before then fetches
+// the new signatures again instead of skipping them.
+func (dam *DataAcquisitionModule) SyncWallet(ctx context.Context, walletAddress string) ([]SwapLeg, WalletCursor, error) {
+    cursor, err := dam.DB.GetWalletCursor(walletAddress)
     if err != nil {
-        return nil, err
+        return nil, WalletCursor{}, err
     }
 
-    resp, err := http.Post(dam.RPCURL, "application/json", bytes.NewBuffer(reqBody))
-    if err != nil {
-        return nil, err
+    pages := 0
+    advanced := cursor
+    if cursor.NewestSignature != "" {
+        // Walk back from the tip, or from where the last call ran out of
+        // pages, until we reach what we already have. The tip only moves
+        // once the walk gets there, so the signatures in between are never
+        // skipped.
+        caughtUp := false
+        for pages < dam.Config.BackfillMaxPages {
+            page, err := dam.RPC.GetSignaturesForAddress(ctx, walletAddress, SignaturesOptions{
+                Before: advanced.CatchUpBefore,
+                Until:  cursor.NewestSignature,
+                Limit:  dam.Config.BackfillPageSize,
+            })
+            if err != nil {
+                return nil, WalletCursor{}, err
+            }
+            pages++
+            if len(page) == 0 {
+                caughtUp = true
+                break
+            }
+            if advanced.CatchUpTip == "" {
+                advanced.CatchUpTip = page[0].Signature
+            }
+            if err := dam.decodeSignatures(ctx, walletAddress, page); err != nil {
+                return nil, WalletCursor{}, err
+            }
+            advanced.CatchUpBefore = page[len(page)-1].Signature
+            if len(page) < dam.Config.BackfillPageSize {
+                caughtUp = true
+                break
+            }
+        }
+        if caughtUp {
+            if advanced.CatchUpTip != "" {
+                advanced.NewestSignature = advanced.CatchUpTip
+            }
+            advanced.CatchUpTip, advanced.CatchUpBefore = "", ""
+        }
     }
-    defer resp.Body.Close()
 
-    body, err := ioutil.ReadAll(resp.Body)
+    horizon := dam.backfillHorizon()
+    for !cursor.BackfillComplete && pages < dam.Config.BackfillMaxPages {
+        page, err := dam.RPC.GetSignaturesForAddress(ctx, walletAddress, SignaturesOptions{
+            Before: cursor.OldestSignature,
+            Until:  dam.Config.BackfillUntilSignature,
+            Limit:  dam.Config.BackfillPageSize,
+        })
+        if err != nil {
+            return nil, WalletCursor{}, err
+        }
+        pages++
+
+        var inHorizon []SignatureInfo
+        for _, sig := range page {
+            if sig.BlockTime != nil && time.Unix(*sig.BlockTime, 0).Before(horizon) {
+                cursor.BackfillComplete = true
+                break
+            }
+            inHorizon = append(inHorizon, sig)
+        }
+        legs, err := dam.fetchSwapLegs(ctx, walletAddress, inHorizon)
+        if err != nil {
+            return nil, WalletCursor{}, err
+        }
+
+        if len(page) > 0 {
+            if cursor.NewestSignature == "" {
+                cursor.NewestSignature = page[0].Signature
+            }
+            cursor.OldestSignature = page[len(page)-1].Signature
+        }
+        if len(page) < dam.Config.BackfillPageSize {
+            cursor.BackfillComplete = true
+        }
+        if err := dam.DB.SaveSyncPage(legs, cursor); err != nil {
+            return nil, WalletCursor{}, err
+        }
+    }
+
+    legs, err := dam.DB.LoadSwapLegs(walletAddress, horizon)
     if err != nil {
-        return nil, err
+        return nil, WalletCursor{}, err
+    }
+    if advanced.NewestSignature != "" {
+        cursor.NewestSignature = advanced.NewestSignature
     }
+    cursor.CatchUpTip, cursor.CatchUpBefore = advanced.CatchUpTip, advanced.CatchUpBefore
+    return legs, cursor, nil
+}
 
-    var rpcResponse struct {
-        JSONRPC string                   `json:"jsonrpc"`
-        ID      int                      `json:"id"`
-        Result  []map[string]interface{} `json:"result"`
-        Error   interface{}              `json:"error"`
+func (dam *DataAcquisitionModule) backfillHorizon() time.Time {
+    if !dam.Config.BackfillSince.IsZero() {
+        return dam.Config.BackfillSince
     }
+    return time.Now().AddDate(0, 0, -dam.Config.BackfillHorizonDays)
+}
 
-    err = json.Unmarshal(body, &rpcResponse)
+// decodeSignatures fetches the successful transactions in batches, decodes
+// them and stores their swap legs
+func (dam *DataAcquisitionModule) decodeSignatures(ctx context.Context, walletAddress string, signatures []SignatureInfo) error {
+    legs, err := dam.fetchSwapLegs(ctx, walletAddress, signatures)
     if err != nil {
-        return nil, err
+        return err
     }
+    return dam.DB.SaveSwapLegs(legs)
+}
 
-    if rpcResponse.Error != nil {
-        return nil, fmt.Errorf("RPC Error: %v", rpcResponse.Error)
+// fetchSwapLegs fetches the successful transactions among signatures with
+// batched getTransaction calls and returns their decoded swap legs.
+// Transactions that are not swaps are skipped; unclassified swaps are logged.
+func (dam *DataAcquisitionModule) fetchSwapLegs(ctx context.Context, walletAddress string, signatures []SignatureInfo) ([]SwapLeg, error) {
+    var pending []string
+    for _, sig := range signatures {
+        if sig.Err == nil {
+            pending = append(pending, sig.Signature)
+        }
     }
 
-    // Parse transactions and extract trades
-    var trades []Trade
-    for _, tx := range rpcResponse.Result {
-        signature, ok := tx["signature"].(string)
-        if !ok {
-            continue
+    var legs []SwapLeg
+    for start := 0; start < len(pending); start += dam.Config.RPCBatchSize {
+        end := start + dam.Config.RPCBatchSize
+        if end > len(pending) {
+            end = len(pending)
         }
 
-        // Fetch detailed transaction data
-        trade, err := dam.FetchTransactionDetails(signature)
+        txs, err := dam.RPC.GetTransactions(ctx, pending[start:end])
         if err != nil {
-            continue
+            return nil, err
         }
 
-        trades = append(trades, trade)
+        for i, tx := range txs {
+            signature := pending[start+i]
+            if tx == nil {
+                log.Println("Error fetching transaction:", signature, errTransactionNotFound)
+                continue
+            }
+
+            txLegs, err := dam.Decoders.DecodeTransaction(walletAddress, tx)
+            if err != nil {
+                if _, ok := err.(*UnclassifiedError); ok {
+                    log.Println("Skipping", err)
+                } else if err != errNotSwap && err != errFailedTransaction {
+                    log.Println("Error decoding transaction:", signature, err)
+                }
+                continue
+            }
+            legs = append(legs, txLegs...)
+        }
     }
 
-    return trades, nil
+    return legs, nil
 }
 
-func (dam *DataAcquisitionModule) FetchTransactionDetails(signature string) (Trade, error) {
-    // Implement fetching transaction details by signature
-    // Placeholder implementation
-
-    // Example RPC call: getTransaction
-    rpcRequest := map[string]interface{}{
-        "jsonrpc": "2.0",
-        "id":      1,
-        "method":  "getTransaction",
-        "params":  []interface{}{signature, "json"},
-    }
-
-    reqBody, err := json.Marshal(rpcRequest)
+// FetchTransactionDetails returns the swap legs walletAddress performed in
+// the transaction, as recognised by the module's decoder registry.
+func (dam *DataAcquisitionModule) FetchTransactionDetails(ctx context.Context, walletAddress, signature string) ([]SwapLeg, error) {
+    tx, err := dam.RPC.GetTransaction(ctx, signature)
     if err != nil {
-        return Trade{}, err
+        return nil, err
     }
+    return dam.Decoders.DecodeTransaction(walletAddress, tx)
+}
 
-    resp, err := http.Post(dam.RPCURL, "application/json", bytes.NewBuffer(reqBody))
-    if err != nil {
-        return Trade{}, err
+// DecodeSwap turns a jsonParsed transaction into a single buy or sell leg
+// from the point of view of walletAddress. The leg is derived from balance
+// changes rather than instructions: the wallet's SOL delta (fee and token
+// account rent excluded, wrapped SOL included) against the largest change in
+// any other mint the wallet owns. DecoderRegistry uses it to tell swaps
+// through unknown programs apart from other activity.
+func DecodeSwap(walletAddress string, tx *SolanaTransaction) (Trade, error) {
+    if tx.Meta == nil {
+        return Trade{}, errors.New("transaction has no meta")
+    }
+    if tx.Meta.Err != nil {
+        return Trade{}, errFailedTransaction
     }
-    defer resp.Body.Close()
 
-    body, err := ioutil.ReadAll(resp.Body)
+    lamportDelta, err := walletLamportDelta(walletAddress, tx)
     if err != nil {
         return Trade{}, err
     }
+    tokenDeltas, _ := walletTokenDeltas(walletAddress, tx.Meta)
+    solDelta := float64(lamportDelta)/lamportsPerSOL + tokenDeltas[wrappedSOLMint]
 
-    var rpcResponse SolanaTransaction
-    err = json.Unmarshal(body, &rpcResponse)
-    if err != nil {
-        return Trade{}, err
+    var mint string
+    var tokenDelta float64
+    for m, delta := range tokenDeltas {
+        if m == wrappedSOLMint {
+            continue
+        }
+        if math.Abs(delta) > math.Abs(tokenDelta) {
+            mint, tokenDelta = m, delta
+        }
     }
 
-    // Parse the transaction to extract trade information
-    // This is highly dependent on the transaction structure and specifics
-    // Placeholder implementation
     var trade Trade
-    trade.OpenTime = time.Now().Add(-2 * time.Hour)   // Replace with actual data
-    trade.CloseTime = time.Now().Add(-1 * time.Hour) // Replace with actual data
-    trade.Profit = 10.0                               // Replace with actual calculation
-    trade.ProfitPct = 5.0                             // Replace with actual calculation
-    trade.PositionSize = 200.0                        // Replace with actual data
-    trade.Action = "buy"                               // Replace with actual action
-    trade.Token = "SHITCOIN"                           // Replace with actual token
-    trade.Quantity = 100.0                             // Replace with actual quantity
-    trade.Price = 2.0                                  // Replace with actual price
+    switch {
+    case tokenDelta > 0 && solDelta < 0:
+        trade.Action = "buy"
+    case tokenDelta < 0 && solDelta > 0:
+        trade.Action = "sell"
+    default:
+        return Trade{}, errNotSwap
+    }
+
+    var blockTime time.Time
+    if tx.BlockTime != nil {
+        blockTime = time.Unix(*tx.BlockTime, 0).UTC()
+    }
+    if len(tx.Transaction.Signatures) > 0 {
+        trade.Signature = tx.Transaction.Signatures[0]
+    }
+    trade.Slot = tx.Slot
+    trade.OpenTime = blockTime
+    trade.CloseTime = blockTime
+    trade.Token = mint
+    trade.Quantity = math.Abs(tokenDelta)
+    trade.PositionSize = math.Abs(solDelta)
+    trade.Price = trade.PositionSize / trade.Quantity
 
     return trade, nil
 }
+
+// walletLamportDelta is the change in the wallet's native SOL balance,
+// excluding the transaction fee and token account rent deposits.
+func walletLamportDelta(walletAddress string, tx *SolanaTransaction) (int64, error) {
+    walletIndex := -1
+    for i, key := range tx.Transaction.Message.AccountKeys {
+        if key.Pubkey == walletAddress {
+            walletIndex = i
+            break
+        }
+    }
+    if walletIndex < 0 || walletIndex >= len(tx.Meta.PreBalances) || walletIndex >= len(tx.Meta.PostBalances) {
+        return 0, fmt.Errorf("wallet %s not found in transaction", walletAddress)
+    }
+
+    lamportDelta := int64(tx.Meta.PostBalances[walletIndex]) - int64(tx.Meta.PreBalances[walletIndex])
+    if walletIndex == 0 {
+        // The fee payer is always the first account; the fee is not part of the price
+        lamportDelta += int64(tx.Meta.Fee)
+    }
+
+    _, accountRent := walletTokenDeltas(walletAddress, tx.Meta)
+    return lamportDelta + accountRent, nil
+}
+
+// programIDs lists the distinct programs invoked by the transaction
+func (tx *SolanaTransaction) programIDs() []string {
+    seen := make(map[string]bool)
+    var ids []string
+    add := func(ix ParsedInstruction) {
+        if !seen[ix.ProgramID] {
+            seen[ix.ProgramID] = true
+            ids = append(ids, ix.ProgramID)
+        }
+    }
+    for _, ix := range tx.Transaction.Message.Instructions {
+        add(ix)
+    }
+    if tx.Meta != nil {
+        for _, inner := range tx.Meta.InnerInstructions {
+            for _, ix := range inner.Instructions {
+                add(ix)
+            }
+        }
+    }
+    return ids
+}
+
+// walletTokenDeltas sums post minus pre token balances per mint for accounts
+// owned by walletAddress. It also returns the lamports to add back to the
+// wallet's SOL delta for token accounts opened (or subtract for accounts
+// closed) by the transaction, so rent deposits don't distort the price.
+func walletTokenDeltas(walletAddress string, meta *TransactionMeta) (map[string]float64, int64) {
+    deltas := make(map[string]float64)
+    pre := make(map[int]bool)
+    post := make(map[int]bool)
+    var accountRent int64
+
+    for _, balance := range meta.PreTokenBalances {
+        if balance.Owner != walletAddress {
+            continue
+        }
+        pre[balance.AccountIndex] = true
+        deltas[balance.Mint] -= balance.uiAmount()
+    }
+    for _, balance := range meta.PostTokenBalances {
+        if balance.Owner != walletAddress {
+            continue
+        }
+        post[balance.AccountIndex] = true
+        deltas[balance.Mint] += balance.uiAmount()
+        if !pre[balance.AccountIndex] {
+            accountRent += tokenAccountRentLamports
+        }
+    }
+    for index := range pre {
+        if !post[index] {
+            accountRent -= tokenAccountRentLamports
+        }
+    }
+
+    return deltas, accountRent
+}
+
+func (tb TokenBalance) uiAmount() float64 {
+    amount, err := strconv.ParseFloat(tb.UITokenAmount.UIAmountString, 64)
+    if err != nil {
+        return 0
+    }
+    return amount
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// loadTransactionFixture reads a getTransaction response in jsonParsed
+// encoding from testdata
+func loadTransactionFixture(t *testing.T, name string) *SolanaTransaction {
+    t.Helper()
+    body, err := os.ReadFile(filepath.Join("testdata", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var response struct {
+        Result *SolanaTransaction `json:"result"`
+    }
+    if err := json.Unmarshal(body, &response); err != nil {
+        t.Fatalf("decoding %s: %v", name, err)
+    }
+    if response.Result == nil {
+        t.Fatalf("%s has no result", name)
+    }
+    return response.Result
+}
+
+func approxEqual(a, b float64) bool {
+    return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestDecodeTransactionFixtures(t *testing.T) {
+    tests := []struct {
+        fixture   string
+        wallet    string
+        programID string
+        pool      string
+        mint      string
+        side      string
+        quantity  float64
+        solAmount float64
+    }{
+        {
+            // Sell into the wallet's existing wrapped SOL account
+            fixture:   "raydium_amm_sell.json",
+            wallet:    "6EWo2Tiv3M7cWrfz6QdffBo7zrhvjGLFSotQkHpWQym7",
+            programID: raydiumAMMProgramID,
+            pool:      "46Farcft5VYEgw5HCLa5xKR7nZb9ySMd86tVmvsBo4gq",
+            mint:      "3Rn7hAaoLXJVR3KPx2MDHuo7gHnsyR2fDoPxLFGS2c1Y",
+            side:      "sell",
+            quantity:  1250000,
+            solAmount: 0.84,
+        },
+        {
+            // SOL paid to the bonding curve and the fee recipient by
+            // system transfer
+            fixture:   "pumpfun_buy.json",
+            wallet:    "F9v9nZnWzGs577yimp8fFSXSAd1Tu5AsR4rLr99ABVXE",
+            programID: pumpFunProgramID,
+            pool:      "AzrfcWRu6dCVMTo9tvChPShXKvqPetUZAmkF6ouMHysp",
+            mint:      "2sUMqdSiw2aVPkKNXs3kUjQzUVB52KcMEp3hwvpEgndk",
+            side:      "buy",
+            quantity:  17543859.649123,
+            solAmount: 0.505,
+        },
+        {
+            // SOL wrapped in a temporary account that is closed again, so
+            // it is in neither token balance list
+            fixture:   "jupiter_route_temp_wsol.json",
+            wallet:    "HsGVEP5ehttwNKkDPUXY2BgB4gaqPKNMNco1PgfQFW7o",
+            programID: jupiterV6ProgramID,
+            mint:      "G9Efde57RnhFuPxVJYgtxfAai3Sr4HoD9BM7gK7UsBt4",
+            side:      "buy",
+            quantity:  1523.456789,
+            solAmount: 2,
+        },
+    }
+
+    registry := DefaultDecoderRegistry()
+    for _, test := range tests {
+        t.Run(test.fixture, func(t *testing.T) {
+            tx := loadTransactionFixture(t, test.fixture)
+            legs, err := registry.DecodeTransaction(test.wallet, tx)
+            if err != nil {
+                t.Fatalf("DecodeTransaction: %v", err)
+            }
+            if len(legs) != 1 {
+                t.Fatalf("got %d legs, want 1: %+v", len(legs), legs)
+            }
+            leg := legs[0]
+
+            if leg.ProgramID != test.programID || leg.Pool != test.pool {
+                t.Errorf("program %s pool %q, want %s pool %q", leg.ProgramID, leg.Pool, test.programID, test.pool)
+            }
+            if leg.Token() != test.mint {
+                t.Errorf("mint %s, want %s", leg.Token(), test.mint)
+            }
+            if leg.Side() != test.side {
+                t.Errorf("side %q, want %q", leg.Side(), test.side)
+            }
+            if !approxEqual(leg.TokenAmount(), test.quantity) {
+                t.Errorf("quantity %v, want %v", leg.TokenAmount(), test.quantity)
+            }
+            if !approxEqual(leg.SOLAmount(), test.solAmount) {
+                t.Errorf("SOL amount %v, want %v", leg.SOLAmount(), test.solAmount)
+            }
+            if price := test.solAmount / test.quantity; !approxEqual(leg.Price(), price) {
+                t.Errorf("price %v SOL, want %v", leg.Price(), price)
+            }
+            if leg.Signature != tx.Transaction.Signatures[0] || leg.Slot != tx.Slot {
+                t.Errorf("leg is from %s at slot %d", leg.Signature, leg.Slot)
+            }
+        })
+    }
+}
+
+func TestSyncWalletKeepsCursorBeforeFailedBatch(t *testing.T) {
+    rpc := newFakeRPC()
+    now := time.Now().Unix()
+    for _, signature := range []string{"sig-3", "sig-2", "sig-1"} {
+        rpc.signatures = append(rpc.signatures, SignatureInfo{Signature: signature, BlockTime: &now})
+        rpc.transactions[signature] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    }
+    rpc.transactionErrors["sig-2"] = &RPCError{Code: -32005, Message: "Node is behind"}
+
+    store := NewMemoryStore()
+    config := Config{BackfillPageSize: 10, BackfillMaxPages: 5, BackfillHorizonDays: 30, RPCBatchSize: 10}
+    dam := InitializeDataAcquisition(store, config, rpc)
+
+    if _, _, err := dam.SyncWallet(context.Background(), "wallet"); err == nil {
+        t.Fatal("SyncWallet succeeded although a transaction could not be fetched")
+    }
+    cursor, err := store.GetWalletCursor("wallet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cursor.NewestSignature != "" || cursor.OldestSignature != "" {
+        t.Fatalf("cursor moved past the failed batch: %+v", cursor)
+    }
+
+    delete(rpc.transactionErrors, "sig-2")
+    if _, _, err := dam.SyncWallet(context.Background(), "wallet"); err != nil {
+        t.Fatalf("SyncWallet: %v", err)
+    }
+    cursor, _ = store.GetWalletCursor("wallet")
+    if cursor.NewestSignature != "sig-3" || cursor.OldestSignature != "sig-1" || !cursor.BackfillComplete {
+        t.Fatalf("cursor %+v, want sig-3 back to sig-1 and complete", cursor)
+    }
+
+    // A new signature moves the returned cursor, but the stored one only
+    // moves with the wallet update
+    rpc.signatures = append([]SignatureInfo{{Signature: "sig-4", BlockTime: &now}}, rpc.signatures...)
+    rpc.transactions["sig-4"] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    _, advanced, err := dam.SyncWallet(context.Background(), "wallet")
+    if err != nil {
+        t.Fatalf("SyncWallet: %v", err)
+    }
+    if advanced.NewestSignature != "sig-4" || advanced.OldestSignature != "sig-1" {
+        t.Fatalf("returned cursor %+v, want sig-4 back to sig-1", advanced)
+    }
+    if cursor, _ = store.GetWalletCursor("wallet"); cursor.NewestSignature != "sig-3" {
+        t.Fatalf("stored cursor moved to %s before the wallet update", cursor.NewestSignature)
+    }
+    if err := store.SaveWalletUpdate(WalletUpdate{Metrics: WalletMetrics{WalletAddress: "wallet"}, Cursor: advanced}); err != nil {
+        t.Fatal(err)
+    }
+    if cursor, _ = store.GetWalletCursor("wallet"); cursor != advanced {
+        t.Fatalf("stored cursor %+v after the wallet update, want %+v", cursor, advanced)
+    }
+}
+
+func TestSyncWalletCatchesUpOverSeveralCalls(t *testing.T) {
+    rpc := newFakeRPC()
+    now := time.Now().Unix()
+    for _, signature := range []string{"sig-5", "sig-4", "sig-3", "sig-2", "sig-1", "sig-0"} {
+        rpc.signatures = append(rpc.signatures, SignatureInfo{Signature: signature, BlockTime: &now})
+        rpc.transactions[signature] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    }
+
+    store := NewMemoryStore()
+    err := store.SaveWalletCursor(WalletCursor{WalletAddress: "wallet", NewestSignature: "sig-0", OldestSignature: "sig-0", BackfillComplete: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    config := Config{BackfillPageSize: 1, BackfillMaxPages: 2, BackfillHorizonDays: 30, RPCBatchSize: 10}
+    dam := InitializeDataAcquisition(store, config, rpc)
+
+    // Each call walks at most two pages and resumes below the last one
+    want := []WalletCursor{
+        {NewestSignature: "sig-0", CatchUpTip: "sig-5", CatchUpBefore: "sig-4"},
+        {NewestSignature: "sig-0", CatchUpTip: "sig-5", CatchUpBefore: "sig-2"},
+        {NewestSignature: "sig-5"},
+    }
+    for i, expected := range want {
+        calls := rpc.callCount("getSignaturesForAddress")
+        _, cursor, err := dam.SyncWallet(context.Background(), "wallet")
+        if err != nil {
+            t.Fatalf("SyncWallet %d: %v", i+1, err)
+        }
+        if walked := rpc.callCount("getSignaturesForAddress") - calls; walked > config.BackfillMaxPages {
+            t.Errorf("call %d walked %d pages, want at most %d", i+1, walked, config.BackfillMaxPages)
+        }
+        if cursor.NewestSignature != expected.NewestSignature || cursor.CatchUpTip != expected.CatchUpTip || cursor.CatchUpBefore != expected.CatchUpBefore {
+            t.Fatalf("call %d returned cursor %+v, want %+v", i+1, cursor, expected)
+        }
+        if err := store.SaveWalletCursor(cursor); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
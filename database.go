@@ -2,17 +2,33 @@ package main
 
 import (
     "context"
+    "encoding/json"
+    "errors"
     "fmt"
     "log"
+    "math"
+    "time"
 
+    "github.com/jackc/pgx/v4"
     "github.com/jackc/pgx/v4/pgxpool"
+    "github.com/shopspring/decimal"
 )
 
 type Database struct {
     Pool *pgxpool.Pool
 }
 
+// InitializeDatabase connects and applies any pending migrations
 func InitializeDatabase(config Config) *Database {
+    db := ConnectDatabase(config)
+    if err := MigrateUp(db, 0); err != nil {
+        log.Fatalf("Unable to migrate database: %v\n", err)
+    }
+    return db
+}
+
+// ConnectDatabase connects without touching the schema
+func ConnectDatabase(config Config) *Database {
     dbURL := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s",
         config.DBUser,
         config.DBPassword,
@@ -26,60 +42,20 @@ func InitializeDatabase(config Config) *Database {
         log.Fatalf("Unable to connect to database: %v\n", err)
     }
 
-    db := &Database{Pool: pool}
-    db.setupSchema()
-    return db
+    return &Database{Pool: pool}
 }
 
-func (db *Database) setupSchema() {
-    // Create tables if they don't exist
-    walletMetricsTable := `
-    CREATE TABLE IF NOT EXISTS wallet_metrics (
-        wallet_address VARCHAR PRIMARY KEY,
-        trade_count INTEGER,
-        win_rate FLOAT,
-        average_profit FLOAT,
-        average_profit_pct FLOAT,
-        average_loss FLOAT,
-        average_loss_pct FLOAT,
-        average_position_size FLOAT,
-        average_trade_duration INTERVAL
-    );`
-
-    dailyPnLTable := `
-    CREATE TABLE IF NOT EXISTS daily_pnl_trend (
-        id SERIAL PRIMARY KEY,
-        wallet_address VARCHAR REFERENCES wallet_metrics(wallet_address),
-        date DATE,
-        pnl FLOAT
-    );`
-
-    _, err := db.Pool.Exec(context.Background(), walletMetricsTable)
-    if err != nil {
-        log.Fatalf("Failed to create wallet_metrics table: %v", err)
-    }
-
-    _, err = db.Pool.Exec(context.Background(), dailyPnLTable)
-    if err != nil {
-        log.Fatalf("Failed to create daily_pnl_trend table: %v", err)
-    }
-
-    // Create indexes
-    indexes := []string{
-        `CREATE INDEX IF NOT EXISTS idx_win_rate ON wallet_metrics(win_rate);`,
-        `CREATE INDEX IF NOT EXISTS idx_average_profit ON wallet_metrics(average_profit);`,
-        `CREATE INDEX IF NOT EXISTS idx_trade_count ON wallet_metrics(trade_count);`,
-    }
-
-    for _, idx := range indexes {
-        _, err := db.Pool.Exec(context.Background(), idx)
-        if err != nil {
-            log.Fatalf("Failed to create index: %v", err)
-        }
-    }
+func (db *Database) UpsertWalletMetrics(wm WalletMetrics) error {
+    batch := &pgx.Batch{}
+    queueWalletMetrics(batch, wm)
+    return db.inTx(context.Background(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+        return sendBatch(context.Background(), tx, batch)
+    })
 }
 
-func UpsertWalletMetrics(db *Database, wm WalletMetrics) error {
+// queueWalletMetrics upserts the wallet's latest metrics and appends them
+// to its history
+func queueWalletMetrics(batch *pgx.Batch, wm WalletMetrics) {
     query := `
         INSERT INTO wallet_metrics (
             wallet_address, trade_count, win_rate, average_profit, 
@@ -98,7 +74,7 @@ func UpsertWalletMetrics(db *Database, wm WalletMetrics) error {
             average_trade_duration = EXCLUDED.average_trade_duration
     `
 
-    _, err := db.Pool.Exec(context.Background(), query,
+    batch.Queue(query,
         wm.WalletAddress,
         wm.TradeCount,
         wm.WinRate,
@@ -109,10 +85,89 @@ func UpsertWalletMetrics(db *Database, wm WalletMetrics) error {
         wm.AveragePositionSize,
         wm.AverageTradeDuration,
     )
-    return err
+
+    historyQuery := `
+        INSERT INTO wallet_metrics_history (
+            wallet_address, trade_count, win_rate, average_profit,
+            average_profit_pct, average_loss, average_loss_pct,
+            average_position_size, average_trade_duration
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `
+
+    batch.Queue(historyQuery,
+        wm.WalletAddress,
+        wm.TradeCount,
+        nullIfNaN(wm.WinRate),
+        nullIfNaN(wm.AverageProfit),
+        nullIfNaN(wm.AverageProfitPct),
+        nullIfNaN(wm.AverageLoss),
+        nullIfNaN(wm.AverageLossPct),
+        nullIfNaN(wm.AveragePositionSize),
+        wm.AverageTradeDuration,
+    )
 }
 
-func InsertDailyPnL(db *Database, walletAddress string, dailyPnLs []DailyPnL) error {
+// nullIfNaN stores a metric that couldn't be computed as NULL in the
+// history, where MetricTrends leaves it out. It reads back as NaN.
+func nullIfNaN(value float64) interface{} {
+    if math.IsNaN(value) {
+        return nil
+    }
+    return value
+}
+
+// TopWallets returns the wallets with more than minTradeCount round trips
+// and a win rate above minWinRate, best first
+func (db *Database) TopWallets(minTradeCount int, minWinRate float64, limit int) ([]WalletMetrics, error) {
+    query := `
+        SELECT wallet_address, trade_count, win_rate, average_profit, 
+               average_profit_pct, average_loss, average_loss_pct, 
+               average_position_size, average_trade_duration
+        FROM wallet_metrics
+        WHERE trade_count > $1 AND win_rate > $2
+        ORDER BY win_rate DESC, average_profit_pct DESC
+        LIMIT $3;
+    `
+
+    rows, err := db.Pool.Query(context.Background(), query, minTradeCount, minWinRate, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var wallets []WalletMetrics
+    for rows.Next() {
+        var wm WalletMetrics
+        err := rows.Scan(
+            &wm.WalletAddress,
+            &wm.TradeCount,
+            &wm.WinRate,
+            &wm.AverageProfit,
+            &wm.AverageProfitPct,
+            &wm.AverageLoss,
+            &wm.AverageLossPct,
+            &wm.AveragePositionSize,
+            &wm.AverageTradeDuration,
+        )
+        if err != nil {
+            log.Println("Error scanning row:", err)
+            continue
+        }
+        wallets = append(wallets, wm)
+    }
+
+    return wallets, nil
+}
+
+func (db *Database) InsertDailyPnL(walletAddress string, dailyPnLs []DailyPnL) error {
+    batch := &pgx.Batch{}
+    queueDailyPnL(batch, walletAddress, dailyPnLs)
+    return db.inTx(context.Background(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+        return sendBatch(context.Background(), tx, batch)
+    })
+}
+
+func queueDailyPnL(batch *pgx.Batch, walletAddress string, dailyPnLs []DailyPnL) {
     query := `
         INSERT INTO daily_pnl_trend (wallet_address, date, pnl)
         VALUES ($1, $2, $3)
@@ -121,10 +176,801 @@ func InsertDailyPnL(db *Database, walletAddress string, dailyPnLs []DailyPnL) er
     `
 
     for _, pnl := range dailyPnLs {
-        _, err := db.Pool.Exec(context.Background(), query, walletAddress, pnl.Date, pnl.PnL)
+        batch.Queue(query, walletAddress, pnl.Date, pnl.PnL)
+    }
+}
+
+// WalletMetricsHistory returns the wallet's metrics snapshots recorded
+// since the given time, oldest first
+func (db *Database) WalletMetricsHistory(walletAddress string, since time.Time) ([]WalletMetricsSnapshot, error) {
+    query := `
+        SELECT recorded_at, trade_count,
+               COALESCE(win_rate, 'NaN'), COALESCE(average_profit, 'NaN'),
+               COALESCE(average_profit_pct, 'NaN'), COALESCE(average_loss, 'NaN'),
+               COALESCE(average_loss_pct, 'NaN'), COALESCE(average_position_size, 'NaN'),
+               average_trade_duration
+        FROM wallet_metrics_history
+        WHERE wallet_address = $1 AND recorded_at >= $2
+        ORDER BY recorded_at, id
+    `
+
+    rows, err := db.Pool.Query(context.Background(), query, walletAddress, since)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var history []WalletMetricsSnapshot
+    for rows.Next() {
+        snapshot := WalletMetricsSnapshot{WalletMetrics: WalletMetrics{WalletAddress: walletAddress}}
+        err := rows.Scan(
+            &snapshot.RecordedAt,
+            &snapshot.TradeCount,
+            &snapshot.WinRate,
+            &snapshot.AverageProfit,
+            &snapshot.AverageProfitPct,
+            &snapshot.AverageLoss,
+            &snapshot.AverageLossPct,
+            &snapshot.AveragePositionSize,
+            &snapshot.AverageTradeDuration,
+        )
         if err != nil {
+            return nil, err
+        }
+        history = append(history, snapshot)
+    }
+    return history, rows.Err()
+}
+
+// MetricTrends fits a least squares line through each wallet's snapshots of
+// metric since the given time, for wallets with at least minSnapshots
+func (db *Database) MetricTrends(metric TrendMetric, since time.Time, minSnapshots int) ([]MetricTrend, error) {
+    if !metric.valid() {
+        return nil, fmt.Errorf("unknown trend metric %q", metric)
+    }
+    query := fmt.Sprintf(`
+        SELECT wallet_address, COUNT(*),
+               COALESCE(regr_slope(%[1]s::FLOAT, EXTRACT(EPOCH FROM recorded_at) / 86400), 0),
+               (array_agg(%[1]s::FLOAT ORDER BY recorded_at, id))[1],
+               (array_agg(%[1]s::FLOAT ORDER BY recorded_at DESC, id DESC))[1]
+        FROM wallet_metrics_history
+        WHERE recorded_at >= $1 AND %[1]s IS NOT NULL
+        GROUP BY wallet_address
+        HAVING COUNT(*) >= $2
+    `, string(metric))
+
+    rows, err := db.Pool.Query(context.Background(), query, since, minSnapshots)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var trends []MetricTrend
+    for rows.Next() {
+        trend := MetricTrend{Metric: metric}
+        err := rows.Scan(&trend.WalletAddress, &trend.Snapshots, &trend.SlopePerDay, &trend.First, &trend.Latest)
+        if err != nil {
+            return nil, err
+        }
+        trends = append(trends, trend)
+    }
+    return trends, rows.Err()
+}
+
+// DownsampleWalletMetricsHistory deletes every snapshot recorded before the
+// given time except the last of each wallet per UTC day
+func (db *Database) DownsampleWalletMetricsHistory(before time.Time) (int64, error) {
+    query := `
+        DELETE FROM wallet_metrics_history
+        WHERE id IN (
+            SELECT id FROM (
+                SELECT id, ROW_NUMBER() OVER (
+                    PARTITION BY wallet_address, (recorded_at AT TIME ZONE 'UTC')::DATE
+                    ORDER BY recorded_at DESC, id DESC
+                ) AS newest
+                FROM wallet_metrics_history
+                WHERE recorded_at < $1
+            ) ranked
+            WHERE newest > 1
+        )
+    `
+
+    tag, err := db.Pool.Exec(context.Background(), query, before)
+    if err != nil {
+        return 0, err
+    }
+    return tag.RowsAffected(), nil
+}
+
+// GetDailyPnL returns the wallet's daily PnL trend, oldest first
+func (db *Database) GetDailyPnL(walletAddress string) ([]DailyPnL, error) {
+    query := `SELECT date, pnl FROM daily_pnl_trend WHERE wallet_address = $1 ORDER BY date`
+
+    rows, err := db.Pool.Query(context.Background(), query, walletAddress)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var trend []DailyPnL
+    for rows.Next() {
+        var day DailyPnL
+        if err := rows.Scan(&day.Date, &day.PnL); err != nil {
+            return nil, err
+        }
+        trend = append(trend, day)
+    }
+    return trend, rows.Err()
+}
+
+// WalletCursor records how far getSignaturesForAddress has been walked for a
+// wallet: NewestSignature is the most recent signature already fetched and
+// OldestSignature the point the backfill resumes from. While a walk back to
+// NewestSignature is unfinished, CatchUpTip is the signature it started from
+// and CatchUpBefore the point it resumes from.
+type WalletCursor struct {
+    WalletAddress    string
+    NewestSignature  string
+    OldestSignature  string
+    BackfillComplete bool
+    CatchUpTip       string
+    CatchUpBefore    string
+}
+
+func (db *Database) GetWalletCursor(walletAddress string) (WalletCursor, error) {
+    query := `
+        SELECT COALESCE(newest_signature, ''), COALESCE(oldest_signature, ''), backfill_complete,
+            COALESCE(catch_up_tip, ''), COALESCE(catch_up_before, '')
+        FROM wallet_cursors
+        WHERE wallet_address = $1
+    `
+
+    cursor := WalletCursor{WalletAddress: walletAddress}
+    err := db.Pool.QueryRow(context.Background(), query, walletAddress).Scan(
+        &cursor.NewestSignature,
+        &cursor.OldestSignature,
+        &cursor.BackfillComplete,
+        &cursor.CatchUpTip,
+        &cursor.CatchUpBefore,
+    )
+    if err == pgx.ErrNoRows {
+        return cursor, nil
+    }
+    return cursor, err
+}
+
+const saveWalletCursorQuery = `
+    INSERT INTO wallet_cursors (
+        wallet_address, newest_signature, oldest_signature, backfill_complete,
+        catch_up_tip, catch_up_before, updated_at
+    ) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''), NOW())
+    ON CONFLICT (wallet_address)
+    DO UPDATE SET
+        newest_signature = EXCLUDED.newest_signature,
+        oldest_signature = EXCLUDED.oldest_signature,
+        backfill_complete = EXCLUDED.backfill_complete,
+        catch_up_tip = EXCLUDED.catch_up_tip,
+        catch_up_before = EXCLUDED.catch_up_before,
+        updated_at = EXCLUDED.updated_at
+`
+
+func walletCursorArgs(cursor WalletCursor) []interface{} {
+    return []interface{}{
+        cursor.WalletAddress,
+        cursor.NewestSignature,
+        cursor.OldestSignature,
+        cursor.BackfillComplete,
+        cursor.CatchUpTip,
+        cursor.CatchUpBefore,
+    }
+}
+
+func (db *Database) SaveWalletCursor(cursor WalletCursor) error {
+    _, err := db.Pool.Exec(context.Background(), saveWalletCursorQuery, walletCursorArgs(cursor)...)
+    return err
+}
+
+// GetSignalCursor returns the last signature of a copied wallet that signal
+// generation has processed, or "" if the wallet has never been processed
+func (db *Database) GetSignalCursor(walletAddress string) (string, error) {
+    query := `SELECT last_signature FROM signal_cursors WHERE wallet_address = $1`
+
+    var signature string
+    err := db.Pool.QueryRow(context.Background(), query, walletAddress).Scan(&signature)
+    if err == pgx.ErrNoRows {
+        return "", nil
+    }
+    return signature, err
+}
+
+func (db *Database) SaveSignalCursor(walletAddress, signature string) error {
+    query := `
+        INSERT INTO signal_cursors (wallet_address, last_signature, updated_at)
+        VALUES ($1, $2, NOW())
+        ON CONFLICT (wallet_address)
+        DO UPDATE SET last_signature = EXCLUDED.last_signature, updated_at = EXCLUDED.updated_at
+    `
+
+    _, err := db.Pool.Exec(context.Background(), query, walletAddress, signature)
+    return err
+}
+
+// ClaimSignal records the signal as processed and reports whether this call
+// was the first to do so. The claim is made before execution, so a crash
+// mid-trade errs on the side of not trading twice.
+func (db *Database) ClaimSignal(signal TradeSignal) (bool, error) {
+    query := `
+        INSERT INTO processed_signals (signature, wallet_address, token, action, slot)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT DO NOTHING
+    `
+
+    tag, err := db.Pool.Exec(context.Background(), query,
+        signal.Signature,
+        signal.WalletAddress,
+        signal.Token,
+        signal.Action,
+        int64(signal.Slot),
+    )
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
+// GetTokenReport returns the cached safety report of a mint, or nil if the
+// mint has never been checked
+func (db *Database) GetTokenReport(mint string) (*TokenReport, error) {
+    query := `
+        SELECT COALESCE(mint_authority, ''), COALESCE(freeze_authority, ''), supply,
+            largest_accounts, created_before, checked_at
+        FROM token_safety
+        WHERE mint = $1
+    `
+
+    report := TokenReport{Mint: mint}
+    var largestAccounts []byte
+    err := db.Pool.QueryRow(context.Background(), query, mint).Scan(
+        &report.MintAuthority,
+        &report.FreezeAuthority,
+        &report.Supply,
+        &largestAccounts,
+        &report.CreatedBefore,
+        &report.CheckedAt,
+    )
+    if err == pgx.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(largestAccounts, &report.LargestAccounts); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+func (db *Database) SaveTokenReport(report TokenReport) error {
+    largestAccounts, err := json.Marshal(report.LargestAccounts)
+    if err != nil {
+        return err
+    }
+
+    query := `
+        INSERT INTO token_safety (mint, mint_authority, freeze_authority, supply, largest_accounts, created_before, checked_at)
+        VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7)
+        ON CONFLICT (mint)
+        DO UPDATE SET
+            mint_authority = EXCLUDED.mint_authority,
+            freeze_authority = EXCLUDED.freeze_authority,
+            supply = EXCLUDED.supply,
+            largest_accounts = EXCLUDED.largest_accounts,
+            created_before = EXCLUDED.created_before,
+            checked_at = EXCLUDED.checked_at
+    `
+
+    _, err = db.Pool.Exec(context.Background(), query,
+        report.Mint,
+        report.MintAuthority,
+        report.FreezeAuthority,
+        report.Supply,
+        string(largestAccounts),
+        report.CreatedBefore,
+        report.CheckedAt,
+    )
+    return err
+}
+
+func (db *Database) CreatePortfolio(name string, balance decimal.Decimal) (int64, error) {
+    query := `
+        INSERT INTO portfolios (name, initial_capital, balance)
+        VALUES ($1, $2, $2)
+        RETURNING id
+    `
+
+    var id int64
+    err := db.Pool.QueryRow(context.Background(), query, name, balance.String()).Scan(&id)
+    return id, err
+}
+
+// LoadPortfolio reads the named portfolio with its open lots, transaction
+// log and cash flows. It returns nil if no portfolio has that name.
+func (db *Database) LoadPortfolio(name string) (*Portfolio, error) {
+    ctx := context.Background()
+    portfolio := NewPortfolio(decimal.Zero)
+    portfolio.Name = name
+
+    query := `SELECT id, initial_capital::TEXT, balance::TEXT FROM portfolios WHERE name = $1`
+    err := db.Pool.QueryRow(ctx, query, name).Scan(&portfolio.ID, &portfolio.InitialCapital, &portfolio.Balance)
+    if err == pgx.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    lotsQuery := `
+        SELECT id, token, source_wallet, quantity::TEXT, initial_quantity::TEXT, entry_price::TEXT,
+            opened_at, peak_price::TEXT, tiers_taken
+        FROM portfolio_lots
+        WHERE portfolio_id = $1 AND quantity > 0
+        ORDER BY id
+    `
+    rows, err := db.Pool.Query(ctx, lotsQuery, portfolio.ID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var lot Lot
+        if err := rows.Scan(&lot.ID, &lot.Token, &lot.SourceWallet, &lot.Quantity, &lot.InitialQuantity,
+            &lot.EntryPrice, &lot.OpenedAt, &lot.PeakPrice, &lot.TiersTaken); err != nil {
+            return nil, err
+        }
+        portfolio.saveLot(lot)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    // Lot IDs keep counting from the highest ever issued, closed lots included
+    var maxLotID int64
+    err = db.Pool.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM portfolio_lots WHERE portfolio_id = $1`, portfolio.ID).Scan(&maxLotID)
+    if err != nil {
+        return nil, err
+    }
+    if maxLotID > portfolio.nextLotID {
+        portfolio.nextLotID = maxLotID
+    }
+
+    transactionsQuery := `
+        SELECT executed_at, action, token, source_wallet, quantity::TEXT, price::TEXT,
+            expected_price::TEXT, fee::TEXT, total::TEXT, reason
+        FROM portfolio_transactions
+        WHERE portfolio_id = $1
+        ORDER BY id
+    `
+    txRows, err := db.Pool.Query(ctx, transactionsQuery, portfolio.ID)
+    if err != nil {
+        return nil, err
+    }
+    defer txRows.Close()
+    for txRows.Next() {
+        var tx Transaction
+        if err := txRows.Scan(&tx.Timestamp, &tx.Action, &tx.Token, &tx.SourceWallet, &tx.Quantity, &tx.Price,
+            &tx.ExpectedPrice, &tx.Fee, &tx.Total, &tx.Reason); err != nil {
+            return nil, err
+        }
+        portfolio.TransactionLog = append(portfolio.TransactionLog, tx)
+    }
+    if err := txRows.Err(); err != nil {
+        return nil, err
+    }
+
+    flowsQuery := `
+        SELECT occurred_at, amount::TEXT, value_before::TEXT
+        FROM portfolio_cash_flows
+        WHERE portfolio_id = $1
+        ORDER BY id
+    `
+    flowRows, err := db.Pool.Query(ctx, flowsQuery, portfolio.ID)
+    if err != nil {
+        return nil, err
+    }
+    defer flowRows.Close()
+    for flowRows.Next() {
+        var flow CashFlow
+        if err := flowRows.Scan(&flow.Timestamp, &flow.Amount, &flow.ValueBefore); err != nil {
+            return nil, err
+        }
+        portfolio.CashFlows = append(portfolio.CashFlows, flow)
+    }
+    if err := flowRows.Err(); err != nil {
+        return nil, err
+    }
+
+    return portfolio, nil
+}
+
+// SavePortfolioChange writes the balance, lots, transaction and cash flow of
+// one portfolio operation in a single transaction. Closed lots are zeroed
+// rather than deleted so their IDs are never reused.
+func (db *Database) SavePortfolioChange(portfolioID int64, change PortfolioChange) error {
+    ctx := context.Background()
+    tx, err := db.Pool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    _, err = tx.Exec(ctx, `UPDATE portfolios SET balance = $2 WHERE id = $1`, portfolioID, change.Balance.String())
+    if err != nil {
+        return err
+    }
+
+    lotQuery := `
+        INSERT INTO portfolio_lots (portfolio_id, id, token, source_wallet, quantity, initial_quantity,
+            entry_price, opened_at, peak_price, tiers_taken)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        ON CONFLICT (portfolio_id, id)
+        DO UPDATE SET
+            quantity = EXCLUDED.quantity,
+            peak_price = EXCLUDED.peak_price,
+            tiers_taken = EXCLUDED.tiers_taken
+    `
+    for _, lot := range change.SavedLots {
+        _, err = tx.Exec(ctx, lotQuery,
+            portfolioID,
+            lot.ID,
+            lot.Token,
+            lot.SourceWallet,
+            lot.Quantity.String(),
+            lot.InitialQuantity.String(),
+            lot.EntryPrice.String(),
+            lot.OpenedAt,
+            lot.PeakPrice.String(),
+            lot.TiersTaken,
+        )
+        if err != nil {
+            return err
+        }
+    }
+
+    for _, id := range change.ClosedLots {
+        _, err = tx.Exec(ctx, `UPDATE portfolio_lots SET quantity = 0 WHERE portfolio_id = $1 AND id = $2`, portfolioID, id)
+        if err != nil {
+            return err
+        }
+    }
+
+    if t := change.Transaction; t != nil {
+        transactionQuery := `
+            INSERT INTO portfolio_transactions (portfolio_id, executed_at, action, token, source_wallet,
+                quantity, price, expected_price, fee, total, reason)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        `
+        _, err = tx.Exec(ctx, transactionQuery,
+            portfolioID,
+            t.Timestamp,
+            t.Action,
+            t.Token,
+            t.SourceWallet,
+            t.Quantity.String(),
+            t.Price.String(),
+            t.ExpectedPrice.String(),
+            t.Fee.String(),
+            t.Total.String(),
+            t.Reason,
+        )
+        if err != nil {
+            return err
+        }
+    }
+
+    if flow := change.CashFlow; flow != nil {
+        flowQuery := `
+            INSERT INTO portfolio_cash_flows (portfolio_id, occurred_at, amount, value_before)
+            VALUES ($1, $2, $3, $4)
+        `
+        _, err = tx.Exec(ctx, flowQuery, portfolioID, flow.Timestamp, flow.Amount.String(), flow.ValueBefore.String())
+        if err != nil {
+            return err
+        }
+    }
+
+    return tx.Commit(ctx)
+}
+
+
+var swapLegColumns = []string{
+    "signature", "wallet_address", "leg_index", "slot", "block_time", "program_id", "pool",
+    "input_mint", "output_mint", "input_amount", "output_amount", "input_balance_before",
+    "sol_reserve", "token_reserve", "sol_vault", "token_vault",
+}
+
+// SaveSwapLegs bulk loads swap legs with COPY. Legs already stored are left
+// as they are, so a page of history can be written again safely. The legs
+// of one transaction must be saved in the same call, in decoder order.
+func (db *Database) SaveSwapLegs(legs []SwapLeg) error {
+    return db.inTx(context.Background(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+        return copySwapLegs(context.Background(), tx, legs)
+    })
+}
+
+// SaveSyncPage stores a page of a wallet's swap legs together with the
+// cursor past that page, so the cursor never gets ahead of the stored legs
+func (db *Database) SaveSyncPage(legs []SwapLeg, cursor WalletCursor) error {
+    ctx := context.Background()
+    return db.inTx(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+        if err := copySwapLegs(ctx, tx, legs); err != nil {
+            return err
+        }
+        _, err := tx.Exec(ctx, saveWalletCursorQuery, walletCursorArgs(cursor)...)
+        return err
+    })
+}
+
+func copySwapLegs(ctx context.Context, tx pgx.Tx, legs []SwapLeg) error {
+    if len(legs) == 0 {
+        return nil
+    }
+
+    rows := make([][]interface{}, 0, len(legs))
+    legIndex := make(map[string]int)
+    for _, leg := range legs {
+        key := leg.Signature + "|" + leg.Wallet
+        rows = append(rows, []interface{}{
+            leg.Signature,
+            leg.Wallet,
+            legIndex[key],
+            int64(leg.Slot),
+            leg.BlockTime,
+            leg.ProgramID,
+            leg.Pool,
+            leg.InputMint,
+            leg.OutputMint,
+            leg.InputAmount,
+            leg.OutputAmount,
+            leg.InputBalanceBefore,
+            leg.Reserves.SOL,
+            leg.Reserves.Token,
+            leg.Reserves.SOLVault,
+            leg.Reserves.TokenVault,
+        })
+        legIndex[key]++
+    }
+
+    // COPY can't skip conflicts, so copy into a staging table first
+    _, err := tx.Exec(ctx, `CREATE TEMPORARY TABLE swap_legs_staging (LIKE swap_legs INCLUDING DEFAULTS) ON COMMIT DROP`)
+    if err != nil {
+        return err
+    }
+    _, err = tx.CopyFrom(ctx, pgx.Identifier{"swap_legs_staging"}, swapLegColumns, pgx.CopyFromRows(rows))
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(ctx, `INSERT INTO swap_legs SELECT * FROM swap_legs_staging ON CONFLICT DO NOTHING`)
+    return err
+}
+
+// LoadSwapLegs returns the wallet's stored swap legs since the given time,
+// oldest first
+func (db *Database) LoadSwapLegs(walletAddress string, since time.Time) ([]SwapLeg, error) {
+    query := `
+        SELECT signature, wallet_address, slot, block_time, program_id, pool,
+            input_mint, output_mint, input_amount, output_amount, input_balance_before,
+            sol_reserve, token_reserve, sol_vault, token_vault
+        FROM swap_legs
+        WHERE wallet_address = $1 AND block_time >= $2
+        ORDER BY slot, signature, leg_index
+    `
+
+    rows, err := db.Pool.Query(context.Background(), query, walletAddress, since)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var legs []SwapLeg
+    for rows.Next() {
+        var leg SwapLeg
+        var slot int64
+        err := rows.Scan(
+            &leg.Signature,
+            &leg.Wallet,
+            &slot,
+            &leg.BlockTime,
+            &leg.ProgramID,
+            &leg.Pool,
+            &leg.InputMint,
+            &leg.OutputMint,
+            &leg.InputAmount,
+            &leg.OutputAmount,
+            &leg.InputBalanceBefore,
+            &leg.Reserves.SOL,
+            &leg.Reserves.Token,
+            &leg.Reserves.SOLVault,
+            &leg.Reserves.TokenVault,
+        )
+        if err != nil {
+            return nil, err
+        }
+        leg.Slot = uint64(slot)
+        legs = append(legs, leg)
+    }
+    return legs, rows.Err()
+}
+
+var roundTripColumns = []string{
+    "wallet_address", "signature", "token", "seq", "open_signature", "slot", "open_time",
+    "close_time", "quantity", "price", "position_size", "profit", "profit_pct", "cost_basis",
+}
+
+// SaveRoundTrips replaces the wallet's stored round trips with trades,
+// reconstructed with the given cost basis method
+func (db *Database) SaveRoundTrips(walletAddress string, method CostBasisMethod, trades []Trade) error {
+    return db.inTx(context.Background(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+        return copyRoundTrips(context.Background(), tx, walletAddress, method, trades)
+    })
+}
+
+func copyRoundTrips(ctx context.Context, tx pgx.Tx, walletAddress string, method CostBasisMethod, trades []Trade) error {
+    rows := make([][]interface{}, 0, len(trades))
+    seq := make(map[string]int)
+    for _, trade := range trades {
+        key := trade.Signature + "|" + trade.Token
+        rows = append(rows, []interface{}{
+            walletAddress,
+            trade.Signature,
+            trade.Token,
+            seq[key],
+            trade.OpenSignature,
+            int64(trade.Slot),
+            trade.OpenTime,
+            trade.CloseTime,
+            trade.Quantity,
+            trade.Price,
+            trade.PositionSize,
+            trade.Profit,
+            trade.ProfitPct,
+            string(method),
+        })
+        seq[key]++
+    }
+
+    _, err := tx.Exec(ctx, `DELETE FROM round_trips WHERE wallet_address = $1`, walletAddress)
+    if err != nil || len(rows) == 0 {
+        return err
+    }
+    _, err = tx.CopyFrom(ctx, pgx.Identifier{"round_trips"}, roundTripColumns, pgx.CopyFromRows(rows))
+    return err
+}
+
+// LoadRoundTrips returns the wallet's stored round trips closed in
+// [from, to), oldest first. A zero to means no upper bound.
+func (db *Database) LoadRoundTrips(walletAddress string, from, to time.Time) ([]Trade, error) {
+    query := `
+        SELECT signature, open_signature, slot, open_time, close_time, token,
+            quantity, price, position_size, profit, profit_pct
+        FROM round_trips
+        WHERE wallet_address = $1 AND close_time >= $2 AND ($3::TIMESTAMPTZ IS NULL OR close_time < $3)
+        ORDER BY close_time, signature, token, seq
+    `
+
+    var until *time.Time
+    if !to.IsZero() {
+        until = &to
+    }
+    rows, err := db.Pool.Query(context.Background(), query, walletAddress, from, until)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var trades []Trade
+    for rows.Next() {
+        trade := Trade{Action: "sell"}
+        var slot int64
+        err := rows.Scan(
+            &trade.Signature,
+            &trade.OpenSignature,
+            &slot,
+            &trade.OpenTime,
+            &trade.CloseTime,
+            &trade.Token,
+            &trade.Quantity,
+            &trade.Price,
+            &trade.PositionSize,
+            &trade.Profit,
+            &trade.ProfitPct,
+        )
+        if err != nil {
+            return nil, err
+        }
+        trade.Slot = uint64(slot)
+        trades = append(trades, trade)
+    }
+    return trades, rows.Err()
+}
+
+// SaveWalletUpdate writes a wallet's round trips, metrics, daily PnL and
+// sync cursor in one serializable transaction, with the row writes sent as
+// a single batch, so readers never see metrics from one pass next to trades
+// of another, and the cursor never moves past history whose metrics were
+// not saved
+func (db *Database) SaveWalletUpdate(update WalletUpdate) error {
+    ctx := context.Background()
+    walletAddress := update.Metrics.WalletAddress
+
+    batch := &pgx.Batch{}
+    queueWalletMetrics(batch, update.Metrics)
+    queueDailyPnL(batch, walletAddress, update.Metrics.DailyPnLTrend)
+    batch.Queue(saveWalletCursorQuery, walletCursorArgs(update.Cursor)...)
+
+    return db.inTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable}, func(tx pgx.Tx) error {
+        if err := copyRoundTrips(ctx, tx, walletAddress, update.CostBasis, update.Trades); err != nil {
+            return err
+        }
+        return sendBatch(ctx, tx, batch)
+    })
+}
+
+// Transactions that lose a serialization conflict or a deadlock are run
+// again up to this many times, backing off from txRetryBackoff
+const (
+    txMaxRetries   = 5
+    txRetryBackoff = 20 * time.Millisecond
+)
+
+// inTx runs fn in a transaction and commits it, starting over when
+// Postgres aborts it with a serialization failure or deadlock. fn must be
+// safe to run more than once.
+func (db *Database) inTx(ctx context.Context, options pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+    backoff := txRetryBackoff
+    for attempt := 0; ; attempt++ {
+        err := db.runTx(ctx, options, fn)
+        if err == nil || attempt == txMaxRetries || !isRetryableTxError(err) {
+            return err
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+func (db *Database) runTx(ctx context.Context, options pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+    tx, err := db.Pool.BeginTx(ctx, options)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    if err := fn(tx); err != nil {
+        return err
+    }
+    return tx.Commit(ctx)
+}
+
+// isRetryableTxError reports serialization_failure and deadlock_detected
+func isRetryableTxError(err error) bool {
+    var pgErr interface{ SQLState() string }
+    if !errors.As(err, &pgErr) {
+        return false
+    }
+    return pgErr.SQLState() == "40001" || pgErr.SQLState() == "40P01"
+}
+
+// sendBatch sends the queued statements in one round trip and checks each
+func sendBatch(ctx context.Context, tx pgx.Tx, batch *pgx.Batch) error {
+    results := tx.SendBatch(ctx, batch)
+    for i := 0; i < batch.Len(); i++ {
+        if _, err := results.Exec(); err != nil {
+            results.Close()
             return err
         }
     }
-    return nil
+    return results.Close()
 }
@@ -0,0 +1,582 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    raydiumAMMProgramID  = "675kPX9MHTjS2zt1qfr1NYHuzeLXfQM9H24wFSUt1Mp8"
+    raydiumCPMMProgramID = "CPMMoo8L3F4NbTegBCKVNunggL7H1ZpdTHKxQB5qKP1C"
+    raydiumCLMMProgramID = "CAMMCzo5YL8w4VFF8KVHrK22GGUsp5VTaW7grrKgrWqK"
+    orcaWhirlpoolID      = "whirLbMiicVdio4qvUfM5KAg6Ct8VwpYzGff3uctyCc"
+    jupiterV6ProgramID   = "JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4"
+    pumpFunProgramID     = "6EF8rrecthR5Dkzon8Nwu78hRvfCKubJ14M5uBEwF6P"
+)
+
+// SwapLeg is one normalized swap performed by a wallet: InputAmount of
+// InputMint went out, OutputAmount of OutputMint came in. Native SOL and
+// wrapped SOL are both reported as wrappedSOLMint.
+type SwapLeg struct {
+    Signature    string
+    Slot         uint64
+    BlockTime    time.Time
+    Wallet       string
+    ProgramID    string
+    Pool         string
+    InputMint    string
+    OutputMint   string
+    InputAmount  float64
+    OutputAmount float64
+
+    // What the wallet held of InputMint before the transaction, so a sell
+    // can be expressed as a fraction of the wallet's position
+    InputBalanceBefore float64
+
+    // The pool's side of a SOL-quoted leg after the swap
+    Reserves PoolReserves
+}
+
+// PoolReserves is what a pool held after a swap, read from the post balances
+// of the accounts that traded with the wallet. The vaults are the pool's
+// token accounts, so they can be told apart from holders and read again
+// later. Zero means unknown.
+type PoolReserves struct {
+    SOL        float64
+    Token      float64
+    SOLVault   string
+    TokenVault string
+}
+
+// Side is "buy" when SOL was spent on a token, "sell" when a token was sold
+// for SOL, and empty for token-to-token swaps.
+func (l SwapLeg) Side() string {
+    switch {
+    case l.InputMint == wrappedSOLMint && l.OutputMint != wrappedSOLMint:
+        return "buy"
+    case l.OutputMint == wrappedSOLMint && l.InputMint != wrappedSOLMint:
+        return "sell"
+    }
+    return ""
+}
+
+// Token is the non-SOL mint of a SOL-quoted leg
+func (l SwapLeg) Token() string {
+    if l.Side() == "buy" {
+        return l.OutputMint
+    }
+    return l.InputMint
+}
+
+func (l SwapLeg) TokenAmount() float64 {
+    if l.Side() == "buy" {
+        return l.OutputAmount
+    }
+    return l.InputAmount
+}
+
+func (l SwapLeg) SOLAmount() float64 {
+    if l.Side() == "buy" {
+        return l.InputAmount
+    }
+    return l.OutputAmount
+}
+
+// SoldFraction is the share of its position in the token the wallet sold,
+// or 0 for buys and when the prior balance is unknown
+func (l SwapLeg) SoldFraction() float64 {
+    if l.Side() != "sell" || l.InputBalanceBefore <= 0 {
+        return 0
+    }
+    return math.Min(l.InputAmount/l.InputBalanceBefore, 1)
+}
+
+// Price is the execution price in SOL per token
+func (l SwapLeg) Price() float64 {
+    if l.TokenAmount() == 0 {
+        return 0
+    }
+    return l.SOLAmount() / l.TokenAmount()
+}
+
+// UnclassifiedError is returned when a transaction moved SOL against a token
+// for the wallet but none of the registered decoders recognised the programs
+// involved.
+type UnclassifiedError struct {
+    Signature  string
+    ProgramIDs []string
+}
+
+func (e *UnclassifiedError) Error() string {
+    return fmt.Sprintf("unclassified swap %s (programs: %s)", e.Signature, strings.Join(e.ProgramIDs, ", "))
+}
+
+// SwapDecoder turns one invocation of a DEX program, together with the
+// instructions it invoked, into swap legs for the wallet in ctx.
+type SwapDecoder interface {
+    Decode(ctx *swapContext, ix ParsedInstruction, inner []ParsedInstruction) []SwapLeg
+}
+
+type DecoderRegistry struct {
+    decoders map[string]SwapDecoder
+}
+
+func NewDecoderRegistry() *DecoderRegistry {
+    return &DecoderRegistry{decoders: make(map[string]SwapDecoder)}
+}
+
+// DefaultDecoderRegistry knows the programs most copied wallets trade through
+func DefaultDecoderRegistry() *DecoderRegistry {
+    r := NewDecoderRegistry()
+    r.Register(raydiumAMMProgramID, ammDecoder{pool: raydiumAMMPool})
+    r.Register(raydiumCPMMProgramID, ammDecoder{pool: anchorPool(3, "swap_base_input", "swap_base_output")})
+    r.Register(raydiumCLMMProgramID, ammDecoder{pool: anchorPool(2, "swap", "swap_v2")})
+    r.Register(orcaWhirlpoolID, ammDecoder{pool: whirlpoolPool})
+    r.Register(jupiterV6ProgramID, ammDecoder{pool: jupiterRoute})
+    r.Register(pumpFunProgramID, ammDecoder{pool: anchorPool(3, "buy", "sell"), solFromBalance: true})
+    return r
+}
+
+func (r *DecoderRegistry) Register(programID string, decoder SwapDecoder) {
+    r.decoders[programID] = decoder
+}
+
+// DecodeTransaction returns every swap leg walletAddress performed in tx.
+// Top-level instructions of known programs are decoded with all of their
+// inner instructions, so a Jupiter route is one leg rather than one per hop.
+// For unknown top-level programs (bots, routers) the inner instructions are
+// searched for known programs invoked by CPI.
+func (r *DecoderRegistry) DecodeTransaction(walletAddress string, tx *SolanaTransaction) ([]SwapLeg, error) {
+    if tx.Meta == nil {
+        return nil, fmt.Errorf("transaction has no meta")
+    }
+    if tx.Meta.Err != nil {
+        return nil, errFailedTransaction
+    }
+
+    ctx := newSwapContext(walletAddress, tx)
+    innerByIndex := make(map[int][]ParsedInstruction)
+    for _, inner := range tx.Meta.InnerInstructions {
+        innerByIndex[inner.Index] = inner.Instructions
+    }
+
+    var legs []SwapLeg
+    for i, ix := range tx.Transaction.Message.Instructions {
+        inner := innerByIndex[i]
+        if decoder, ok := r.decoders[ix.ProgramID]; ok {
+            legs = append(legs, decoder.Decode(ctx, ix, inner)...)
+            continue
+        }
+
+        for j := 0; j < len(inner); j++ {
+            decoder, ok := r.decoders[inner[j].ProgramID]
+            if !ok {
+                continue
+            }
+            end := j + 1
+            for end < len(inner) && inner[end].stackHeight() > inner[j].stackHeight() {
+                end++
+            }
+            legs = append(legs, decoder.Decode(ctx, inner[j], inner[j+1:end])...)
+            j = end - 1
+        }
+    }
+
+    if len(legs) > 0 {
+        return legs, nil
+    }
+
+    // Nothing recognised: tell a swap through an unknown program apart from
+    // transfers and other activity by looking at the balance changes
+    if _, err := DecodeSwap(walletAddress, tx); err != nil {
+        return nil, err
+    }
+    return nil, &UnclassifiedError{Signature: ctx.signature, ProgramIDs: tx.programIDs()}
+}
+
+type tokenAccount struct {
+    Mint     string
+    Owner    string
+    Decimals int
+}
+
+// swapContext carries what decoders need to resolve transfers: the wallet,
+// the owner and mint of every token account touched, and block metadata.
+type swapContext struct {
+    wallet        string
+    tx            *SolanaTransaction
+    signature     string
+    blockTime     time.Time
+    tokenAccounts map[string]tokenAccount
+}
+
+func newSwapContext(walletAddress string, tx *SolanaTransaction) *swapContext {
+    ctx := &swapContext{
+        wallet:        walletAddress,
+        tx:            tx,
+        tokenAccounts: make(map[string]tokenAccount),
+    }
+    if len(tx.Transaction.Signatures) > 0 {
+        ctx.signature = tx.Transaction.Signatures[0]
+    }
+    if tx.BlockTime != nil {
+        ctx.blockTime = time.Unix(*tx.BlockTime, 0).UTC()
+    }
+
+    keys := tx.Transaction.Message.AccountKeys
+    for _, balances := range [][]TokenBalance{tx.Meta.PreTokenBalances, tx.Meta.PostTokenBalances} {
+        for _, balance := range balances {
+            if balance.AccountIndex < len(keys) {
+                ctx.tokenAccounts[keys[balance.AccountIndex].Pubkey] = tokenAccount{
+                    Mint:     balance.Mint,
+                    Owner:    balance.Owner,
+                    Decimals: balance.UITokenAmount.Decimals,
+                }
+            }
+        }
+    }
+
+    // Accounts opened and closed within the transaction, like the temporary
+    // wrapped SOL account of a Jupiter route, are in neither balance list.
+    // Resolve them from the instructions that created them instead, or at
+    // least their mint from transferChecked.
+    for _, ix := range tx.Transaction.Message.Instructions {
+        ctx.resolveTokenAccounts(ix)
+    }
+    for _, inner := range tx.Meta.InnerInstructions {
+        for _, ix := range inner.Instructions {
+            ctx.resolveTokenAccounts(ix)
+        }
+    }
+    return ctx
+}
+
+// parsedAccountSetup is the parsed form of spl-token initializeAccount*,
+// associated token account create and transferChecked instructions
+type parsedAccountSetup struct {
+    Type string `json:"type"`
+    Info struct {
+        Account     string `json:"account"`
+        Mint        string `json:"mint"`
+        Owner       string `json:"owner"`
+        Wallet      string `json:"wallet"`
+        Source      string `json:"source"`
+        Destination string `json:"destination"`
+        TokenAmount struct {
+            Decimals int `json:"decimals"`
+        } `json:"tokenAmount"`
+    } `json:"info"`
+}
+
+// resolveTokenAccounts adds the token accounts ix creates, or the accounts
+// of a transferChecked not seen yet, to the context
+func (ctx *swapContext) resolveTokenAccounts(ix ParsedInstruction) {
+    var parsed parsedAccountSetup
+    if len(ix.Parsed) == 0 || json.Unmarshal(ix.Parsed, &parsed) != nil {
+        return
+    }
+    info := parsed.Info
+
+    switch {
+    case strings.HasPrefix(ix.Program, "spl-token") && strings.HasPrefix(parsed.Type, "initializeAccount"):
+        ctx.tokenAccounts[info.Account] = tokenAccount{Mint: info.Mint, Owner: info.Owner, Decimals: ctx.mintDecimals(info.Mint)}
+    case ix.Program == "spl-associated-token-account" && (parsed.Type == "create" || parsed.Type == "createIdempotent"):
+        if _, known := ctx.tokenAccounts[info.Account]; !known {
+            ctx.tokenAccounts[info.Account] = tokenAccount{Mint: info.Mint, Owner: info.Wallet, Decimals: ctx.mintDecimals(info.Mint)}
+        }
+    case strings.HasPrefix(ix.Program, "spl-token") && parsed.Type == "transferChecked" && info.Mint != "":
+        for _, address := range []string{info.Source, info.Destination} {
+            if _, known := ctx.tokenAccounts[address]; !known {
+                ctx.tokenAccounts[address] = tokenAccount{Mint: info.Mint, Decimals: info.TokenAmount.Decimals}
+            }
+        }
+    }
+}
+
+// mintDecimals returns the decimals of mint as seen on another account in
+// the transaction, or 0 if it is unknown
+func (ctx *swapContext) mintDecimals(mint string) int {
+    if mint == wrappedSOLMint {
+        return 9
+    }
+    for _, account := range ctx.tokenAccounts {
+        if account.Mint == mint {
+            return account.Decimals
+        }
+    }
+    return 0
+}
+
+// walletBalanceBefore is what the wallet held of mint before the transaction
+func (ctx *swapContext) walletBalanceBefore(mint string) float64 {
+    if mint == wrappedSOLMint {
+        return 0
+    }
+    var total float64
+    for _, balance := range ctx.tx.Meta.PreTokenBalances {
+        if balance.Owner == ctx.wallet && balance.Mint == mint {
+            total += balance.uiAmount()
+        }
+    }
+    return total
+}
+
+// parsedTransfer is the parsed form of system and spl-token transfers
+type parsedTransfer struct {
+    Type string `json:"type"`
+    Info struct {
+        Source      string `json:"source"`
+        Destination string `json:"destination"`
+        Authority   string `json:"authority"`
+        Amount      string `json:"amount"`
+        Lamports    uint64 `json:"lamports"`
+        TokenAmount struct {
+            UIAmountString string `json:"uiAmountString"`
+        } `json:"tokenAmount"`
+    } `json:"info"`
+}
+
+// walletFlows nets the token and SOL transfers in instructions from the
+// wallet's point of view: negative amounts left the wallet, positive arrived.
+func (ctx *swapContext) walletFlows(instructions []ParsedInstruction) map[string]float64 {
+    flows := make(map[string]float64)
+    for _, ix := range instructions {
+        var parsed parsedTransfer
+        if len(ix.Parsed) == 0 || json.Unmarshal(ix.Parsed, &parsed) != nil {
+            continue
+        }
+        info := parsed.Info
+
+        switch {
+        case ix.Program == "system" && parsed.Type == "transfer":
+            amount := float64(info.Lamports) / lamportsPerSOL
+            if info.Source == ctx.wallet {
+                flows[wrappedSOLMint] -= amount
+            }
+            if info.Destination == ctx.wallet {
+                flows[wrappedSOLMint] += amount
+            }
+        case strings.HasPrefix(ix.Program, "spl-token") && (parsed.Type == "transfer" || parsed.Type == "transferChecked"):
+            source, sourceKnown := ctx.tokenAccounts[info.Source]
+            destination, destinationKnown := ctx.tokenAccounts[info.Destination]
+            account := source
+            if !sourceKnown {
+                account = destination
+            }
+            if !sourceKnown && !destinationKnown {
+                continue
+            }
+
+            amount, err := strconv.ParseFloat(info.TokenAmount.UIAmountString, 64)
+            if err != nil {
+                raw, err := strconv.ParseFloat(info.Amount, 64)
+                if err != nil {
+                    continue
+                }
+                amount = raw / math.Pow10(account.Decimals)
+            }
+
+            if sourceKnown && (source.Owner == ctx.wallet || info.Authority == ctx.wallet) {
+                flows[account.Mint] -= amount
+            }
+            if destinationKnown && destination.Owner == ctx.wallet {
+                flows[account.Mint] += amount
+            }
+        }
+    }
+    return flows
+}
+
+// poolReserves reads the pool's SOL and token reserves after the swap from
+// the token accounts on the other side of the wallet's transfers. A pool that
+// holds native SOL, like a Pump.fun bonding curve, has no wrapped SOL vault,
+// so the pool account's own lamports are used instead.
+func (ctx *swapContext) poolReserves(instructions []ParsedInstruction, pool, token string) PoolReserves {
+    keys := ctx.tx.Transaction.Message.AccountKeys
+    postBalances := make(map[string]TokenBalance)
+    for _, balance := range ctx.tx.Meta.PostTokenBalances {
+        if balance.AccountIndex < len(keys) {
+            postBalances[keys[balance.AccountIndex].Pubkey] = balance
+        }
+    }
+
+    var reserves PoolReserves
+    for _, ix := range instructions {
+        var parsed parsedTransfer
+        if !strings.HasPrefix(ix.Program, "spl-token") || len(ix.Parsed) == 0 || json.Unmarshal(ix.Parsed, &parsed) != nil {
+            continue
+        }
+        if parsed.Type != "transfer" && parsed.Type != "transferChecked" {
+            continue
+        }
+
+        source := ctx.tokenAccounts[parsed.Info.Source]
+        counterparty := parsed.Info.Destination
+        if source.Owner != ctx.wallet && parsed.Info.Authority != ctx.wallet {
+            if ctx.tokenAccounts[parsed.Info.Destination].Owner != ctx.wallet {
+                continue
+            }
+            counterparty = parsed.Info.Source
+        }
+
+        balance, ok := postBalances[counterparty]
+        if !ok || balance.Owner == ctx.wallet {
+            continue
+        }
+        switch balance.Mint {
+        case wrappedSOLMint:
+            if amount := balance.uiAmount(); amount > reserves.SOL {
+                reserves.SOL = amount
+                reserves.SOLVault = counterparty
+            }
+        case token:
+            if amount := balance.uiAmount(); amount > reserves.Token {
+                reserves.Token = amount
+                reserves.TokenVault = counterparty
+            }
+        }
+    }
+
+    if reserves.SOL == 0 {
+        for i, key := range keys {
+            if key.Pubkey == pool && i < len(ctx.tx.Meta.PostBalances) {
+                reserves.SOL = float64(ctx.tx.Meta.PostBalances[i]) / lamportsPerSOL
+                break
+            }
+        }
+    }
+    return reserves
+}
+
+// ammDecoder covers programs whose swaps are visible as token transfers in
+// their inner instructions. pool reports the pool account of a swap
+// instruction, or false when the instruction is not a swap (deposits,
+// account setup). Programs that pay SOL out by editing lamports directly,
+// like Pump.fun's bonding curve, set solFromBalance so the SOL side is taken
+// from the wallet's balance change instead.
+type ammDecoder struct {
+    pool           func(ix ParsedInstruction) (string, bool)
+    solFromBalance bool
+}
+
+func (d ammDecoder) Decode(ctx *swapContext, ix ParsedInstruction, inner []ParsedInstruction) []SwapLeg {
+    pool, ok := d.pool(ix)
+    if !ok {
+        return nil
+    }
+
+    flows := ctx.walletFlows(inner)
+    if d.solFromBalance && flows[wrappedSOLMint] == 0 {
+        if lamports, err := walletLamportDelta(ctx.wallet, ctx.tx); err == nil {
+            flows[wrappedSOLMint] = float64(lamports) / lamportsPerSOL
+        }
+    }
+
+    var inputMint, outputMint string
+    var inputAmount, outputAmount float64
+    mints := make([]string, 0, len(flows))
+    for mint := range flows {
+        mints = append(mints, mint)
+    }
+    sort.Strings(mints)
+    for _, mint := range mints {
+        amount := flows[mint]
+        if amount < 0 && -amount > inputAmount {
+            inputMint, inputAmount = mint, -amount
+        }
+        if amount > 0 && amount > outputAmount {
+            outputMint, outputAmount = mint, amount
+        }
+    }
+    if inputMint == "" || outputMint == "" {
+        return nil
+    }
+
+    leg := SwapLeg{
+        Signature:    ctx.signature,
+        Slot:         ctx.tx.Slot,
+        BlockTime:    ctx.blockTime,
+        Wallet:       ctx.wallet,
+        ProgramID:    ix.ProgramID,
+        Pool:         pool,
+        InputMint:    inputMint,
+        OutputMint:   outputMint,
+        InputAmount:  inputAmount,
+        OutputAmount: outputAmount,
+
+        InputBalanceBefore: ctx.walletBalanceBefore(inputMint),
+    }
+    if leg.Side() != "" {
+        leg.Reserves = ctx.poolReserves(inner, pool, leg.Token())
+    }
+    return []SwapLeg{leg}
+}
+
+// anchorDiscriminator is the 8-byte instruction tag Anchor programs prefix
+// to instruction data: sha256("global:<name>")[:8]
+func anchorDiscriminator(name string) []byte {
+    sum := sha256.Sum256([]byte("global:" + name))
+    return sum[:8]
+}
+
+// anchorPool recognises the named Anchor instructions and reports the
+// account at poolIndex as the pool.
+func anchorPool(poolIndex int, names ...string) func(ix ParsedInstruction) (string, bool) {
+    var discriminators [][]byte
+    for _, name := range names {
+        discriminators = append(discriminators, anchorDiscriminator(name))
+    }
+    return func(ix ParsedInstruction) (string, bool) {
+        data, err := Base58Decode(ix.Data)
+        if err != nil || len(data) < 8 || poolIndex >= len(ix.Accounts) {
+            return "", false
+        }
+        for _, discriminator := range discriminators {
+            if bytes.Equal(data[:8], discriminator) {
+                return ix.Accounts[poolIndex], true
+            }
+        }
+        return "", false
+    }
+}
+
+// Raydium AMM v4 is not an Anchor program: swap_base_in is tag 9 and
+// swap_base_out is tag 11, and the AMM id is the second account.
+func raydiumAMMPool(ix ParsedInstruction) (string, bool) {
+    data, err := Base58Decode(ix.Data)
+    if err != nil || len(data) == 0 || len(ix.Accounts) < 2 {
+        return "", false
+    }
+    if data[0] != 9 && data[0] != 11 {
+        return "", false
+    }
+    return ix.Accounts[1], true
+}
+
+// Whirlpool's swap takes the pool as the third account, swap_v2 as the fifth
+var (
+    whirlpoolSwap   = anchorPool(2, "swap")
+    whirlpoolSwapV2 = anchorPool(4, "swap_v2")
+)
+
+func whirlpoolPool(ix ParsedInstruction) (string, bool) {
+    if pool, ok := whirlpoolSwap(ix); ok {
+        return pool, true
+    }
+    return whirlpoolSwapV2(ix)
+}
+
+// A Jupiter route may cross several pools, so it carries no single pool
+var jupiterRouteInstruction = anchorPool(0, "route", "shared_accounts_route", "exact_out_route", "shared_accounts_exact_out_route")
+
+func jupiterRoute(ix ParsedInstruction) (string, bool) {
+    _, ok := jupiterRouteInstruction(ix)
+    return "", ok
+}
@@ -1,50 +1,135 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "fmt"
     "log"
 
     "github.com/shopspring/decimal"
 )
 
+var errSignalAlreadyProcessed = errors.New("signal already processed")
+
+// Execution modes selected by EXECUTION_MODE
+const (
+    ExecutionPaper = "paper"
+    ExecutionLive  = "live"
+)
+
+// Fill is how a trade actually executed: the token quantity bought or sold,
+// the realized price in SOL per token after price impact and swap fees, the
+// price the signal expected, and the network fees paid in SOL
+type Fill struct {
+    Quantity      decimal.Decimal
+    Price         decimal.Decimal
+    ExpectedPrice decimal.Decimal
+    Fee           decimal.Decimal
+    Signature     string // Our transaction; empty for paper fills
+}
+
+// SlippageBps is how much worse than expected the fill was, in basis points
+func (f Fill) SlippageBps(action string) float64 {
+    if !f.ExpectedPrice.IsPositive() {
+        return 0
+    }
+    slippage := f.Price.Sub(f.ExpectedPrice).Div(f.ExpectedPrice).InexactFloat64() * 10000
+    if action == "sell" {
+        return -slippage
+    }
+    return slippage
+}
+
+// Executor carries out a sized signal and reports the fill
+type Executor interface {
+    Execute(ctx context.Context, signal TradeSignal) (Fill, error)
+}
+
+// ExecutionEngineModule claims each signal once, hands it to the Executor
+// and books the fill in the Portfolio
 type ExecutionEngineModule struct {
-    SerumAPIKey string
-    Portfolio   *Portfolio
-    // Add other necessary fields, e.g., API endpoint, authentication tokens
+    Executor  Executor
+    Portfolio *Portfolio
+    DB        Store
 }
 
-func InitializeExecutionEngine(config Config, portfolio *Portfolio) *ExecutionEngineModule {
+func InitializeExecutionEngine(db Store, config Config, portfolio *Portfolio, rpc SolanaRPC, pools *PoolPriceSource, prices PriceSource) *ExecutionEngineModule {
+    var executor Executor = NewPaperExecutor(config, pools, prices)
+    if config.ExecutionMode == ExecutionLive {
+        live, err := NewJupiterExecutor(config, rpc)
+        if err != nil {
+            log.Fatalf("Unable to initialize live executor: %v\n", err)
+        }
+        executor = live
+    }
+    log.Printf("Execution mode: %s\n", config.ExecutionMode)
+
     return &ExecutionEngineModule{
-        SerumAPIKey: config.SerumAPIKey,
-        Portfolio:   portfolio,
+        Executor:  executor,
+        Portfolio: portfolio,
+        DB:        db,
     }
 }
 
-func (eem *ExecutionEngineModule) ExecuteTrade(signal TradeSignal) error {
-    // In paper trading mode, simulate the trade by updating the virtual portfolio
-    quantity := decimal.NewFromFloat(signal.Quantity)
-    price := decimal.NewFromFloat(signal.Price)
+func (eem *ExecutionEngineModule) ExecuteTrade(ctx context.Context, signal TradeSignal) error {
+    // Act on each source transaction at most once, across restarts
+    if signal.Signature != "" {
+        claimed, err := eem.DB.ClaimSignal(signal)
+        if err != nil {
+            return err
+        }
+        if !claimed {
+            return errSignalAlreadyProcessed
+        }
+    }
 
+    // Refuse before executing what the portfolio could not book
     switch signal.Action {
     case "buy":
-        success := eem.Portfolio.Buy(signal.Token, quantity, price)
-        if !success {
-            log.Printf("Failed to buy %s - Not enough balance.\n", signal.Token)
-        } else {
-            log.Printf("Simulated Buy: %s - Quantity: %s at Price: %s\n", signal.Token, quantity.String(), price.String())
+        cost := decimal.NewFromFloat(signal.Quantity).Mul(decimal.NewFromFloat(signal.Price))
+        if eem.Portfolio.GetBalance().LessThan(cost) {
+            return fmt.Errorf("failed to buy %s - not enough balance", signal.Token)
         }
     case "sell":
-        success := eem.Portfolio.Sell(signal.Token, quantity, price)
+        if !eem.Portfolio.SourcePosition(signal.Token, signal.WalletAddress).IsPositive() {
+            return fmt.Errorf("failed to sell %s - not enough holdings", signal.Token)
+        }
+    default:
+        return fmt.Errorf("unknown action: %s", signal.Action)
+    }
+
+    fill, err := eem.Executor.Execute(ctx, signal)
+    if err != nil {
+        return fmt.Errorf("executing %s of %s: %w", signal.Action, signal.Token, err)
+    }
+
+    switch signal.Action {
+    case "buy":
+        sources := signal.ContributingWallets
+        if len(sources) == 0 {
+            sources = []string{signal.WalletAddress}
+        }
+        success := eem.Portfolio.BuyFor(signal.Token, sources, fill)
         if !success {
-            log.Printf("Failed to sell %s - Not enough holdings.\n", signal.Token)
+            return fmt.Errorf("failed to book buy of %s - not enough balance", signal.Token)
+        }
+    case "sell":
+        success := false
+        if signal.LotID != 0 {
+            success = eem.Portfolio.SellLot(signal.Token, signal.LotID, fill, signal.Reason, signal.TiersTaken)
         } else {
-            log.Printf("Simulated Sell: %s - Quantity: %s at Price: %s\n", signal.Token, quantity.String(), price.String())
+            success = eem.Portfolio.Sell(signal.Token, signal.WalletAddress, fill)
+        }
+        if !success {
+            return fmt.Errorf("failed to book sell of %s - not enough holdings", signal.Token)
         }
-    default:
-        log.Printf("Unknown action: %s\n", signal.Action)
     }
+    log.Printf("Filled %s: %s - Quantity: %s at Price: %s (expected %s, slippage %.1f bps, fee %s SOL)\n",
+        signal.Action, signal.Token, fill.Quantity.String(), fill.Price.String(),
+        fill.ExpectedPrice.String(), fill.SlippageBps(signal.Action), fill.Fee.String())
 
     // Log the transaction
-    log.Printf("Trade Executed: %+v\n", signal)
+    log.Printf("Trade Executed: %+v (fill %+v)\n", signal, fill)
 
     return nil
 }
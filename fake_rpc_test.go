@@ -0,0 +1,192 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+)
+
+// fakeRPC is an in-memory SolanaRPC. Signatures are kept newest first, as
+// the node returns them; transactions, mints, holders and accounts missing
+// from the maps are reported the way the node reports them.
+type fakeRPC struct {
+    signatures   []SignatureInfo
+    transactions map[string]*SolanaTransaction
+    mints        map[string]*MintAccount
+    holders      map[string][]TokenAccountBalance
+    accountData  map[string][]byte
+    balances     map[string]float64
+    statuses     map[string]*SignatureStatus
+    blockHeight  uint64 // Advances by one on every getBlockHeight call
+
+    // Errors returned for one transaction of a batch, or by every call of a
+    // method
+    transactionErrors map[string]error
+    methodErrors      map[string]error
+
+    sent  [][]byte
+    calls map[string]int
+    mutex sync.Mutex
+}
+
+func newFakeRPC() *fakeRPC {
+    return &fakeRPC{
+        transactions:      make(map[string]*SolanaTransaction),
+        mints:             make(map[string]*MintAccount),
+        holders:           make(map[string][]TokenAccountBalance),
+        accountData:       make(map[string][]byte),
+        balances:          make(map[string]float64),
+        statuses:          make(map[string]*SignatureStatus),
+        transactionErrors: make(map[string]error),
+        methodErrors:      make(map[string]error),
+        calls:             make(map[string]int),
+    }
+}
+
+// call counts a call of method and returns the error it should fail with
+func (f *fakeRPC) call(method string) error {
+    f.calls[method]++
+    return f.methodErrors[method]
+}
+
+func (f *fakeRPC) callCount(method string) int {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    return f.calls[method]
+}
+
+func (f *fakeRPC) GetSignaturesForAddress(ctx context.Context, address string, opts SignaturesOptions) ([]SignatureInfo, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getSignaturesForAddress"); err != nil {
+        return nil, err
+    }
+
+    start := 0
+    if opts.Before != "" {
+        start = len(f.signatures)
+        for i, sig := range f.signatures {
+            if sig.Signature == opts.Before {
+                start = i + 1
+                break
+            }
+        }
+    }
+    var page []SignatureInfo
+    for _, sig := range f.signatures[start:] {
+        if sig.Signature == opts.Until || (opts.Limit > 0 && len(page) == opts.Limit) {
+            break
+        }
+        page = append(page, sig)
+    }
+    return page, nil
+}
+
+func (f *fakeRPC) GetTransaction(ctx context.Context, signature string) (*SolanaTransaction, error) {
+    txs, err := f.GetTransactions(ctx, []string{signature})
+    if err != nil {
+        return nil, err
+    }
+    if txs[0] == nil {
+        return nil, errTransactionNotFound
+    }
+    return txs[0], nil
+}
+
+func (f *fakeRPC) GetTransactions(ctx context.Context, signatures []string) ([]*SolanaTransaction, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getTransaction"); err != nil {
+        return nil, err
+    }
+
+    txs := make([]*SolanaTransaction, len(signatures))
+    for i, signature := range signatures {
+        if err := f.transactionErrors[signature]; err != nil {
+            return nil, fmt.Errorf("transaction %s: %w", signature, err)
+        }
+        txs[i] = f.transactions[signature]
+    }
+    return txs, nil
+}
+
+func (f *fakeRPC) GetMintAccount(ctx context.Context, mint string) (*MintAccount, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getAccountInfo"); err != nil {
+        return nil, err
+    }
+    account, ok := f.mints[mint]
+    if !ok {
+        return nil, errAccountNotFound
+    }
+    return account, nil
+}
+
+func (f *fakeRPC) GetTokenLargestAccounts(ctx context.Context, mint string) ([]TokenAccountBalance, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getTokenLargestAccounts"); err != nil {
+        return nil, err
+    }
+    return f.holders[mint], nil
+}
+
+func (f *fakeRPC) SendTransaction(ctx context.Context, tx []byte) (string, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("sendTransaction"); err != nil {
+        return "", err
+    }
+    f.sent = append(f.sent, tx)
+    return fmt.Sprintf("sent-%d", len(f.sent)), nil
+}
+
+func (f *fakeRPC) GetSignatureStatus(ctx context.Context, signature string) (*SignatureStatus, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getSignatureStatuses"); err != nil {
+        return nil, err
+    }
+    return f.statuses[signature], nil
+}
+
+func (f *fakeRPC) GetBlockHeight(ctx context.Context) (uint64, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getBlockHeight"); err != nil {
+        return 0, err
+    }
+    f.blockHeight++
+    return f.blockHeight, nil
+}
+
+func (f *fakeRPC) GetAccountData(ctx context.Context, address string) ([]byte, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getAccountInfo"); err != nil {
+        return nil, err
+    }
+    data, ok := f.accountData[address]
+    if !ok {
+        return nil, errAccountNotFound
+    }
+    return data, nil
+}
+
+func (f *fakeRPC) GetTokenAccountBalances(ctx context.Context, accounts []string) ([]float64, error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if err := f.call("getTokenAccountBalance"); err != nil {
+        return nil, err
+    }
+    balances := make([]float64, len(accounts))
+    for i, account := range accounts {
+        balance, ok := f.balances[account]
+        if !ok {
+            return nil, fmt.Errorf("balance of %s: %w", account, errAccountNotFound)
+        }
+        balances[i] = balance
+    }
+    return balances, nil
+}
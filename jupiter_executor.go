@@ -0,0 +1,422 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// How often a submitted transaction's status is polled
+const confirmPollInterval = 500 * time.Millisecond
+
+// Attempts at reading back a confirmed transaction, which a lagging node
+// may not serve yet
+const landedFetchAttempts = 3
+
+// Base fee per signature, for estimating the fee of a swap we could not
+// read back
+const lamportsPerSignature = 5000
+
+// JupiterExecutor trades for real through the Jupiter swap API: it asks for
+// a quote, has Jupiter build the swap transaction, signs it with our key,
+// submits it over RPC and waits for confirmation. The fill is read back
+// from the landed transaction.
+//
+// A submitted transaction can land until its blockhash expires, so we wait
+// for that rather than a fixed time; ConfirmTimeout only applies when
+// Jupiter does not tell us the blockhash's last valid block height.
+type JupiterExecutor struct {
+    APIURL         string
+    RPC            SolanaRPC
+    HTTPClient     *http.Client
+    Key            ed25519.PrivateKey
+    PublicKey      string
+    SlippageBps    int
+    PriorityFee    string // "auto" or lamports
+    ConfirmTimeout time.Duration
+    PollInterval   time.Duration
+    Decoders       *DecoderRegistry
+}
+
+func NewJupiterExecutor(config Config, rpc SolanaRPC) (*JupiterExecutor, error) {
+    key, err := parseKeypair(config.WalletKeypair)
+    if err != nil {
+        return nil, err
+    }
+
+    return &JupiterExecutor{
+        APIURL:         strings.TrimRight(config.JupiterAPIURL, "/"),
+        RPC:            rpc,
+        HTTPClient:     &http.Client{Timeout: config.RPCTimeout},
+        Key:            key,
+        PublicKey:      Base58Encode(key.Public().(ed25519.PublicKey)),
+        SlippageBps:    config.SlippageBps,
+        PriorityFee:    config.PriorityFee,
+        ConfirmTimeout: config.ConfirmTimeout,
+        PollInterval:   confirmPollInterval,
+        Decoders:       DefaultDecoderRegistry(),
+    }, nil
+}
+
+// parseKeypair accepts a 64-byte secret key either as a solana-keygen JSON
+// byte array or as base58
+func parseKeypair(value string) (ed25519.PrivateKey, error) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return nil, errors.New("WALLET_KEYPAIR is not set")
+    }
+
+    var secret []byte
+    if strings.HasPrefix(value, "[") {
+        var ints []int
+        if err := json.Unmarshal([]byte(value), &ints); err != nil {
+            return nil, fmt.Errorf("parsing keypair: %w", err)
+        }
+        for _, b := range ints {
+            secret = append(secret, byte(b))
+        }
+    } else {
+        var err error
+        secret, err = Base58Decode(value)
+        if err != nil {
+            return nil, fmt.Errorf("parsing keypair: %w", err)
+        }
+    }
+    if len(secret) != ed25519.PrivateKeySize {
+        return nil, fmt.Errorf("keypair is %d bytes, want %d", len(secret), ed25519.PrivateKeySize)
+    }
+    return ed25519.PrivateKey(secret), nil
+}
+
+// jupiterQuote keeps the raw quote, which /swap wants back verbatim
+type jupiterQuote struct {
+    raw       json.RawMessage
+    InAmount  string `json:"inAmount"`
+    OutAmount string `json:"outAmount"`
+}
+
+// jupiterSwap is the /swap response: the unsigned transaction, the last
+// block height at which its blockhash is valid, and the priority fee it pays
+type jupiterSwap struct {
+    SwapTransaction           string `json:"swapTransaction"`
+    LastValidBlockHeight      uint64 `json:"lastValidBlockHeight"`
+    PrioritizationFeeLamports uint64 `json:"prioritizationFeeLamports"`
+}
+
+func (je *JupiterExecutor) Execute(ctx context.Context, signal TradeSignal) (Fill, error) {
+    mint, err := je.RPC.GetMintAccount(ctx, signal.Token)
+    if err != nil {
+        return Fill{}, err
+    }
+    tokenUnit := math.Pow10(mint.Decimals)
+
+    inputMint, outputMint := wrappedSOLMint, signal.Token
+    amount := uint64(signal.Quantity * signal.Price * lamportsPerSOL)
+    if signal.Action == "sell" {
+        inputMint, outputMint = signal.Token, wrappedSOLMint
+        amount = uint64(signal.Quantity * tokenUnit)
+    }
+    if amount == 0 {
+        return Fill{}, errors.New("trade amount rounds to zero")
+    }
+
+    quote, err := je.quote(ctx, inputMint, outputMint, amount)
+    if err != nil {
+        return Fill{}, err
+    }
+    swap, unsigned, err := je.swapTransaction(ctx, quote)
+    if err != nil {
+        return Fill{}, err
+    }
+    tx, err := signTransaction(unsigned, je.Key)
+    if err != nil {
+        return Fill{}, err
+    }
+
+    signature, err := je.RPC.SendTransaction(ctx, tx)
+    if err != nil {
+        return Fill{}, err
+    }
+    log.Printf("Submitted %s of %s: %s\n", signal.Action, signal.Token, signature)
+
+    if err := je.confirm(ctx, signature, swap.LastValidBlockHeight); err != nil {
+        return Fill{}, fmt.Errorf("transaction %s: %w", signature, err)
+    }
+
+    landed := je.landedTransaction(ctx, signature)
+    if fill, ok := je.landedFill(landed, signature, signal); ok {
+        return fill, nil
+    }
+
+    // Fall back to the quoted amounts when the landed swap can't be decoded,
+    // and estimate the fee if we could not read the transaction at all
+    fee := decimal.New(int64(lamportsPerSignature*signatureCount(tx)+swap.PrioritizationFeeLamports), -9)
+    if landed != nil && landed.Meta != nil {
+        fee = decimal.New(int64(landed.Meta.Fee), -9)
+    }
+    inAmount, _ := strconv.ParseFloat(quote.InAmount, 64)
+    outAmount, _ := strconv.ParseFloat(quote.OutAmount, 64)
+    quantity, solAmount := outAmount/tokenUnit, inAmount/lamportsPerSOL
+    if signal.Action == "sell" {
+        quantity, solAmount = inAmount/tokenUnit, outAmount/lamportsPerSOL
+    }
+    if quantity <= 0 {
+        return Fill{}, fmt.Errorf("transaction %s: empty quote", signature)
+    }
+    return Fill{
+        Quantity:      decimal.NewFromFloat(quantity),
+        Price:         decimal.NewFromFloat(solAmount / quantity),
+        ExpectedPrice: decimal.NewFromFloat(signal.Price),
+        Fee:           fee,
+        Signature:     signature,
+    }, nil
+}
+
+func (je *JupiterExecutor) quote(ctx context.Context, inputMint, outputMint string, amount uint64) (jupiterQuote, error) {
+    query := url.Values{}
+    query.Set("inputMint", inputMint)
+    query.Set("outputMint", outputMint)
+    query.Set("amount", strconv.FormatUint(amount, 10))
+    query.Set("slippageBps", strconv.Itoa(je.SlippageBps))
+
+    body, err := je.do(ctx, http.MethodGet, je.APIURL+"/quote?"+query.Encode(), nil)
+    if err != nil {
+        return jupiterQuote{}, fmt.Errorf("quote: %w", err)
+    }
+
+    var quote jupiterQuote
+    if err := json.Unmarshal(body, &quote); err != nil {
+        return jupiterQuote{}, fmt.Errorf("decoding quote: %w", err)
+    }
+    quote.raw = body
+    return quote, nil
+}
+
+// swapTransaction has Jupiter build the unsigned swap transaction for quote
+func (je *JupiterExecutor) swapTransaction(ctx context.Context, quote jupiterQuote) (jupiterSwap, []byte, error) {
+    var priorityFee interface{} = je.PriorityFee
+    if lamports, err := strconv.ParseUint(je.PriorityFee, 10, 64); err == nil {
+        priorityFee = lamports
+    }
+
+    request, err := json.Marshal(map[string]interface{}{
+        "quoteResponse":             quote.raw,
+        "userPublicKey":             je.PublicKey,
+        "wrapAndUnwrapSol":          true,
+        "dynamicComputeUnitLimit":   true,
+        "prioritizationFeeLamports": priorityFee,
+    })
+    if err != nil {
+        return jupiterSwap{}, nil, err
+    }
+
+    body, err := je.do(ctx, http.MethodPost, je.APIURL+"/swap", request)
+    if err != nil {
+        return jupiterSwap{}, nil, fmt.Errorf("swap: %w", err)
+    }
+
+    var swap jupiterSwap
+    if err := json.Unmarshal(body, &swap); err != nil {
+        return jupiterSwap{}, nil, fmt.Errorf("decoding swap response: %w", err)
+    }
+    tx, err := base64.StdEncoding.DecodeString(swap.SwapTransaction)
+    return swap, tx, err
+}
+
+func (je *JupiterExecutor) do(ctx context.Context, method, url string, reqBody []byte) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
+    if err != nil {
+        return nil, err
+    }
+    if reqBody != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := je.HTTPClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+    }
+    return body, nil
+}
+
+// confirm waits until signature is confirmed or failed, or until it can no
+// longer land: once the block height has passed lastValidBlockHeight, or
+// after ConfirmTimeout when that height is unknown
+func (je *JupiterExecutor) confirm(ctx context.Context, signature string, lastValidBlockHeight uint64) error {
+    if lastValidBlockHeight == 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, je.ConfirmTimeout)
+        defer cancel()
+    }
+
+    for {
+        // Read the height first: a status still missing after the blockhash
+        // expired will not appear later
+        expired := false
+        if lastValidBlockHeight > 0 {
+            height, err := je.RPC.GetBlockHeight(ctx)
+            if err != nil && ctx.Err() == nil {
+                log.Println("Error polling block height:", err)
+            }
+            expired = err == nil && height > lastValidBlockHeight
+        }
+
+        status, err := je.RPC.GetSignatureStatus(ctx, signature)
+        if err != nil && ctx.Err() == nil {
+            log.Println("Error polling signature status:", err)
+        }
+        if status != nil {
+            if status.Err != nil {
+                return fmt.Errorf("failed on-chain: %v", status.Err)
+            }
+            if status.ConfirmationStatus == "confirmed" || status.ConfirmationStatus == "finalized" {
+                return nil
+            }
+        }
+        if expired && status == nil && err == nil {
+            return fmt.Errorf("blockhash expired at block height %d", lastValidBlockHeight)
+        }
+
+        select {
+        case <-ctx.Done():
+            if lastValidBlockHeight == 0 {
+                return errors.New("not confirmed before timeout")
+            }
+            return ctx.Err()
+        case <-time.After(je.PollInterval):
+        }
+    }
+}
+
+// landedTransaction reads back our confirmed transaction, or returns nil if
+// the node would not serve it
+func (je *JupiterExecutor) landedTransaction(ctx context.Context, signature string) *SolanaTransaction {
+    for attempt := 1; ; attempt++ {
+        tx, err := je.RPC.GetTransaction(ctx, signature)
+        if err == nil {
+            return tx
+        }
+        if attempt == landedFetchAttempts || ctx.Err() != nil {
+            log.Println("Error fetching landed transaction:", signature, err)
+            return nil
+        }
+        time.Sleep(je.PollInterval)
+    }
+}
+
+// landedFill decodes our own swap of the signal's token, and the fee we
+// paid, from the landed transaction
+func (je *JupiterExecutor) landedFill(tx *SolanaTransaction, signature string, signal TradeSignal) (Fill, bool) {
+    if tx == nil || tx.Meta == nil {
+        return Fill{}, false
+    }
+    legs, err := je.Decoders.DecodeTransaction(je.PublicKey, tx)
+    if err != nil {
+        log.Println("Error decoding landed transaction:", signature, err)
+        return Fill{}, false
+    }
+    for _, leg := range legs {
+        if leg.Token() == signal.Token && leg.Price() > 0 {
+            return Fill{
+                Quantity:      decimal.NewFromFloat(leg.TokenAmount()),
+                Price:         decimal.NewFromFloat(leg.Price()),
+                ExpectedPrice: decimal.NewFromFloat(signal.Price),
+                Fee:           decimal.New(int64(tx.Meta.Fee), -9),
+                Signature:     signature,
+            }, true
+        }
+    }
+    return Fill{}, false
+}
+
+// signatureCount is the number of signatures a serialized transaction
+// carries, each paying the base fee
+func signatureCount(tx []byte) uint64 {
+    count, _, err := decodeShortVec(tx)
+    if err != nil {
+        return 1
+    }
+    return uint64(count)
+}
+
+// signTransaction signs a serialized transaction built for us by a third
+// party. The message is everything after the signature list; our signature
+// goes in the slot of our key among the required signers.
+func signTransaction(tx []byte, key ed25519.PrivateKey) ([]byte, error) {
+    sigCount, offset, err := decodeShortVec(tx)
+    if err != nil {
+        return nil, err
+    }
+    messageStart := offset + sigCount*ed25519.SignatureSize
+    if messageStart >= len(tx) {
+        return nil, errors.New("transaction truncated in signatures")
+    }
+    message := tx[messageStart:]
+
+    // Versioned messages start with a 0x80 | version prefix
+    header := message
+    if header[0]&0x80 != 0 {
+        header = header[1:]
+    }
+    if len(header) < 3 {
+        return nil, errors.New("transaction message truncated")
+    }
+    requiredSigners := int(header[0])
+    keyCount, keysOffset, err := decodeShortVec(header[3:])
+    if err != nil {
+        return nil, err
+    }
+    keys := header[3+keysOffset:]
+    if len(keys) < keyCount*ed25519.PublicKeySize || requiredSigners > keyCount || requiredSigners > sigCount {
+        return nil, errors.New("transaction message truncated in account keys")
+    }
+
+    publicKey := key.Public().(ed25519.PublicKey)
+    for i := 0; i < requiredSigners; i++ {
+        if bytes.Equal(keys[i*ed25519.PublicKeySize:(i+1)*ed25519.PublicKeySize], publicKey) {
+            signed := append([]byte(nil), tx...)
+            copy(signed[offset+i*ed25519.SignatureSize:], ed25519.Sign(key, message))
+            return signed, nil
+        }
+    }
+    return nil, errors.New("transaction does not require our signature")
+}
+
+// decodeShortVec reads Solana's compact-u16 length prefix and returns the
+// value and the number of bytes it took
+func decodeShortVec(data []byte) (int, int, error) {
+    value := 0
+    for i := 0; i < 3; i++ {
+        if i >= len(data) {
+            return 0, 0, errors.New("truncated compact-u16")
+        }
+        value |= int(data[i]&0x7F) << (7 * uint(i))
+        if data[i]&0x80 == 0 {
+            return value, i + 1, nil
+        }
+    }
+    return 0, 0, errors.New("invalid compact-u16")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+const testJupiterToken = "7GCihgDB8fe6KNjn2MYtkzZcRjQy3t9GHdC8uHYmW2hr"
+
+// unsignedTransaction is a legacy transaction with one empty signature slot
+// for key and no instructions
+func unsignedTransaction(key ed25519.PublicKey) []byte {
+    tx := []byte{1}
+    tx = append(tx, make([]byte, ed25519.SignatureSize)...)
+    tx = append(tx, 1, 0, 0, 1)
+    tx = append(tx, key...)
+    tx = append(tx, make([]byte, 32)...) // Recent blockhash
+    return append(tx, 0)
+}
+
+// newJupiterServer serves /quote and /swap the way the Jupiter API does,
+// with a swap transaction for key valid until lastValidBlockHeight
+func newJupiterServer(t *testing.T, key ed25519.PublicKey, lastValidBlockHeight uint64) *httptest.Server {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        switch r.URL.Path {
+        case "/quote":
+            query := r.URL.Query()
+            if query.Get("inputMint") != wrappedSOLMint || query.Get("outputMint") != testJupiterToken ||
+                query.Get("amount") != "1000000000" || query.Get("slippageBps") != "100" {
+                http.Error(w, "unexpected quote "+r.URL.RawQuery, http.StatusBadRequest)
+                return
+            }
+            w.Write([]byte(`{
+                "inputMint": "So11111111111111111111111111111111111111112",
+                "inAmount": "1000000000",
+                "outputMint": "7GCihgDB8fe6KNjn2MYtkzZcRjQy3t9GHdC8uHYmW2hr",
+                "outAmount": "995000000",
+                "otherAmountThreshold": "985050000",
+                "swapMode": "ExactIn",
+                "slippageBps": 100,
+                "priceImpactPct": "0.0012",
+                "routePlan": []
+            }`))
+        case "/swap":
+            var request struct {
+                QuoteResponse map[string]interface{} `json:"quoteResponse"`
+                UserPublicKey string                 `json:"userPublicKey"`
+            }
+            if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.QuoteResponse["outAmount"] != "995000000" {
+                http.Error(w, "quote not passed back verbatim", http.StatusBadRequest)
+                return
+            }
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "swapTransaction":           base64.StdEncoding.EncodeToString(unsignedTransaction(key)),
+                "lastValidBlockHeight":      lastValidBlockHeight,
+                "prioritizationFeeLamports": 10000,
+            })
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    t.Cleanup(server.Close)
+    return server
+}
+
+func newTestJupiterExecutor(t *testing.T, rpc SolanaRPC, lastValidBlockHeight uint64) *JupiterExecutor {
+    public, key, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := newJupiterServer(t, public, lastValidBlockHeight)
+    return &JupiterExecutor{
+        APIURL:         server.URL,
+        RPC:            rpc,
+        HTTPClient:     server.Client(),
+        Key:            key,
+        PublicKey:      Base58Encode(public),
+        SlippageBps:    100,
+        PriorityFee:    "auto",
+        ConfirmTimeout: time.Millisecond,
+        PollInterval:   time.Millisecond,
+        Decoders:       DefaultDecoderRegistry(),
+    }
+}
+
+func newJupiterRPC() *fakeRPC {
+    rpc := newFakeRPC()
+    rpc.mints[testJupiterToken] = &MintAccount{Supply: 1e9, Decimals: 6}
+    return rpc
+}
+
+var testJupiterBuy = TradeSignal{Action: "buy", Token: testJupiterToken, Quantity: 1000, Price: 0.001}
+
+func TestJupiterExecuteFallsBackToQuoteWithFee(t *testing.T) {
+    tests := []struct {
+        name   string
+        landed *SolanaTransaction
+        fee    string
+    }{
+        // The landed transaction has no swap we can decode
+        {"undecodable", &SolanaTransaction{Meta: &TransactionMeta{Fee: 25000}}, "0.000025"},
+        // One signature plus the priority fee from the swap response
+        {"unreadable", nil, "0.000015"},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            rpc := newJupiterRPC()
+            rpc.statuses["sent-1"] = &SignatureStatus{Slot: 10, ConfirmationStatus: "confirmed"}
+            if test.landed != nil {
+                rpc.transactions["sent-1"] = test.landed
+            }
+
+            executor := newTestJupiterExecutor(t, rpc, 1000)
+            fill, err := executor.Execute(context.Background(), testJupiterBuy)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !fill.Quantity.Equal(decimal.NewFromInt(995)) || !approxEqual(fill.Price.InexactFloat64(), 1.0/995) {
+                t.Errorf("filled %s at %s, want the quoted 995 at %g", fill.Quantity, fill.Price, 1.0/995)
+            }
+            if !fill.Fee.Equal(decimal.RequireFromString(test.fee)) {
+                t.Errorf("fee %s, want %s", fill.Fee, test.fee)
+            }
+            if fill.Signature != "sent-1" || len(rpc.sent) != 1 {
+                t.Fatalf("signature %q, %d sent", fill.Signature, len(rpc.sent))
+            }
+            sent := rpc.sent[0]
+            if !ed25519.Verify(executor.Key.Public().(ed25519.PublicKey), sent[1+ed25519.SignatureSize:], sent[1:1+ed25519.SignatureSize]) {
+                t.Error("submitted transaction is not signed with our key")
+            }
+        })
+    }
+}
+
+func TestJupiterConfirmWaitsForBlockhashExpiry(t *testing.T) {
+    rpc := newJupiterRPC()
+    go func() {
+        // Lands well after ConfirmTimeout, before the blockhash expires
+        time.Sleep(20 * time.Millisecond)
+        rpc.mutex.Lock()
+        rpc.statuses["sent-1"] = &SignatureStatus{Slot: 10, ConfirmationStatus: "confirmed"}
+        rpc.mutex.Unlock()
+    }()
+
+    executor := newTestJupiterExecutor(t, rpc, 1000000)
+    if _, err := executor.Execute(context.Background(), testJupiterBuy); err != nil {
+        t.Fatalf("Execute: %v", err)
+    }
+}
+
+func TestJupiterConfirmFailsOnceBlockhashExpired(t *testing.T) {
+    rpc := newJupiterRPC()
+    executor := newTestJupiterExecutor(t, rpc, 3)
+    executor.ConfirmTimeout = time.Minute
+
+    _, err := executor.Execute(context.Background(), testJupiterBuy)
+    if err == nil || !strings.Contains(err.Error(), "blockhash expired") {
+        t.Fatalf("got %v, want an expired blockhash", err)
+    }
+    if calls := rpc.callCount("getBlockHeight"); calls != 4 {
+        t.Errorf("%d getBlockHeight calls, want polling until height 4", calls)
+    }
+}
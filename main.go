@@ -1,36 +1,93 @@
 package main
 
 import (
+    "context"
+    "flag"
     "log"
     "time"
 
     "github.com/shopspring/decimal"
 )
 
+// How long the main loop sleeps between trading cycles
+const tradingCycleInterval = 5 * time.Minute
+
 func main() {
+    portfolioName := flag.String("portfolio", "default", "name of the portfolio to trade")
+    freshPortfolio := flag.Bool("fresh", false, "start a new portfolio under -portfolio instead of restoring it")
+    inMemory := flag.Bool("memory", false, "keep all state in memory instead of Postgres")
+    flag.Parse()
+
     // Load configuration
     config := LoadConfig()
 
+    // solbot migrate ... manages the schema and exits
+    if flag.Arg(0) == "migrate" {
+        db := ConnectDatabase(config)
+        defer db.Pool.Close()
+        if err := RunMigrateCommand(db, flag.Args()[1:]); err != nil {
+            log.Fatalf("Migration failed: %v", err)
+        }
+        return
+    }
+
     // Initialize database
-    db := InitializeDatabase(config)
-    defer db.Pool.Close()
+    var db Store
+    if *inMemory {
+        db = NewMemoryStore()
+    } else {
+        database := InitializeDatabase(config)
+        defer database.Pool.Close()
+        db = database
+    }
 
-    // Initialize virtual portfolio with 10 SOL
-    initialSOL, err := decimal.NewFromString("10")
+    // Restore the virtual portfolio, or start it with the initial capital
+    initialSOL := decimal.NewFromFloat(config.InitialCapitalSOL)
+    portfolio, err := OpenPortfolio(db, *portfolioName, *freshPortfolio, initialSOL)
     if err != nil {
-        log.Fatalf("Invalid initial SOL amount: %v", err)
+        log.Fatalf("Unable to open portfolio: %v", err)
     }
-    portfolio := NewPortfolio(initialSOL)
 
     // Initialize other modules
-    dataModule := InitializeDataAcquisition(config)
+    rpcEndpoints := NewEndpointPool(config)
+    rpcEndpoints.StartHealthChecks()
+    rpcClient := NewRPCClient(config, rpcEndpoints)
+    dataModule := InitializeDataAcquisition(db, config, rpcClient)
     walletSelectionModule := InitializeWalletSelection(db, config)
-    tradeSignalModule := InitializeTradeSignalModule(db, config) // From signal.go
-    executionEngine := InitializeExecutionEngine(config, portfolio)
-    monitoringModule := InitializeMonitoring(db, portfolio)
+    tradeSignalModule := InitializeTradeSignalModule(db, config, dataModule) // From signal.go
+    pools := NewPoolPriceSource(rpcClient, NewMintDecimals(rpcClient))
+    prices := NewPriceSource(config, pools)
+    executionEngine := InitializeExecutionEngine(db, config, portfolio, rpcClient, pools, prices)
+    positionSizer := NewPositionSizer(config, portfolio)
+    monitoringModule := InitializeMonitoring(db, portfolio, rpcEndpoints, prices)
+    positionManager := NewPositionManager(config, portfolio, executionEngine, monitoringModule.FetchCurrentPrice)
+    pipeline := &SignalPipeline{
+        Guard:     NewSignalGuard(config, monitoringModule.FetchCurrentPrice, monitoringModule.Rejections),
+        Safety:    NewTokenSafetyFilter(db, config, rpcClient, monitoringModule.Rejections),
+        Sizer:     positionSizer,
+        Engine:    executionEngine,
+        Positions: positionManager,
+        Pools:     pools,
+    }
+
+    // Close positions on stop-loss, take-profit and trailing-stop rules
+    go positionManager.Run(context.Background())
 
     // Initialize and serve dashboard
-    InitializeDashboard(monitoringModule)
+    InitializeDashboard(monitoringModule, config)
+
+    // Stream the top wallets' transactions and act on their swaps as they land
+    streamer := NewWalletStreamer(config, dataModule)
+    go streamer.Run(context.Background())
+    go func() {
+        for leg := range streamer.Legs {
+            signal, ok := tradeSignalModule.SignalFromLeg(leg)
+            if !ok {
+                continue
+            }
+            pipeline.Process(context.Background(), signal)
+        }
+    }()
 
     // Define the list of wallets to monitor
     walletsToMonitor := []string{
@@ -44,52 +101,69 @@ func main() {
         log.Println("Starting new trading cycle...")
 
         for _, wallet := range walletsToMonitor {
-            // Fetch recent trades for the wallet
-            trades, err := dataModule.FetchRecentTransactions(wallet)
+            // Fetch new signatures and continue the history backfill
+            legs, cursor, err := dataModule.SyncWallet(context.Background(), wallet)
             if err != nil {
                 log.Println("Error fetching trades for wallet:", wallet, err)
                 continue
             }
 
+            // Pair buys with later sells into closed round trips
+            trades, _ := ReconstructRoundTrips(legs, config.CostBasis)
+
             // Calculate metrics
             walletMetrics := CalculateWalletMetrics(wallet, trades)
 
-            // Upsert metrics into the database
-            err = UpsertWalletMetrics(db, walletMetrics)
+            // Store the round trips, metrics and daily PnL trend together,
+            // so the wallet's selection can be audited, and only then move
+            // the cursor past the history they came from
+            err = db.SaveWalletUpdate(WalletUpdate{
+                Metrics:   walletMetrics,
+                CostBasis: config.CostBasis,
+                Trades:    trades,
+                Cursor:    cursor,
+            })
             if err != nil {
-                log.Println("Error upserting wallet metrics:", err)
+                log.Println("Error saving wallet metrics:", err)
                 continue
             }
+        }
 
-            // Insert daily PnL trends
-            err = InsertDailyPnL(db, wallet, walletMetrics.DailyPnLTrend)
-            if err != nil {
-                log.Println("Error inserting daily PnL:", err)
-                continue
-            }
+        // Keep one metrics snapshot per wallet per day once it's old
+        if removed, err := walletSelectionModule.DownsampleHistory(); err != nil {
+            log.Println("Error downsampling wallet metrics history:", err)
+        } else if removed > 0 {
+            log.Printf("Downsampled wallet metrics history: %d snapshots removed\n", removed)
         }
 
-        // Select top wallets based on metrics
-        topWallets, err := walletSelectionModule.SelectTopWallets(100)
+        // Select top wallets based on metrics, and their trend if configured
+        topWallets, err := walletSelectionModule.SelectWallets(100)
         if err != nil {
             log.Println("Error selecting top wallets:", err)
             continue
         }
 
-        // Generate trade signals using signal.go
-        tradeSignals, err := tradeSignalModule.GenerateTradeSignals(topWallets)
+        // Follow the selected wallets in real time
+        topAddresses := make([]string, 0, len(topWallets))
+        for _, wallet := range topWallets {
+            topAddresses = append(topAddresses, wallet.WalletAddress)
+        }
+        streamer.SetWallets(context.Background(), topAddresses)
+        positionSizer.SetWalletMetrics(topWallets)
+
+        // Generate trade signals using signal.go, then size and execute them
+        // in paper trading mode
+        err = tradeSignalModule.GenerateTradeSignals(context.Background(), topWallets, func(signal TradeSignal) {
+            pipeline.Process(context.Background(), signal)
+        })
         if err != nil {
             log.Println("Error generating trade signals:", err)
             continue
         }
 
-        // Execute trade signals in paper trading mode
-        for _, signal := range tradeSignals {
-            err := executionEngine.ExecuteTrade(signal)
-            if err != nil {
-                log.Println("Error executing trade:", err)
-                continue
-            }
+        // Retry portfolio changes the database could not take
+        if waiting := portfolio.SaveQueued(); waiting > 0 {
+            log.Printf("%d portfolio changes not saved yet\n", waiting)
         }
 
         // Monitor performance
@@ -100,9 +174,9 @@ func main() {
         // Implement feedback-based adjustments
         AdjustSystem(monitoringModule, metrics, config)
 
-        log.Println("Trading cycle completed. Sleeping for 5 minutes...")
+        log.Printf("Trading cycle completed. Sleeping for %s...\n", tradingCycleInterval)
         // Wait for the next cycle (e.g., 5 minutes)
-        time.Sleep(5 * time.Minute)
+        time.Sleep(tradingCycleInterval)
     }
 }
 
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// MemoryStore keeps everything Database persists in memory, with the same
+// semantics, so the trading cycle can run without Postgres. Nothing
+// survives the process.
+type MemoryStore struct {
+    walletMetrics map[string]WalletMetrics
+    history       map[string][]WalletMetricsSnapshot
+    dailyPnL      map[string]map[time.Time]float64
+    walletCursors map[string]WalletCursor
+    swapLegs      map[string][]storedLeg // Per wallet
+    swapLegKeys   map[string]bool
+    roundTrips    map[string][]Trade // Per wallet, in store order
+    signalCursors map[string]string
+    claimed       map[string]bool
+    tokenReports  map[string]TokenReport
+    portfolios    map[int64]*storedPortfolio
+    portfolioIDs  map[string]int64
+    mutex         sync.Mutex
+}
+
+type storedLeg struct {
+    leg   SwapLeg
+    index int
+}
+
+type storedPortfolio struct {
+    name           string
+    initialCapital decimal.Decimal
+    balance        decimal.Decimal
+    lots           map[int64]Lot // Closed lots are kept with zero quantity
+    transactions   []Transaction
+    cashFlows      []CashFlow
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        walletMetrics: make(map[string]WalletMetrics),
+        history:       make(map[string][]WalletMetricsSnapshot),
+        dailyPnL:      make(map[string]map[time.Time]float64),
+        walletCursors: make(map[string]WalletCursor),
+        swapLegs:      make(map[string][]storedLeg),
+        swapLegKeys:   make(map[string]bool),
+        roundTrips:    make(map[string][]Trade),
+        signalCursors: make(map[string]string),
+        claimed:       make(map[string]bool),
+        tokenReports:  make(map[string]TokenReport),
+        portfolios:    make(map[int64]*storedPortfolio),
+        portfolioIDs:  make(map[string]int64),
+    }
+}
+
+func (ms *MemoryStore) UpsertWalletMetrics(wm WalletMetrics) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.upsertWalletMetrics(wm)
+    return nil
+}
+
+func (ms *MemoryStore) upsertWalletMetrics(wm WalletMetrics) {
+    wm.DailyPnLTrend = nil // Stored separately, as in daily_pnl_trend
+    ms.walletMetrics[wm.WalletAddress] = wm
+    ms.history[wm.WalletAddress] = append(ms.history[wm.WalletAddress], WalletMetricsSnapshot{
+        WalletMetrics: wm,
+        RecordedAt:    time.Now(),
+    })
+}
+
+func (ms *MemoryStore) TopWallets(minTradeCount int, minWinRate float64, limit int) ([]WalletMetrics, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var wallets []WalletMetrics
+    for _, wm := range ms.walletMetrics {
+        if wm.TradeCount > minTradeCount && wm.WinRate > minWinRate {
+            wallets = append(wallets, wm)
+        }
+    }
+    sort.Slice(wallets, func(i, j int) bool {
+        if wallets[i].WinRate != wallets[j].WinRate {
+            return wallets[i].WinRate > wallets[j].WinRate
+        }
+        return wallets[i].AverageProfitPct > wallets[j].AverageProfitPct
+    })
+    if len(wallets) > limit {
+        wallets = wallets[:limit]
+    }
+    return wallets, nil
+}
+
+func (ms *MemoryStore) WalletMetricsHistory(walletAddress string, since time.Time) ([]WalletMetricsSnapshot, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var history []WalletMetricsSnapshot
+    for _, snapshot := range ms.history[walletAddress] {
+        if !snapshot.RecordedAt.Before(since) {
+            history = append(history, snapshot)
+        }
+    }
+    return history, nil
+}
+
+func (ms *MemoryStore) MetricTrends(metric TrendMetric, since time.Time, minSnapshots int) ([]MetricTrend, error) {
+    if !metric.valid() {
+        return nil, fmt.Errorf("unknown trend metric %q", metric)
+    }
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var trends []MetricTrend
+    for walletAddress, snapshots := range ms.history {
+        var days, values []float64
+        for _, snapshot := range snapshots {
+            if snapshot.RecordedAt.Before(since) {
+                continue
+            }
+            // NaN is what Database stores as NULL, which the trend skips
+            value := metric.value(snapshot.WalletMetrics)
+            if math.IsNaN(value) {
+                continue
+            }
+            days = append(days, snapshot.RecordedAt.Sub(since).Hours()/24)
+            values = append(values, value)
+        }
+        if len(values) == 0 || len(values) < minSnapshots {
+            continue
+        }
+        trends = append(trends, MetricTrend{
+            WalletAddress: walletAddress,
+            Metric:        metric,
+            Snapshots:     len(values),
+            SlopePerDay:   leastSquaresSlope(days, values),
+            First:         values[0],
+            Latest:        values[len(values)-1],
+        })
+    }
+    return trends, nil
+}
+
+func (ms *MemoryStore) DownsampleWalletMetricsHistory(before time.Time) (int64, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var removed int64
+    for walletAddress, snapshots := range ms.history {
+        // Walk newest first, keeping the first snapshot seen of each day
+        kept := make([]WalletMetricsSnapshot, 0, len(snapshots))
+        days := make(map[time.Time]bool)
+        for i := len(snapshots) - 1; i >= 0; i-- {
+            snapshot := snapshots[i]
+            if snapshot.RecordedAt.Before(before) {
+                year, month, day := snapshot.RecordedAt.UTC().Date()
+                date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+                if days[date] {
+                    removed++
+                    continue
+                }
+                days[date] = true
+            }
+            kept = append(kept, snapshot)
+        }
+        for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+            kept[i], kept[j] = kept[j], kept[i]
+        }
+        ms.history[walletAddress] = kept
+    }
+    return removed, nil
+}
+
+// leastSquaresSlope is the slope of the least squares line through (x, y),
+// or 0 if all x are equal, as regr_slope returns NULL then
+func leastSquaresSlope(x, y []float64) float64 {
+    n := float64(len(x))
+    var sumX, sumY float64
+    for i := range x {
+        sumX += x[i]
+        sumY += y[i]
+    }
+    meanX, meanY := sumX/n, sumY/n
+
+    var covariance, variance float64
+    for i := range x {
+        covariance += (x[i] - meanX) * (y[i] - meanY)
+        variance += (x[i] - meanX) * (x[i] - meanX)
+    }
+    if variance == 0 {
+        return 0
+    }
+    return covariance / variance
+}
+
+func (ms *MemoryStore) InsertDailyPnL(walletAddress string, dailyPnLs []DailyPnL) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.insertDailyPnL(walletAddress, dailyPnLs)
+    return nil
+}
+
+func (ms *MemoryStore) insertDailyPnL(walletAddress string, dailyPnLs []DailyPnL) {
+    days, ok := ms.dailyPnL[walletAddress]
+    if !ok {
+        days = make(map[time.Time]float64)
+        ms.dailyPnL[walletAddress] = days
+    }
+    for _, pnl := range dailyPnLs {
+        year, month, day := pnl.Date.Date()
+        days[time.Date(year, month, day, 0, 0, 0, 0, time.UTC)] = pnl.PnL
+    }
+}
+
+func (ms *MemoryStore) GetDailyPnL(walletAddress string) ([]DailyPnL, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var trend []DailyPnL
+    for date, pnl := range ms.dailyPnL[walletAddress] {
+        trend = append(trend, DailyPnL{Date: date, PnL: pnl})
+    }
+    sort.Slice(trend, func(i, j int) bool {
+        return trend[i].Date.Before(trend[j].Date)
+    })
+    return trend, nil
+}
+
+func (ms *MemoryStore) GetWalletCursor(walletAddress string) (WalletCursor, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    if cursor, ok := ms.walletCursors[walletAddress]; ok {
+        return cursor, nil
+    }
+    return WalletCursor{WalletAddress: walletAddress}, nil
+}
+
+func (ms *MemoryStore) SaveWalletCursor(cursor WalletCursor) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.walletCursors[cursor.WalletAddress] = cursor
+    return nil
+}
+
+func (ms *MemoryStore) SaveSwapLegs(legs []SwapLeg) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.saveSwapLegs(legs)
+    return nil
+}
+
+func (ms *MemoryStore) saveSwapLegs(legs []SwapLeg) {
+    legIndex := make(map[string]int)
+    for _, leg := range legs {
+        key := leg.Signature + "|" + leg.Wallet
+        index := legIndex[key]
+        legIndex[key]++
+
+        storedKey := fmt.Sprintf("%s|%d", key, index)
+        if ms.swapLegKeys[storedKey] {
+            continue
+        }
+        ms.swapLegKeys[storedKey] = true
+        ms.swapLegs[leg.Wallet] = append(ms.swapLegs[leg.Wallet], storedLeg{leg: leg, index: index})
+    }
+}
+
+func (ms *MemoryStore) SaveSyncPage(legs []SwapLeg, cursor WalletCursor) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.saveSwapLegs(legs)
+    ms.walletCursors[cursor.WalletAddress] = cursor
+    return nil
+}
+
+func (ms *MemoryStore) LoadSwapLegs(walletAddress string, since time.Time) ([]SwapLeg, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var stored []storedLeg
+    for _, s := range ms.swapLegs[walletAddress] {
+        if !s.leg.BlockTime.Before(since) {
+            stored = append(stored, s)
+        }
+    }
+    sort.Slice(stored, func(i, j int) bool {
+        a, b := stored[i], stored[j]
+        if a.leg.Slot != b.leg.Slot {
+            return a.leg.Slot < b.leg.Slot
+        }
+        if a.leg.Signature != b.leg.Signature {
+            return a.leg.Signature < b.leg.Signature
+        }
+        return a.index < b.index
+    })
+
+    var legs []SwapLeg
+    for _, s := range stored {
+        legs = append(legs, s.leg)
+    }
+    return legs, nil
+}
+
+func (ms *MemoryStore) SaveRoundTrips(walletAddress string, method CostBasisMethod, trades []Trade) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.roundTrips[walletAddress] = append([]Trade(nil), trades...)
+    return nil
+}
+
+func (ms *MemoryStore) LoadRoundTrips(walletAddress string, from, to time.Time) ([]Trade, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    var trades []Trade
+    for _, trade := range ms.roundTrips[walletAddress] {
+        if trade.CloseTime.Before(from) || (!to.IsZero() && !trade.CloseTime.Before(to)) {
+            continue
+        }
+        trade.Action = "sell"
+        trades = append(trades, trade)
+    }
+    // Stable, so portions of one sell keep their order as seq does
+    sort.SliceStable(trades, func(i, j int) bool {
+        a, b := trades[i], trades[j]
+        if !a.CloseTime.Equal(b.CloseTime) {
+            return a.CloseTime.Before(b.CloseTime)
+        }
+        if a.Signature != b.Signature {
+            return a.Signature < b.Signature
+        }
+        return a.Token < b.Token
+    })
+    return trades, nil
+}
+
+// SaveWalletUpdate holds the lock throughout, so readers see all of the
+// update or none of it, as with the transaction in Database
+func (ms *MemoryStore) SaveWalletUpdate(update WalletUpdate) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    walletAddress := update.Metrics.WalletAddress
+    ms.roundTrips[walletAddress] = append([]Trade(nil), update.Trades...)
+    ms.upsertWalletMetrics(update.Metrics)
+    ms.insertDailyPnL(walletAddress, update.Metrics.DailyPnLTrend)
+    ms.walletCursors[update.Cursor.WalletAddress] = update.Cursor
+    return nil
+}
+
+func (ms *MemoryStore) GetSignalCursor(walletAddress string) (string, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    return ms.signalCursors[walletAddress], nil
+}
+
+func (ms *MemoryStore) SaveSignalCursor(walletAddress, signature string) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    ms.signalCursors[walletAddress] = signature
+    return nil
+}
+
+func (ms *MemoryStore) ClaimSignal(signal TradeSignal) (bool, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    key := signal.Signature + "|" + signal.WalletAddress + "|" + signal.Token
+    if ms.claimed[key] {
+        return false, nil
+    }
+    ms.claimed[key] = true
+    return true, nil
+}
+
+func (ms *MemoryStore) GetTokenReport(mint string) (*TokenReport, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    report, ok := ms.tokenReports[mint]
+    if !ok {
+        return nil, nil
+    }
+    report.LargestAccounts = append([]TokenAccountBalance(nil), report.LargestAccounts...)
+    return &report, nil
+}
+
+func (ms *MemoryStore) SaveTokenReport(report TokenReport) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+    report.LargestAccounts = append([]TokenAccountBalance(nil), report.LargestAccounts...)
+    ms.tokenReports[report.Mint] = report
+    return nil
+}
+
+func (ms *MemoryStore) CreatePortfolio(name string, balance decimal.Decimal) (int64, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    if _, ok := ms.portfolioIDs[name]; ok {
+        return 0, fmt.Errorf("portfolio %q already exists", name)
+    }
+    id := int64(len(ms.portfolios) + 1)
+    ms.portfolios[id] = &storedPortfolio{
+        name:           name,
+        initialCapital: balance,
+        balance:        balance,
+        lots:           make(map[int64]Lot),
+    }
+    ms.portfolioIDs[name] = id
+    return id, nil
+}
+
+func (ms *MemoryStore) LoadPortfolio(name string) (*Portfolio, error) {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    id, ok := ms.portfolioIDs[name]
+    if !ok {
+        return nil, nil
+    }
+    stored := ms.portfolios[id]
+
+    portfolio := NewPortfolio(stored.initialCapital)
+    portfolio.ID = id
+    portfolio.Name = name
+    portfolio.Balance = stored.balance
+
+    var ids []int64
+    for lotID := range stored.lots {
+        ids = append(ids, lotID)
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    for _, lotID := range ids {
+        if lot := stored.lots[lotID]; lot.Quantity.IsPositive() {
+            portfolio.saveLot(lot)
+        }
+        if lotID > portfolio.nextLotID {
+            portfolio.nextLotID = lotID
+        }
+    }
+
+    portfolio.TransactionLog = append([]Transaction(nil), stored.transactions...)
+    portfolio.CashFlows = append([]CashFlow(nil), stored.cashFlows...)
+    return portfolio, nil
+}
+
+func (ms *MemoryStore) SavePortfolioChange(portfolioID int64, change PortfolioChange) error {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    stored, ok := ms.portfolios[portfolioID]
+    if !ok {
+        return fmt.Errorf("portfolio %d does not exist", portfolioID)
+    }
+
+    stored.balance = change.Balance
+    for _, lot := range change.SavedLots {
+        if existing, ok := stored.lots[lot.ID]; ok {
+            // Only what changes over a lot's life is updated, as in Postgres
+            existing.Quantity = lot.Quantity
+            existing.PeakPrice = lot.PeakPrice
+            existing.TiersTaken = lot.TiersTaken
+            lot = existing
+        }
+        stored.lots[lot.ID] = lot
+    }
+    for _, id := range change.ClosedLots {
+        if lot, ok := stored.lots[id]; ok {
+            lot.Quantity = decimal.Zero
+            stored.lots[id] = lot
+        }
+    }
+    if change.Transaction != nil {
+        stored.transactions = append(stored.transactions, *change.Transaction)
+    }
+    if change.CashFlow != nil {
+        stored.cashFlows = append(stored.cashFlows, *change.CashFlow)
+    }
+    return nil
+}
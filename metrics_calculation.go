@@ -1,12 +1,17 @@
 package main
 
 import (
+    "sort"
     "time"
-
-    "github.com/shopspring/decimal"
 )
 
+// Trade is a closed round trip: a quantity of Token bought at OpenTime and
+// sold at CloseTime for Price, with PositionSize the SOL cost basis.
+// Signature is the closing sell and OpenSignature the buy it was matched to.
 type Trade struct {
+    Signature       string
+    OpenSignature   string
+    Slot            uint64
     OpenTime        time.Time
     CloseTime       time.Time
     Profit          float64
@@ -91,6 +96,9 @@ func CalculateWalletMetrics(walletAddress string, trades []Trade) WalletMetrics
             PnL:  pnl,
         })
     }
+    sort.Slice(wm.DailyPnLTrend, func(i, j int) bool {
+        return wm.DailyPnLTrend[i].Date.Before(wm.DailyPnLTrend[j].Date)
+    })
 
     return wm
 }
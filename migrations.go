@@ -0,0 +1,282 @@
+package main
+
+import (
+    "context"
+    "embed"
+    "fmt"
+    "io/fs"
+    "log"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// Migrations are embedded from migrations/NNNN_name.up.sql and the matching
+// NNNN_name.down.sql, and applied in version order
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Held for the duration of each migration's transaction so that instances
+// starting together don't apply the same migration twice
+const migrationLockKey = 5410247
+
+type Migration struct {
+    Version int64
+    Name    string
+    Up      string
+    Down    string // Empty if the migration can't be rolled back
+}
+
+type AppliedMigration struct {
+    Version   int64
+    Name      string
+    AppliedAt time.Time
+}
+
+// loadMigrations returns the embedded migrations in version order
+func loadMigrations() ([]Migration, error) {
+    entries, err := fs.ReadDir(migrationFiles, "migrations")
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := make(map[int64]*Migration)
+    for _, entry := range entries {
+        match := migrationFileName.FindStringSubmatch(entry.Name())
+        if match == nil {
+            return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+        }
+        version, err := strconv.ParseInt(match[1], 10, 64)
+        if err != nil {
+            return nil, err
+        }
+        body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+        if err != nil {
+            return nil, err
+        }
+
+        migration, ok := byVersion[version]
+        if !ok {
+            migration = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = migration
+        }
+        if migration.Name != match[2] {
+            return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, match[2])
+        }
+        if match[3] == "up" {
+            migration.Up = string(body)
+        } else {
+            migration.Down = string(body)
+        }
+    }
+
+    var migrations []Migration
+    for _, migration := range byVersion {
+        if migration.Up == "" {
+            return nil, fmt.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+        }
+        migrations = append(migrations, *migration)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    return migrations, nil
+}
+
+func ensureMigrationsTable(db *Database) error {
+    query := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version BIGINT PRIMARY KEY,
+        name VARCHAR NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );`
+
+    _, err := db.Pool.Exec(context.Background(), query)
+    return err
+}
+
+// AppliedMigrations returns the migrations recorded in schema_migrations in
+// version order
+func AppliedMigrations(db *Database) ([]AppliedMigration, error) {
+    if err := ensureMigrationsTable(db); err != nil {
+        return nil, err
+    }
+
+    rows, err := db.Pool.Query(context.Background(), `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var applied []AppliedMigration
+    for rows.Next() {
+        var migration AppliedMigration
+        if err := rows.Scan(&migration.Version, &migration.Name, &migration.AppliedAt); err != nil {
+            return nil, err
+        }
+        applied = append(applied, migration)
+    }
+    return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration up to and including target, or
+// all of them if target is 0
+func MigrateUp(db *Database, target int64) error {
+    migrations, err := loadMigrations()
+    if err != nil {
+        return err
+    }
+    if err := ensureMigrationsTable(db); err != nil {
+        return err
+    }
+
+    for _, migration := range migrations {
+        if target != 0 && migration.Version > target {
+            break
+        }
+        if err := runMigration(db, migration, true); err != nil {
+            return fmt.Errorf("applying migration %d_%s: %w", migration.Version, migration.Name, err)
+        }
+    }
+    return nil
+}
+
+// MigrateDown rolls back the newest steps applied migrations
+func MigrateDown(db *Database, steps int) error {
+    migrations, err := loadMigrations()
+    if err != nil {
+        return err
+    }
+    byVersion := make(map[int64]Migration)
+    for _, migration := range migrations {
+        byVersion[migration.Version] = migration
+    }
+
+    applied, err := AppliedMigrations(db)
+    if err != nil {
+        return err
+    }
+    for i := len(applied) - 1; i >= 0 && steps > 0; i-- {
+        migration, ok := byVersion[applied[i].Version]
+        if !ok {
+            return fmt.Errorf("migration %d_%s is applied but unknown to this build", applied[i].Version, applied[i].Name)
+        }
+        if migration.Down == "" {
+            return fmt.Errorf("migration %d_%s can't be rolled back", migration.Version, migration.Name)
+        }
+        if err := runMigration(db, migration, false); err != nil {
+            return fmt.Errorf("rolling back migration %d_%s: %w", migration.Version, migration.Name, err)
+        }
+        steps--
+    }
+    return nil
+}
+
+// runMigration applies or rolls back one migration and records it in a
+// single transaction. It does nothing if the migration is already in the
+// requested state.
+func runMigration(db *Database, migration Migration, up bool) error {
+    ctx := context.Background()
+    tx, err := db.Pool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+        return err
+    }
+    var applied bool
+    err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, migration.Version).Scan(&applied)
+    if err != nil {
+        return err
+    }
+    if applied == up {
+        return nil
+    }
+
+    if up {
+        if _, err := tx.Exec(ctx, migration.Up); err != nil {
+            return err
+        }
+        _, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+    } else {
+        if _, err := tx.Exec(ctx, migration.Down); err != nil {
+            return err
+        }
+        _, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+    }
+    if err != nil {
+        return err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return err
+    }
+
+    direction := "Applied"
+    if !up {
+        direction = "Rolled back"
+    }
+    log.Printf("%s migration %d_%s\n", direction, migration.Version, migration.Name)
+    return nil
+}
+
+// RunMigrateCommand implements the migrate subcommand:
+//
+//    migrate [up [version]]   apply pending migrations, optionally up to version
+//    migrate down [steps]     roll back the newest steps migrations, default 1
+//    migrate status           list migrations and whether they're applied
+func RunMigrateCommand(db *Database, args []string) error {
+    command := "up"
+    if len(args) > 0 {
+        command = args[0]
+    }
+    var n int64
+    if len(args) > 1 {
+        var err error
+        n, err = strconv.ParseInt(args[1], 10, 64)
+        if err != nil || n < 0 {
+            return fmt.Errorf("invalid migrate argument %q", args[1])
+        }
+    }
+
+    switch command {
+    case "up":
+        return MigrateUp(db, n)
+    case "down":
+        if n == 0 {
+            n = 1
+        }
+        return MigrateDown(db, int(n))
+    case "status":
+        return printMigrationStatus(db)
+    }
+    return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+}
+
+func printMigrationStatus(db *Database) error {
+    migrations, err := loadMigrations()
+    if err != nil {
+        return err
+    }
+    applied, err := AppliedMigrations(db)
+    if err != nil {
+        return err
+    }
+    appliedAt := make(map[int64]time.Time)
+    for _, migration := range applied {
+        appliedAt[migration.Version] = migration.AppliedAt
+    }
+
+    for _, migration := range migrations {
+        status := "pending"
+        if at, ok := appliedAt[migration.Version]; ok {
+            status = "applied " + at.Format(time.RFC3339)
+        }
+        fmt.Printf("%04d_%s\t%s\n", migration.Version, migration.Name, status)
+    }
+    return nil
+}
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS portfolio_cash_flows;
+DROP TABLE IF EXISTS portfolio_transactions;
+DROP TABLE IF EXISTS portfolio_lots;
+DROP TABLE IF EXISTS portfolios;
+DROP TABLE IF EXISTS token_safety;
+DROP TABLE IF EXISTS processed_signals;
+DROP TABLE IF EXISTS signal_cursors;
+DROP TABLE IF EXISTS wallet_cursors;
+DROP TABLE IF EXISTS daily_pnl_trend;
+DROP TABLE IF EXISTS wallet_metrics;
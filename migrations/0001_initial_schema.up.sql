@@ -0,0 +1,111 @@
+-- Baseline schema. Every statement is idempotent so deployments that
+-- predate migrations adopt it: missing tables are created, and columns a
+-- table gained after it was first created are added to it.
+
+CREATE TABLE IF NOT EXISTS wallet_metrics (
+    wallet_address VARCHAR PRIMARY KEY,
+    trade_count INTEGER,
+    win_rate FLOAT,
+    average_profit FLOAT,
+    average_profit_pct FLOAT,
+    average_loss FLOAT,
+    average_loss_pct FLOAT,
+    average_position_size FLOAT,
+    average_trade_duration INTERVAL
+);
+
+CREATE TABLE IF NOT EXISTS daily_pnl_trend (
+    id SERIAL PRIMARY KEY,
+    wallet_address VARCHAR REFERENCES wallet_metrics(wallet_address),
+    date DATE,
+    pnl FLOAT
+);
+
+CREATE TABLE IF NOT EXISTS wallet_cursors (
+    wallet_address VARCHAR PRIMARY KEY,
+    newest_signature VARCHAR,
+    oldest_signature VARCHAR,
+    backfill_complete BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS signal_cursors (
+    wallet_address VARCHAR PRIMARY KEY,
+    last_signature VARCHAR NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS processed_signals (
+    signature VARCHAR NOT NULL,
+    wallet_address VARCHAR NOT NULL,
+    token VARCHAR NOT NULL,
+    action VARCHAR NOT NULL,
+    slot BIGINT,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (signature, wallet_address, token)
+);
+
+CREATE TABLE IF NOT EXISTS token_safety (
+    mint VARCHAR PRIMARY KEY,
+    mint_authority VARCHAR,
+    freeze_authority VARCHAR,
+    supply FLOAT NOT NULL,
+    largest_accounts JSONB NOT NULL,
+    created_before TIMESTAMPTZ NOT NULL,
+    checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS portfolios (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR UNIQUE NOT NULL,
+    initial_capital NUMERIC NOT NULL,
+    balance NUMERIC NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Portfolios created before initial capital was configurable lack the
+-- column; they all started with the then fixed 10 SOL
+ALTER TABLE portfolios ADD COLUMN IF NOT EXISTS initial_capital NUMERIC NOT NULL DEFAULT 10;
+ALTER TABLE portfolios ALTER COLUMN initial_capital DROP DEFAULT;
+
+CREATE TABLE IF NOT EXISTS portfolio_lots (
+    portfolio_id BIGINT NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    id BIGINT NOT NULL,
+    token VARCHAR NOT NULL,
+    source_wallet VARCHAR NOT NULL,
+    quantity NUMERIC NOT NULL,
+    initial_quantity NUMERIC NOT NULL,
+    entry_price NUMERIC NOT NULL,
+    opened_at TIMESTAMPTZ NOT NULL,
+    peak_price NUMERIC NOT NULL,
+    tiers_taken INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (portfolio_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS portfolio_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    portfolio_id BIGINT NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    executed_at TIMESTAMPTZ NOT NULL,
+    action VARCHAR NOT NULL,
+    token VARCHAR NOT NULL,
+    source_wallet VARCHAR NOT NULL,
+    quantity NUMERIC NOT NULL,
+    price NUMERIC NOT NULL,
+    expected_price NUMERIC NOT NULL,
+    fee NUMERIC NOT NULL,
+    total NUMERIC NOT NULL,
+    reason VARCHAR NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS portfolio_cash_flows (
+    id BIGSERIAL PRIMARY KEY,
+    portfolio_id BIGINT NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    amount NUMERIC NOT NULL,
+    value_before NUMERIC NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_win_rate ON wallet_metrics(win_rate);
+CREATE INDEX IF NOT EXISTS idx_average_profit ON wallet_metrics(average_profit);
+CREATE INDEX IF NOT EXISTS idx_trade_count ON wallet_metrics(trade_count);
+CREATE INDEX IF NOT EXISTS idx_portfolio_transactions ON portfolio_transactions(portfolio_id, executed_at);
@@ -0,0 +1,2 @@
+ALTER TABLE daily_pnl_trend
+    DROP CONSTRAINT IF EXISTS daily_pnl_trend_wallet_date_key;
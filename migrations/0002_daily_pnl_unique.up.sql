@@ -0,0 +1,12 @@
+-- InsertDailyPnL upserts ON CONFLICT (wallet_address, date), which needs a
+-- unique constraint on those columns. Keep the newest row of any duplicates
+-- first so the constraint can be added.
+
+DELETE FROM daily_pnl_trend older
+USING daily_pnl_trend newer
+WHERE older.wallet_address = newer.wallet_address
+    AND older.date = newer.date
+    AND older.id < newer.id;
+
+ALTER TABLE daily_pnl_trend
+    ADD CONSTRAINT daily_pnl_trend_wallet_date_key UNIQUE (wallet_address, date);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS round_trips;
+DROP TABLE IF EXISTS swap_legs;
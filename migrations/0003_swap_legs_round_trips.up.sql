@@ -0,0 +1,51 @@
+-- Decoded swap legs of tracked wallets, so history survives restarts and
+-- metrics can be recomputed without going back to RPC. leg_index orders the
+-- legs of one transaction.
+CREATE TABLE swap_legs (
+    signature VARCHAR NOT NULL,
+    wallet_address VARCHAR NOT NULL,
+    leg_index INTEGER NOT NULL,
+    slot BIGINT NOT NULL,
+    block_time TIMESTAMPTZ NOT NULL,
+    program_id VARCHAR NOT NULL,
+    pool VARCHAR NOT NULL DEFAULT '',
+    input_mint VARCHAR NOT NULL,
+    output_mint VARCHAR NOT NULL,
+    input_amount FLOAT NOT NULL,
+    output_amount FLOAT NOT NULL,
+    input_balance_before FLOAT NOT NULL DEFAULT 0,
+    sol_reserve FLOAT NOT NULL DEFAULT 0,
+    token_reserve FLOAT NOT NULL DEFAULT 0,
+    sol_vault VARCHAR NOT NULL DEFAULT '',
+    token_vault VARCHAR NOT NULL DEFAULT '',
+    PRIMARY KEY (signature, wallet_address, leg_index)
+);
+
+CREATE INDEX idx_swap_legs_wallet_slot ON swap_legs(wallet_address, slot);
+
+-- Closed round trips reconstructed from swap_legs, replaced as a whole for
+-- a wallet each time its metrics are computed. seq numbers the portions of
+-- one sell matched against different buys.
+CREATE TABLE round_trips (
+    wallet_address VARCHAR NOT NULL,
+    signature VARCHAR NOT NULL,
+    token VARCHAR NOT NULL,
+    seq INTEGER NOT NULL,
+    open_signature VARCHAR NOT NULL,
+    slot BIGINT NOT NULL,
+    open_time TIMESTAMPTZ NOT NULL,
+    close_time TIMESTAMPTZ NOT NULL,
+    quantity FLOAT NOT NULL,
+    price FLOAT NOT NULL,
+    position_size FLOAT NOT NULL,
+    profit FLOAT NOT NULL,
+    profit_pct FLOAT NOT NULL,
+    cost_basis VARCHAR NOT NULL,
+    PRIMARY KEY (wallet_address, signature, token, seq)
+);
+
+CREATE INDEX idx_round_trips_wallet_close ON round_trips(wallet_address, close_time);
+
+-- Cursors were persisted while legs were not. Walk every wallet again so
+-- its legs land in swap_legs.
+DELETE FROM wallet_cursors;
@@ -0,0 +1,18 @@
+-- Append-only snapshots of wallet_metrics, one per wallet per metrics pass,
+-- so trends can be told apart from the latest value
+CREATE TABLE wallet_metrics_history (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_address VARCHAR NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    trade_count INTEGER,
+    win_rate FLOAT,
+    average_profit FLOAT,
+    average_profit_pct FLOAT,
+    average_loss FLOAT,
+    average_loss_pct FLOAT,
+    average_position_size FLOAT,
+    average_trade_duration INTERVAL
+);
+
+CREATE INDEX idx_wallet_metrics_history_recorded ON wallet_metrics_history(recorded_at, wallet_address);
+CREATE INDEX idx_wallet_metrics_history_wallet ON wallet_metrics_history(wallet_address, recorded_at);
@@ -0,0 +1,2 @@
+ALTER TABLE wallet_cursors DROP COLUMN IF EXISTS catch_up_before;
+ALTER TABLE wallet_cursors DROP COLUMN IF EXISTS catch_up_tip;
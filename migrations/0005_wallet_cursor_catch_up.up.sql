@@ -0,0 +1,4 @@
+-- Where an unfinished walk back to newest_signature started and resumes,
+-- so catching up after an outage can be spread over several cycles
+ALTER TABLE wallet_cursors ADD COLUMN catch_up_tip VARCHAR;
+ALTER TABLE wallet_cursors ADD COLUMN catch_up_before VARCHAR;
@@ -1,30 +1,70 @@
 package main
 
 import (
+    "context"
     "log"
+    "sync"
     "time"
 
     "github.com/shopspring/decimal"
 )
 
+// How long a single price lookup may take
+const priceFetchTimeout = 10 * time.Second
+
 type MonitoringModule struct {
-    DB        *Database
-    Portfolio *Portfolio
+    DB           Store
+    Portfolio    *Portfolio
+    RPCEndpoints *EndpointPool
+    Prices       PriceSource
+    Rejections   *RejectionStats
 }
 
-func InitializeMonitoring(db *Database, portfolio *Portfolio) *MonitoringModule {
+func InitializeMonitoring(db Store, portfolio *Portfolio, rpcEndpoints *EndpointPool, prices PriceSource) *MonitoringModule {
     return &MonitoringModule{
-        DB:        db,
-        Portfolio: portfolio,
+        DB:           db,
+        Portfolio:    portfolio,
+        RPCEndpoints: rpcEndpoints,
+        Prices:       prices,
+        Rejections:   NewRejectionStats(),
     }
 }
 
+// RejectionStats counts signals dropped before execution, by reason
+type RejectionStats struct {
+    counts map[string]int64
+    mutex  sync.Mutex
+}
+
+func NewRejectionStats() *RejectionStats {
+    return &RejectionStats{counts: make(map[string]int64)}
+}
+
+func (rs *RejectionStats) Record(reason string) {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    rs.counts[reason]++
+}
+
+func (rs *RejectionStats) Snapshot() map[string]int64 {
+    rs.mutex.Lock()
+    defer rs.mutex.Unlock()
+    snapshot := make(map[string]int64, len(rs.counts))
+    for reason, count := range rs.counts {
+        snapshot[reason] = count
+    }
+    return snapshot
+}
+
 type PerformanceMetrics struct {
     TotalSOL      decimal.Decimal
     TotalValue    decimal.Decimal
-    ProfitLossSOL decimal.Decimal
-    ProfitLossPct decimal.Decimal
+    NetDeposits   decimal.Decimal // Initial capital plus deposits minus withdrawals
+    ProfitLossSOL decimal.Decimal // TotalValue over NetDeposits
+    ProfitLossPct decimal.Decimal // Time-weighted return
     SharpeRatio   float64 // Optional
+    RPCEndpoints  []EndpointStats
+    Rejections    map[string]int64
     // Add more metrics as needed
 }
 
@@ -32,49 +72,69 @@ func (mm *MonitoringModule) CollectMetrics() PerformanceMetrics {
     metrics := PerformanceMetrics{}
 
     metrics.TotalSOL = mm.Portfolio.GetBalance()
-    holdings := mm.Portfolio.GetHoldings()
+    metrics.TotalValue = mm.PortfolioValue()
+
+    // Calculate Profit/Loss against what was put in, so deposits and
+    // withdrawals don't show up as performance
+    metrics.NetDeposits = mm.Portfolio.NetDeposits()
+    metrics.ProfitLossSOL = metrics.TotalValue.Sub(metrics.NetDeposits)
+    metrics.ProfitLossPct = mm.Portfolio.TimeWeightedReturn(metrics.TotalValue).Mul(decimal.NewFromFloat(100.0))
+
+    // Optional: Calculate Sharpe Ratio or other advanced metrics
+
+    if mm.RPCEndpoints != nil {
+        metrics.RPCEndpoints = mm.RPCEndpoints.Stats()
+    }
+    metrics.Rejections = mm.Rejections.Snapshot()
 
-    // Assume you have a function to get current prices
-    totalValue := metrics.TotalSOL
-    for token, quantity := range holdings {
+    return metrics
+}
+
+// PortfolioValue is the SOL balance plus the holdings at current prices.
+// Holdings that can't be priced are left out.
+func (mm *MonitoringModule) PortfolioValue() decimal.Decimal {
+    return mm.Portfolio.Value(mm.HoldingPrices())
+}
+
+// HoldingPrices returns the current price of every held token that can be
+// priced
+func (mm *MonitoringModule) HoldingPrices() map[string]decimal.Decimal {
+    prices := make(map[string]decimal.Decimal)
+    for token := range mm.Portfolio.GetHoldings() {
         price, err := mm.FetchCurrentPrice(token)
         if err != nil {
             log.Println("Error fetching price for token:", token, err)
             continue
         }
-        tokenValue := quantity.Mul(price)
-        totalValue = totalValue.Add(tokenValue)
+        prices[token] = price
     }
-
-    metrics.TotalValue = totalValue
-
-    // Calculate Profit/Loss
-    // For simplicity, assume initial investment is 10 SOL
-    initialInvestment := decimal.NewFromFloat(10.0)
-    metrics.ProfitLossSOL = metrics.TotalValue.Sub(initialInvestment)
-    metrics.ProfitLossPct = metrics.ProfitLossSOL.Div(initialInvestment).Mul(decimal.NewFromFloat(100.0))
-
-    // Optional: Calculate Sharpe Ratio or other advanced metrics
-
-    return metrics
+    return prices
 }
 
+// FetchCurrentPrice returns the token's price in SOL from the price source
 func (mm *MonitoringModule) FetchCurrentPrice(token string) (decimal.Decimal, error) {
-    // Implement fetching current price from an API or data source
-    // For paper trading, return mock prices based on some logic
-
-    // Placeholder: Return a mock price that fluctuates slightly
-    // In a real scenario, fetch from a reliable API
-    currentTime := time.Now().Unix()
-    mockPrice := 2.0 + float64(currentTime%10)/10.0 // Simple fluctuation
+    ctx, cancel := context.WithTimeout(context.Background(), priceFetchTimeout)
+    defer cancel()
 
-    return decimal.NewFromFloat(mockPrice), nil
+    quote, err := mm.Prices.Price(ctx, token)
+    if err != nil {
+        return decimal.Zero, err
+    }
+    return quote.Price, nil
 }
 
 func (mm *MonitoringModule) LogPerformance(metrics PerformanceMetrics) {
     log.Printf("Total SOL Balance: %s SOL\n", metrics.TotalSOL.String())
     log.Printf("Total Portfolio Value: %s SOL\n", metrics.TotalValue.String())
+    log.Printf("Net Deposits: %s SOL\n", metrics.NetDeposits.String())
     log.Printf("Profit/Loss: %s SOL (%.2f%%)\n", metrics.ProfitLossSOL.String(), metrics.ProfitLossPct.InexactFloat64())
+    for reason, count := range metrics.Rejections {
+        log.Printf("Rejected Signals (%s): %d\n", reason, count)
+    }
+    for _, endpoint := range metrics.RPCEndpoints {
+        log.Printf("RPC %s - Healthy: %t, Slot Lag: %d, Requests: %d, Errors: %d, Avg Latency: %.1fms\n",
+            endpoint.Endpoint, endpoint.Healthy, endpoint.SlotLag, endpoint.Requests, endpoint.Errors, endpoint.AvgLatencyMs)
+    }
     // Log more metrics as needed
 }
 
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "math/rand"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Solana's base fee per transaction signature
+const baseFeeLamports = 5000
+
+// PaperExecutor simulates fills without touching the chain. A buy spends
+// Quantity × Price SOL and a sell sells Quantity tokens against a constant
+// product pool. The fill lands after a random latency, and the pool is read
+// again at that point, so the simulation sees any moves made while we were
+// waiting. When it can't be read, the reserves the source wallet's swap left
+// behind are used: both sides for constant product pools, and otherwise
+// only the SOL side as a measure of depth, priced at the signal price, as
+// vault balances misprice bonding curves with virtual reserves and
+// concentrated liquidity pools. Exits we originate carry no reserves and
+// their price is the mark that fired them, so without a readable pool they
+// are priced by a fresh quote from Prices instead, and fail without one.
+// The swap fee is taken from the input, and base and priority fees are
+// charged in SOL.
+type PaperExecutor struct {
+    Pools               *PoolPriceSource
+    Prices              PriceSource
+    SwapFeeBps          float64
+    PriorityFeeLamports uint64
+    LatencyMin          time.Duration
+    LatencyMax          time.Duration
+}
+
+func NewPaperExecutor(config Config, pools *PoolPriceSource, prices PriceSource) *PaperExecutor {
+    return &PaperExecutor{
+        Pools:               pools,
+        Prices:              prices,
+        SwapFeeBps:          config.PaperSwapFeeBps,
+        PriorityFeeLamports: config.PaperPriorityFeeLamports,
+        LatencyMin:          config.PaperLatencyMin,
+        LatencyMax:          config.PaperLatencyMax,
+    }
+}
+
+func (pe *PaperExecutor) Execute(ctx context.Context, signal TradeSignal) (Fill, error) {
+    latency := pe.LatencyMin
+    if pe.LatencyMax > pe.LatencyMin {
+        latency += time.Duration(rand.Int63n(int64(pe.LatencyMax - pe.LatencyMin)))
+    }
+    select {
+    case <-ctx.Done():
+        return Fill{}, ctx.Err()
+    case <-time.After(latency):
+    }
+
+    expected := signal.Price
+    solReserve, tokenReserve := pe.reserves(ctx, signal)
+    if signal.LotID != 0 && (solReserve <= 0 || tokenReserve <= 0) {
+        if pe.Prices == nil {
+            return Fill{}, fmt.Errorf("no pool or price source to fill exit of %s", signal.Token)
+        }
+        quote, err := pe.Prices.Price(ctx, signal.Token)
+        if err != nil {
+            return Fill{}, fmt.Errorf("pricing exit of %s: %w", signal.Token, err)
+        }
+        signal.Price = quote.Price.InexactFloat64()
+    }
+
+    quantity, price := pe.simulate(signal, solReserve, tokenReserve)
+    return Fill{
+        Quantity:      decimal.NewFromFloat(quantity),
+        Price:         decimal.NewFromFloat(price),
+        ExpectedPrice: decimal.NewFromFloat(expected),
+        Fee:           decimal.New(int64(baseFeeLamports+pe.PriorityFeeLamports), -9),
+    }, nil
+}
+
+// reserves returns the SOL and token reserves to trade against: the pool's
+// as they stand now, or else those the source wallet's swap left behind
+func (pe *PaperExecutor) reserves(ctx context.Context, signal TradeSignal) (float64, float64) {
+    if pe.Pools != nil {
+        if reserves, err := pe.Pools.Reserves(ctx, signal.Token); err == nil {
+            return reserves.SOL, reserves.Token
+        }
+    }
+
+    solReserve, tokenReserve := signal.Reserves.SOL, signal.Reserves.Token
+    switch signal.ProgramID {
+    case raydiumAMMProgramID, raydiumCPMMProgramID:
+        if tokenReserve > 0 {
+            return solReserve, tokenReserve
+        }
+    }
+    return solReserve, solReserve / signal.Price
+}
+
+// simulate returns the token quantity and realized price of the signal's
+// swap against the reserves. Without a known reserve only the swap fee is
+// applied.
+func (pe *PaperExecutor) simulate(signal TradeSignal, solReserve, tokenReserve float64) (float64, float64) {
+    afterFee := 1 - pe.SwapFeeBps/10000
+
+    if signal.Action == "buy" {
+        solIn := signal.Quantity * signal.Price
+        tokensOut := signal.Quantity * afterFee
+        if solReserve > 0 && tokenReserve > 0 {
+            tokensOut = tokenReserve * solIn * afterFee / (solReserve + solIn*afterFee)
+        }
+        if tokensOut <= 0 {
+            return 0, signal.Price
+        }
+        return tokensOut, solIn / tokensOut
+    }
+
+    tokensIn := signal.Quantity
+    if tokensIn <= 0 {
+        return 0, signal.Price
+    }
+    solOut := tokensIn * signal.Price * afterFee
+    if solReserve > 0 && tokenReserve > 0 {
+        solOut = solReserve * tokensIn * afterFee / (tokenReserve + tokensIn*afterFee)
+    }
+    return tokensIn, math.Max(solOut, 0) / tokensIn
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestPaperExecutorReserves(t *testing.T) {
+    const (
+        solVault   = "DQyrAcCrDXQ7NeoqGgDCZwBvWDcYmFCjSb9JtteuvPpz"
+        tokenVault = "HLmqeL62xR1QoZ1HKKbXRrdN1p3phKpxRMb2VVopvBBz"
+    )
+    raydium := TradeSignal{
+        Action:      "buy",
+        Token:       "token",
+        Quantity:    10,
+        Price:       0.1,
+        SourcePrice: 0.1,
+        ProgramID:   raydiumAMMProgramID,
+        Pool:        "pool",
+        Reserves:    PoolReserves{SOL: 100, Token: 500, SOLVault: solVault, TokenVault: tokenVault},
+    }
+    pumpFun := raydium
+    pumpFun.ProgramID = pumpFunProgramID
+
+    tests := []struct {
+        name     string
+        signal   TradeSignal
+        balances map[string]float64 // Vaults as they stand after the delay
+        sol      float64
+        tokens   float64
+    }{
+        {"pool read after the delay", raydium, map[string]float64{solVault: 110, tokenVault: 450}, 110, 450},
+        {"constant product pool left by the source", raydium, nil, 100, 500},
+        // A bonding curve's real reserves don't set its price
+        {"other pool left by the source", pumpFun, nil, 100, 1000},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            rpc := newFakeRPC()
+            for account, balance := range test.balances {
+                rpc.balances[account] = balance
+            }
+            pools := NewPoolPriceSource(rpc, NewMintDecimals(rpc))
+            pools.Observe(test.signal)
+
+            executor := NewPaperExecutor(Config{PaperSwapFeeBps: 25}, pools, nil)
+            sol, tokens := executor.reserves(context.Background(), test.signal)
+            if !approxEqual(sol, test.sol) || !approxEqual(tokens, test.tokens) {
+                t.Fatalf("reserves %g SOL, %g tokens; want %g, %g", sol, tokens, test.sol, test.tokens)
+            }
+
+            fill, err := executor.Execute(context.Background(), test.signal)
+            if err != nil {
+                t.Fatal(err)
+            }
+            solIn := test.signal.Quantity * test.signal.Price * (1 - 0.0025)
+            want := test.tokens * solIn / (test.sol + solIn)
+            if !approxEqual(fill.Quantity.InexactFloat64(), want) {
+                t.Errorf("bought %s tokens, want %g", fill.Quantity, want)
+            }
+        })
+    }
+}
+
+func TestPaperExecutorExitWithoutPool(t *testing.T) {
+    // The lot's mark fired the exit; the pool has never been observed
+    exit := TradeSignal{Action: "sell", Token: "token", Quantity: 100, Price: 0.5, LotID: 1, Reason: "stop_loss"}
+
+    tests := []struct {
+        name   string
+        source *fakePriceSource
+        price  float64 // Zero when the fill must fail
+    }{
+        {"fresh quote", &fakePriceSource{price: decimal.NewFromFloat(0.2)}, 0.2 * (1 - 0.0025)},
+        {"stale quote", &fakePriceSource{price: decimal.NewFromFloat(0.2), age: time.Hour}, 0},
+        {"no quote", &fakePriceSource{err: errors.New("no route")}, 0},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            rpc := newFakeRPC()
+            prices := &FallbackPriceSource{Sources: []PriceSource{test.source}, MaxAge: time.Minute}
+            executor := NewPaperExecutor(Config{PaperSwapFeeBps: 25}, NewPoolPriceSource(rpc, NewMintDecimals(rpc)), prices)
+
+            fill, err := executor.Execute(context.Background(), exit)
+            if test.price == 0 {
+                if err == nil {
+                    t.Fatalf("filled at %s, want an error", fill.Price)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !approxEqual(fill.Price.InexactFloat64(), test.price) || !approxEqual(fill.ExpectedPrice.InexactFloat64(), exit.Price) {
+                t.Errorf("filled at %s expecting %s, want %g expecting %g", fill.Price, fill.ExpectedPrice, test.price, exit.Price)
+            }
+        })
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "log"
+)
+
+// SignalPipeline takes a copied signal through the checks and sizing that
+// sit between signal generation and execution
+type SignalPipeline struct {
+    Guard     *SignalGuard
+    Safety    *TokenSafetyFilter
+    Sizer     *PositionSizer
+    Engine    *ExecutionEngineModule
+    Positions *PositionManager
+    Pools     *PoolPriceSource
+}
+
+// Process guards, vets, sizes and executes a signal, logging why it stopped if it
+// did not reach the portfolio. The source wallet's fill also tells us where
+// the token trades, but only once the guard has run: the guard compares the
+// fill with the current price, which must not be the fill itself. The fill
+// prices our lots of the token only when the guard passed it and it is
+// fresh, so replayed and late fills, sells included, never move a lot's
+// peak or fire its exits.
+func (sp *SignalPipeline) Process(ctx context.Context, signal TradeSignal) {
+    guardErr := sp.Guard.Check(signal)
+
+    sp.Pools.Observe(signal)
+    if guardErr == nil && sp.Guard.Fresh(signal) {
+        sp.Positions.OnPrice(ctx, signal.Token, signal.SourcePrice)
+    }
+
+    if guardErr != nil {
+        log.Println("Rejected signal:", guardErr)
+        return
+    }
+
+    if err := sp.Safety.Check(ctx, signal); err != nil {
+        log.Println("Rejected signal:", err)
+        return
+    }
+
+    sized, ok := sp.Sizer.Size(signal)
+    if !ok {
+        return
+    }
+
+    err := sp.Engine.ExecuteTrade(ctx, sized)
+    if err == errSignalAlreadyProcessed {
+        log.Printf("Skipping already processed signal %s for %s\n", signal.Signature, signal.Token)
+        return
+    }
+    if err != nil {
+        log.Println("Error executing trade:", err)
+    }
+}
@@ -1,84 +1,524 @@
 package main
 
 import (
+    "fmt"
+    "log"
+    "strings"
     "sync"
     "time"
 
     "github.com/shopspring/decimal"
 )
 
+// Relative amount by which a sell may exceed the position and still close it
+var sellRoundingTolerance = decimal.New(1, -9)
+
+// Portfolio is the virtual account we trade. When DB is set every change
+// is also written to the store in one transaction, so the portfolio
+// survives restarts; Holdings are rebuilt from the lots. A change is
+// applied in memory first, since it records a trade that has already
+// happened, and one that could not be written is kept and retried in order
+// before the next.
 type Portfolio struct {
+    ID             int64
+    Name           string
+    DB             Store
+    InitialCapital decimal.Decimal            // SOL the portfolio was created with
     Balance        decimal.Decimal            // Total SOL balance
     Holdings       map[string]decimal.Decimal // Holdings in different shitcoins
+    Lots           map[string][]*Lot          // Open lots per token, oldest first
     TransactionLog []Transaction
+    CashFlows      []CashFlow
+    nextLotID      int64
+    unsaved        []PortfolioChange
     mutex          sync.Mutex
 }
 
+// Lot is a quantity of a token bought by copying one source wallet. Sells
+// mirrored from that wallet close its lots only.
+type Lot struct {
+    ID              int64
+    Token           string
+    SourceWallet    string
+    Quantity        decimal.Decimal
+    InitialQuantity decimal.Decimal
+    EntryPrice      decimal.Decimal
+    OpenedAt        time.Time
+
+    // Exit management: the highest price seen since entry and how many
+    // take-profit tiers have been sold
+    PeakPrice  decimal.Decimal
+    TiersTaken int
+}
+
 type Transaction struct {
-    Timestamp time.Time
-    Action    string          // "buy" or "sell"
-    Token     string
-    Quantity  decimal.Decimal
-    Price     decimal.Decimal
-    Total     decimal.Decimal
+    Timestamp     time.Time
+    Action        string          // "buy" or "sell"
+    Token         string
+    SourceWallet  string
+    Quantity      decimal.Decimal
+    Price         decimal.Decimal // Realized
+    ExpectedPrice decimal.Decimal // What the signal asked for
+    Fee           decimal.Decimal // Network fees in SOL
+    Total         decimal.Decimal // Quantity × Price, before fees
+    Reason        string          // Exit rule that fired; empty for copied trades
+}
+
+// CashFlow is SOL added to (positive Amount) or taken out of (negative) the
+// portfolio. ValueBefore is the portfolio's total value just before the
+// flow, which splits performance into periods unaffected by it.
+type CashFlow struct {
+    Timestamp   time.Time
+    Amount      decimal.Decimal
+    ValueBefore decimal.Decimal
+}
+
+// PortfolioChange is what one portfolio operation writes: the new balance,
+// lots opened or updated, lots closed and the transaction or cash flow, if any
+type PortfolioChange struct {
+    Balance     decimal.Decimal
+    SavedLots   []Lot
+    ClosedLots  []int64
+    Transaction *Transaction
+    CashFlow    *CashFlow
 }
 
 func NewPortfolio(initialSOL decimal.Decimal) *Portfolio {
     return &Portfolio{
-        Balance:  initialSOL,
-        Holdings: make(map[string]decimal.Decimal),
+        InitialCapital: initialSOL,
+        Balance:        initialSOL,
+        Holdings:       make(map[string]decimal.Decimal),
+        Lots:           make(map[string][]*Lot),
+    }
+}
+
+// OpenPortfolio restores the named portfolio from the store, creating it
+// with initialSOL if it does not exist. With fresh set the portfolio must
+// not exist yet.
+func OpenPortfolio(db Store, name string, fresh bool, initialSOL decimal.Decimal) (*Portfolio, error) {
+    portfolio, err := db.LoadPortfolio(name)
+    if err != nil {
+        return nil, err
+    }
+    if portfolio != nil {
+        if fresh {
+            return nil, fmt.Errorf("portfolio %q already exists", name)
+        }
+        portfolio.DB = db
+        log.Printf("Restored portfolio %q: %s SOL, %d open lots, %d transactions\n",
+            name, portfolio.Balance.String(), len(portfolio.GetLots()), len(portfolio.TransactionLog))
+        if !portfolio.InitialCapital.Equal(initialSOL) {
+            log.Printf("Portfolio %q keeps its initial capital of %s SOL\n", name, portfolio.InitialCapital.String())
+        }
+        return portfolio, nil
+    }
+
+    portfolio = NewPortfolio(initialSOL)
+    portfolio.Name = name
+    portfolio.DB = db
+    id, err := db.CreatePortfolio(name, initialSOL)
+    if err != nil {
+        return nil, fmt.Errorf("creating portfolio %q: %w", name, err)
+    }
+    portfolio.ID = id
+    log.Printf("Created portfolio %q with %s SOL\n", name, initialSOL.String())
+    return portfolio, nil
+}
+
+// commit applies change and queues it to be written, then writes what is
+// queued. Must be called with p.mutex held.
+func (p *Portfolio) commit(change PortfolioChange) {
+    p.Balance = change.Balance
+    for i := range change.SavedLots {
+        p.saveLot(change.SavedLots[i])
+    }
+    for _, id := range change.ClosedLots {
+        p.closeLot(id)
+    }
+    if change.Transaction != nil {
+        p.TransactionLog = append(p.TransactionLog, *change.Transaction)
+    }
+    if change.CashFlow != nil {
+        p.CashFlows = append(p.CashFlows, *change.CashFlow)
+    }
+
+    if p.DB != nil {
+        p.unsaved = append(p.unsaved, change)
+        p.save()
+    }
+}
+
+// save writes the queued changes oldest first, stopping at the first that
+// fails: each change holds the balance and lots as they stood after it, so
+// a later one must not be written before an earlier one.
+// Must be called with p.mutex held.
+func (p *Portfolio) save() {
+    for len(p.unsaved) > 0 {
+        if err := p.DB.SavePortfolioChange(p.ID, p.unsaved[0]); err != nil {
+            log.Printf("Error persisting portfolio, %d changes waiting: %v\n", len(p.unsaved), err)
+            return
+        }
+        p.unsaved = p.unsaved[1:]
+    }
+}
+
+// SaveQueued retries writing the changes that could not be saved yet, and
+// reports how many are still waiting
+func (p *Portfolio) SaveQueued() int {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if p.DB != nil {
+        p.save()
     }
+    return len(p.unsaved)
 }
 
-func (p *Portfolio) Buy(token string, quantity, price decimal.Decimal) bool {
+// saveLot replaces the lot with the same ID, or appends it as a new lot
+func (p *Portfolio) saveLot(updated Lot) {
+    lot := &updated
+    found := false
+    for i, existing := range p.Lots[updated.Token] {
+        if existing.ID == updated.ID {
+            p.Holdings[updated.Token] = p.Holdings[updated.Token].Sub(existing.Quantity)
+            p.Lots[updated.Token][i] = lot
+            found = true
+        }
+    }
+    if !found {
+        p.Lots[updated.Token] = append(p.Lots[updated.Token], lot)
+    }
+    p.Holdings[updated.Token] = p.Holdings[updated.Token].Add(lot.Quantity)
+    if updated.ID > p.nextLotID {
+        p.nextLotID = updated.ID
+    }
+}
+
+func (p *Portfolio) closeLot(id int64) {
+    for token, lots := range p.Lots {
+        var open []*Lot
+        for _, lot := range lots {
+            if lot.ID == id {
+                p.Holdings[token] = p.Holdings[token].Sub(lot.Quantity)
+                continue
+            }
+            open = append(open, lot)
+        }
+        if len(open) == 0 {
+            delete(p.Lots, token)
+            delete(p.Holdings, token)
+        } else {
+            p.Lots[token] = open
+        }
+    }
+}
+
+// Buy opens a lot of the filled quantity attributed to sourceWallet
+func (p *Portfolio) Buy(token, sourceWallet string, fill Fill) bool {
+    return p.BuyFor(token, []string{sourceWallet}, fill)
+}
+
+// BuyFor opens one lot per source wallet, splitting the filled quantity
+// evenly, so each wallet's later exits close only its share. The fill's fee
+// is paid from the balance on top of its cost.
+func (p *Portfolio) BuyFor(token string, sourceWallets []string, fill Fill) bool {
     p.mutex.Lock()
     defer p.mutex.Unlock()
 
+    quantity, price := fill.Quantity, fill.Price
     totalCost := quantity.Mul(price)
-    if p.Balance.LessThan(totalCost) {
+    if p.Balance.LessThan(totalCost.Add(fill.Fee)) {
         return false // Not enough balance
     }
 
-    p.Balance = p.Balance.Sub(totalCost)
-    p.Holdings[token] = p.Holdings[token].Add(quantity)
+    now := time.Now()
+    change := PortfolioChange{Balance: p.Balance.Sub(totalCost).Sub(fill.Fee)}
+    share := quantity.Div(decimal.NewFromInt(int64(len(sourceWallets))))
+    for i, sourceWallet := range sourceWallets {
+        lotQuantity := share
+        if i == len(sourceWallets)-1 {
+            // The last lot absorbs the division remainder
+            lotQuantity = quantity.Sub(share.Mul(decimal.NewFromInt(int64(i))))
+        }
+        change.SavedLots = append(change.SavedLots, Lot{
+            ID:              p.nextLotID + int64(i) + 1,
+            Token:           token,
+            SourceWallet:    sourceWallet,
+            Quantity:        lotQuantity,
+            InitialQuantity: lotQuantity,
+            EntryPrice:      price,
+            OpenedAt:        now,
+            PeakPrice:       price,
+        })
+    }
 
-    p.TransactionLog = append(p.TransactionLog, Transaction{
-        Timestamp: time.Now(),
-        Action:    "buy",
-        Token:     token,
-        Quantity:  quantity,
-        Price:     price,
-        Total:     totalCost,
-    })
+    change.Transaction = &Transaction{
+        Timestamp:     now,
+        Action:        "buy",
+        Token:         token,
+        SourceWallet:  strings.Join(sourceWallets, ","),
+        Quantity:      quantity,
+        Price:         price,
+        ExpectedPrice: fill.ExpectedPrice,
+        Fee:           fill.Fee,
+        Total:         totalCost,
+    }
 
+    p.commit(change)
     return true
 }
 
-func (p *Portfolio) Sell(token string, quantity, price decimal.Decimal) bool {
+// Sell closes the filled quantity from the lots of sourceWallet, oldest
+// first, and pays the fill's fee out of the proceeds. An empty sourceWallet
+// sells from all lots of the token.
+func (p *Portfolio) Sell(token, sourceWallet string, fill Fill) bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    match := func(lot *Lot) bool {
+        return sourceWallet == "" || lot.SourceWallet == sourceWallet
+    }
+    return p.sell(token, match, fill, sourceWallet, "", 0)
+}
+
+// SellLot closes the filled quantity from one lot, for exits that concern
+// that lot alone, and records the rule that fired as the reason. The lot's
+// take-profit tiers taken are raised to tiersTaken with the same change.
+func (p *Portfolio) SellLot(token string, lotID int64, fill Fill, reason string, tiersTaken int) bool {
     p.mutex.Lock()
     defer p.mutex.Unlock()
 
-    holding, exists := p.Holdings[token]
-    if !exists || holding.LessThan(quantity) {
-        return false // Not enough holdings
+    sourceWallet := ""
+    for _, lot := range p.Lots[token] {
+        if lot.ID == lotID {
+            sourceWallet = lot.SourceWallet
+        }
+    }
+    if sourceWallet == "" {
+        return false // Lot already closed
+    }
+
+    match := func(lot *Lot) bool {
+        return lot.ID == lotID
+    }
+    return p.sell(token, match, fill, sourceWallet, reason, tiersTaken)
+}
+
+// sell closes the filled quantity from the token's lots accepted by match,
+// oldest first, raising the tiers taken of those left open to tiersTaken.
+// Must be called with p.mutex held.
+func (p *Portfolio) sell(token string, match func(lot *Lot) bool, fill Fill, sourceWallet, reason string, tiersTaken int) bool {
+    quantity, price := fill.Quantity, fill.Price
+
+    position := decimal.Zero
+    for _, lot := range p.Lots[token] {
+        if match(lot) {
+            position = position.Add(lot.Quantity)
+        }
+    }
+    if position.LessThan(quantity) {
+        // Quantities round-tripped through float64 may overshoot by a hair
+        if quantity.Sub(position).GreaterThan(position.Mul(sellRoundingTolerance)) {
+            return false // Not enough holdings
+        }
+        quantity = position
     }
 
     totalRevenue := quantity.Mul(price)
-    p.Balance = p.Balance.Add(totalRevenue)
-    p.Holdings[token] = holding.Sub(quantity)
-
-    p.TransactionLog = append(p.TransactionLog, Transaction{
-        Timestamp: time.Now(),
-        Action:    "sell",
-        Token:     token,
-        Quantity:  quantity,
-        Price:     price,
-        Total:     totalRevenue,
-    })
+    change := PortfolioChange{Balance: p.Balance.Add(totalRevenue).Sub(fill.Fee)}
+    remaining := quantity
+    for _, lot := range p.Lots[token] {
+        if !remaining.IsPositive() || !match(lot) {
+            continue
+        }
+        matched := decimal.Min(remaining, lot.Quantity)
+        remaining = remaining.Sub(matched)
+        if matched.Equal(lot.Quantity) {
+            change.ClosedLots = append(change.ClosedLots, lot.ID)
+            continue
+        }
+        updated := *lot
+        updated.Quantity = lot.Quantity.Sub(matched)
+        if tiersTaken > updated.TiersTaken {
+            updated.TiersTaken = tiersTaken
+        }
+        change.SavedLots = append(change.SavedLots, updated)
+    }
 
+    change.Transaction = &Transaction{
+        Timestamp:     time.Now(),
+        Action:        "sell",
+        Token:         token,
+        SourceWallet:  sourceWallet,
+        Quantity:      quantity,
+        Price:         price,
+        ExpectedPrice: fill.ExpectedPrice,
+        Fee:           fill.Fee,
+        Total:         totalRevenue,
+        Reason:        reason,
+    }
+
+    p.commit(change)
     return true
 }
 
+// MarkPrice raises the peak price of the token's lots to price
+func (p *Portfolio) MarkPrice(token string, price decimal.Decimal) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    change := PortfolioChange{Balance: p.Balance}
+    for _, lot := range p.Lots[token] {
+        if price.GreaterThan(lot.PeakPrice) {
+            updated := *lot
+            updated.PeakPrice = price
+            change.SavedLots = append(change.SavedLots, updated)
+        }
+    }
+    if len(change.SavedLots) > 0 {
+        p.commit(change)
+    }
+}
+
+// Deposit adds SOL to the balance. The cash flow records the portfolio's
+// value just before it, with holdings at prices; tokens without a price are
+// left out.
+func (p *Portfolio) Deposit(amount decimal.Decimal, prices map[string]decimal.Decimal) (CashFlow, bool) {
+    if !amount.IsPositive() {
+        return CashFlow{}, false
+    }
+    return p.recordCashFlow(amount, prices)
+}
+
+// Withdraw takes SOL out of the balance, which must cover it
+func (p *Portfolio) Withdraw(amount decimal.Decimal, prices map[string]decimal.Decimal) (CashFlow, bool) {
+    if !amount.IsPositive() {
+        return CashFlow{}, false
+    }
+    return p.recordCashFlow(amount.Neg(), prices)
+}
+
+// recordCashFlow values the portfolio and moves the balance under one lock,
+// so no trade can land in between
+func (p *Portfolio) recordCashFlow(amount decimal.Decimal, prices map[string]decimal.Decimal) (CashFlow, bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    balance := p.Balance.Add(amount)
+    if balance.IsNegative() {
+        return CashFlow{}, false // Not enough balance
+    }
+    flow := CashFlow{
+        Timestamp:   time.Now(),
+        Amount:      amount,
+        ValueBefore: p.value(prices),
+    }
+    p.commit(PortfolioChange{Balance: balance, CashFlow: &flow})
+    return flow, true
+}
+
+// Value is the SOL balance plus the holdings at prices. Tokens without a
+// price are left out.
+func (p *Portfolio) Value(prices map[string]decimal.Decimal) decimal.Decimal {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.value(prices)
+}
+
+// Must be called with p.mutex held
+func (p *Portfolio) value(prices map[string]decimal.Decimal) decimal.Decimal {
+    value := p.Balance
+    for token, quantity := range p.Holdings {
+        if price, ok := prices[token]; ok {
+            value = value.Add(quantity.Mul(price))
+        }
+    }
+    return value
+}
+
+// NetDeposits is the initial capital plus deposits minus withdrawals: the
+// SOL the portfolio has to exceed to be in profit
+func (p *Portfolio) NetDeposits() decimal.Decimal {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    net := p.InitialCapital
+    for _, flow := range p.CashFlows {
+        net = net.Add(flow.Amount)
+    }
+    return net
+}
+
+// TimeWeightedReturn chains the returns of the periods between cash flows,
+// ending at the current total value, so deposits and withdrawals don't
+// count as gains or losses. Periods starting from nothing are skipped.
+func (p *Portfolio) TimeWeightedReturn(value decimal.Decimal) decimal.Decimal {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    growth := decimal.NewFromInt(1)
+    start := p.InitialCapital
+    for _, flow := range p.CashFlows {
+        if start.IsPositive() {
+            growth = growth.Mul(flow.ValueBefore.Div(start))
+        }
+        start = flow.ValueBefore.Add(flow.Amount)
+    }
+    if start.IsPositive() {
+        growth = growth.Mul(value.Div(start))
+    }
+    return growth.Sub(decimal.NewFromInt(1))
+}
+
+func (p *Portfolio) GetCashFlows() []CashFlow {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return append([]CashFlow(nil), p.CashFlows...)
+}
+
+// SourcePosition is the quantity of token held in lots of sourceWallet
+func (p *Portfolio) SourcePosition(token, sourceWallet string) decimal.Decimal {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.sourcePosition(token, sourceWallet)
+}
+
+func (p *Portfolio) sourcePosition(token, sourceWallet string) decimal.Decimal {
+    total := decimal.Zero
+    for _, lot := range p.Lots[token] {
+        if sourceWallet == "" || lot.SourceWallet == sourceWallet {
+            total = total.Add(lot.Quantity)
+        }
+    }
+    return total
+}
+
+// SourceExposure is the entry cost in SOL of all open lots of sourceWallet
+func (p *Portfolio) SourceExposure(sourceWallet string) decimal.Decimal {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    total := decimal.Zero
+    for _, lots := range p.Lots {
+        for _, lot := range lots {
+            if lot.SourceWallet == sourceWallet {
+                total = total.Add(lot.Quantity.Mul(lot.EntryPrice))
+            }
+        }
+    }
+    return total
+}
+
+// GetLots returns a copy of the open lots of every token
+func (p *Portfolio) GetLots() []Lot {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    var lots []Lot
+    for _, tokenLots := range p.Lots {
+        for _, lot := range tokenLots {
+            lots = append(lots, *lot)
+        }
+    }
+    return lots
+}
+
 func (p *Portfolio) GetBalance() decimal.Decimal {
     p.mutex.Lock()
     defer p.mutex.Unlock()
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+// flakyStore fails portfolio writes while down
+type flakyStore struct {
+    *MemoryStore
+    down bool
+}
+
+func (fs *flakyStore) SavePortfolioChange(portfolioID int64, change PortfolioChange) error {
+    if fs.down {
+        return errors.New("connection refused")
+    }
+    return fs.MemoryStore.SavePortfolioChange(portfolioID, change)
+}
+
+func TestPortfolioKeepsFillsTheStoreRefused(t *testing.T) {
+    store := &flakyStore{MemoryStore: NewMemoryStore()}
+    portfolio, err := OpenPortfolio(store, "test", true, decimal.NewFromInt(10))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Both trades already happened, so they are booked while the store is down
+    store.down = true
+    if !portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(100), Price: decimal.NewFromFloat(0.01), Fee: decimal.New(5, -6)}) {
+        t.Fatal("buy not booked")
+    }
+    lotID := portfolio.GetLots()[0].ID
+    if !portfolio.SellLot("token", lotID, Fill{Quantity: decimal.NewFromInt(40), Price: decimal.NewFromFloat(0.02)}, "take_profit_1", 1) {
+        t.Fatal("sell not booked")
+    }
+    if waiting := portfolio.SaveQueued(); waiting != 2 {
+        t.Fatalf("%d changes waiting, want 2", waiting)
+    }
+
+    store.down = false
+    if waiting := portfolio.SaveQueued(); waiting != 0 {
+        t.Fatalf("%d changes still waiting", waiting)
+    }
+
+    restored, err := store.LoadPortfolio("test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !restored.Balance.Equal(portfolio.GetBalance()) || !restored.Balance.Equal(decimal.RequireFromString("9.799995")) {
+        t.Errorf("restored balance %s, in memory %s", restored.Balance, portfolio.GetBalance())
+    }
+    lots := restored.GetLots()
+    if len(lots) != 1 || !lots[0].Quantity.Equal(decimal.NewFromInt(60)) || lots[0].TiersTaken != 1 {
+        t.Errorf("restored lots %+v, want 60 left with one tier taken", lots)
+    }
+    if len(restored.TransactionLog) != 2 {
+        t.Errorf("restored %d transactions, want 2", len(restored.TransactionLog))
+    }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Exit rules, also used as the reason recorded on the exit
+const (
+    exitStopLoss     = "stop_loss"
+    exitTakeProfit   = "take_profit"
+    exitTrailingStop = "trailing_stop"
+)
+
+// TakeProfitTier sells SellPct of a lot's initial quantity once the price
+// is GainPct above entry
+type TakeProfitTier struct {
+    GainPct float64
+    SellPct float64
+}
+
+// ExitRules close positions on our own terms instead of waiting for the
+// copied wallet to sell. Zero values disable a rule. The trailing stop arms
+// once a lot has gained TrailingActivationPct and then fires when the price
+// falls TrailingStopPct below its peak.
+type ExitRules struct {
+    StopLossPct           float64
+    TakeProfit            []TakeProfitTier // Ascending by GainPct
+    TrailingStopPct       float64
+    TrailingActivationPct float64
+}
+
+// PositionManager watches the price of every open lot and sells it through
+// the execution engine when an exit rule fires. Prices arrive from the
+// polling loop, the wallet stream and Run at once, so each lot is claimed
+// while its exit executes and skipped by the other callers until then.
+type PositionManager struct {
+    Portfolio *Portfolio
+    Engine    *ExecutionEngineModule
+    Rules     ExitRules
+    Quote     func(token string) (decimal.Decimal, error)
+    Interval  time.Duration
+
+    exiting map[int64]bool
+    mutex   sync.Mutex
+}
+
+func NewPositionManager(config Config, portfolio *Portfolio, engine *ExecutionEngineModule, quote func(token string) (decimal.Decimal, error)) *PositionManager {
+    return &PositionManager{
+        Portfolio: portfolio,
+        Engine:    engine,
+        Rules:     config.ExitRules,
+        Quote:     quote,
+        Interval:  config.PositionCheckInterval,
+        exiting:   make(map[int64]bool),
+    }
+}
+
+// Run quotes every held token each Interval until ctx is done. Without a
+// Quote source it returns at once, leaving OnPrice to the callers that
+// observe prices.
+func (pm *PositionManager) Run(ctx context.Context) {
+    if pm.Quote == nil {
+        return
+    }
+    ticker := time.NewTicker(pm.Interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        for token := range pm.Portfolio.GetHoldings() {
+            price, err := pm.Quote(token)
+            if err != nil {
+                log.Println("Error quoting held token:", token, err)
+                continue
+            }
+            pm.OnPrice(ctx, token, price.InexactFloat64())
+        }
+    }
+}
+
+// OnPrice applies a new price of token to its open lots and executes the
+// exits that fire. At most one exit is made per lot and update: a stop-loss
+// before a trailing stop before take-profit.
+func (pm *PositionManager) OnPrice(ctx context.Context, token string, price float64) {
+    if price <= 0 {
+        return
+    }
+    pm.Portfolio.MarkPrice(token, decimal.NewFromFloat(price))
+
+    for _, lot := range pm.Portfolio.GetLots() {
+        if lot.Token != token {
+            continue
+        }
+        pm.checkLot(ctx, lot.ID, token, price)
+    }
+}
+
+// checkLot executes the exit that fires for a lot at price, unless another
+// caller is already exiting it. The lot is read again once claimed, as an
+// exit that just finished may have sold some of it.
+func (pm *PositionManager) checkLot(ctx context.Context, lotID int64, token string, price float64) {
+    if !pm.claim(lotID) {
+        return
+    }
+    defer pm.release(lotID)
+
+    for _, lot := range pm.Portfolio.GetLots() {
+        if lot.ID != lotID {
+            continue
+        }
+        quantity, tiers, reason := pm.evaluate(lot, price)
+        if reason == "" {
+            return
+        }
+
+        signal := TradeSignal{
+            WalletAddress: lot.SourceWallet,
+            Action:        "sell",
+            Token:         token,
+            Quantity:      quantity,
+            Price:         price,
+            LotID:         lot.ID,
+            Reason:        reason,
+            TiersTaken:    tiers,
+        }
+        log.Printf("Exit %s on lot %d of %s at %.9f (entry %s)\n", reason, lot.ID, token, price, lot.EntryPrice.String())
+        if err := pm.Engine.ExecuteTrade(ctx, signal); err != nil {
+            log.Println("Error executing exit:", err)
+        }
+        return
+    }
+}
+
+func (pm *PositionManager) claim(lotID int64) bool {
+    pm.mutex.Lock()
+    defer pm.mutex.Unlock()
+    if pm.exiting[lotID] {
+        return false
+    }
+    pm.exiting[lotID] = true
+    return true
+}
+
+func (pm *PositionManager) release(lotID int64) {
+    pm.mutex.Lock()
+    defer pm.mutex.Unlock()
+    delete(pm.exiting, lotID)
+}
+
+// evaluate returns the quantity to sell, the take-profit tiers taken after
+// the sale and the rule that fired, or an empty rule if none did
+func (pm *PositionManager) evaluate(lot Lot, price float64) (float64, int, string) {
+    entry := lot.EntryPrice.InexactFloat64()
+    peak := lot.PeakPrice.InexactFloat64()
+    remaining := lot.Quantity.InexactFloat64()
+    if entry <= 0 || remaining <= 0 {
+        return 0, lot.TiersTaken, ""
+    }
+    gainPct := (price - entry) / entry * 100
+    rules := pm.Rules
+
+    if rules.StopLossPct > 0 && gainPct <= -rules.StopLossPct {
+        return remaining, lot.TiersTaken, exitStopLoss
+    }
+
+    peakGainPct := (peak - entry) / entry * 100
+    if rules.TrailingStopPct > 0 && peakGainPct >= rules.TrailingActivationPct {
+        if drawdownPct := (peak - price) / peak * 100; drawdownPct >= rules.TrailingStopPct {
+            return remaining, lot.TiersTaken, exitTrailingStop
+        }
+    }
+
+    // Sell every tier crossed since the last update in one exit
+    var sellPct float64
+    tiers := lot.TiersTaken
+    for tiers < len(rules.TakeProfit) && gainPct >= rules.TakeProfit[tiers].GainPct {
+        sellPct += rules.TakeProfit[tiers].SellPct
+        tiers++
+    }
+    if tiers == lot.TiersTaken {
+        return 0, lot.TiersTaken, ""
+    }
+
+    quantity := lot.InitialQuantity.InexactFloat64() * sellPct / 100
+    if quantity >= remaining*fullExitFraction {
+        quantity = remaining
+    }
+    return quantity, tiers, fmt.Sprintf("%s_%d", exitTakeProfit, tiers)
+}
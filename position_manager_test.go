@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// slowExecutor fills every signal in full at its price after a delay,
+// counting the fills
+type slowExecutor struct {
+    delay time.Duration
+    fills int64
+}
+
+func (se *slowExecutor) Execute(ctx context.Context, signal TradeSignal) (Fill, error) {
+    time.Sleep(se.delay)
+    atomic.AddInt64(&se.fills, 1)
+    return Fill{
+        Quantity: decimal.NewFromFloat(signal.Quantity),
+        Price:    decimal.NewFromFloat(signal.Price),
+    }, nil
+}
+
+func TestOnPriceExitsEachLotOnce(t *testing.T) {
+    tests := []struct {
+        name      string
+        price     float64
+        remaining string
+    }{
+        {"stop loss", 0.5, "0"},
+        // The first tier sells half the lot; racing callers must not sell
+        // it again
+        {"take profit tier", 2, "50"},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            portfolio := NewPortfolio(decimal.NewFromInt(1000))
+            if !portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(100), Price: decimal.NewFromInt(1)}) {
+                t.Fatal("buy failed")
+            }
+            executor := &slowExecutor{delay: 20 * time.Millisecond}
+            engine := &ExecutionEngineModule{Executor: executor, Portfolio: portfolio, DB: NewMemoryStore()}
+            config := Config{ExitRules: ExitRules{
+                StopLossPct: 30,
+                TakeProfit:  []TakeProfitTier{{GainPct: 50, SellPct: 50}, {GainPct: 300, SellPct: 50}},
+            }}
+            pm := NewPositionManager(config, portfolio, engine, nil)
+
+            // Run, the wallet stream and the polling loop see the price at once
+            var wg sync.WaitGroup
+            for i := 0; i < 8; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    pm.OnPrice(context.Background(), "token", test.price)
+                }()
+            }
+            wg.Wait()
+            // A later update at the same price finds nothing left to do
+            pm.OnPrice(context.Background(), "token", test.price)
+
+            if fills := atomic.LoadInt64(&executor.fills); fills != 1 {
+                t.Errorf("%d exits executed, want 1", fills)
+            }
+            if held := portfolio.GetHoldings()["token"]; !held.Equal(decimal.RequireFromString(test.remaining)) {
+                t.Errorf("holding %s, want %s", held, test.remaining)
+            }
+        })
+    }
+}
+
+func TestProcessPricesLotsOnlyFromFreshFills(t *testing.T) {
+    tests := []struct {
+        name  string
+        age   time.Duration
+        exits int64
+    }{
+        {"fresh sell", 10 * time.Second, 1},
+        {"hour-old sell", time.Hour, 0},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            portfolio := NewPortfolio(decimal.NewFromInt(1000))
+            if !portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(100), Price: decimal.NewFromInt(1)}) {
+                t.Fatal("buy failed")
+            }
+            executor := &slowExecutor{}
+            engine := &ExecutionEngineModule{Executor: executor, Portfolio: portfolio, DB: NewMemoryStore()}
+            config := Config{MaxSignalAge: time.Minute, ExitRules: ExitRules{StopLossPct: 30}}
+            rpc := newFakeRPC()
+            pipeline := &SignalPipeline{
+                Guard:     NewSignalGuard(config, nil, NewRejectionStats()),
+                Sizer:     NewPositionSizer(config, portfolio),
+                Engine:    engine,
+                Positions: NewPositionManager(config, portfolio, engine, nil),
+                Pools:     NewPoolPriceSource(rpc, NewMintDecimals(rpc)),
+            }
+
+            // Another wallet sells far below our entry; its share sold is
+            // unknown, so only a stop-loss could sell our lot
+            pipeline.Process(context.Background(), TradeSignal{
+                WalletAddress:   "other",
+                Action:          "sell",
+                Token:           "token",
+                Quantity:        5000,
+                Price:           0.5,
+                Signature:       "sig",
+                SourceBlockTime: time.Now().Add(-test.age),
+                SourcePrice:     0.5,
+            })
+
+            if fills := atomic.LoadInt64(&executor.fills); fills != test.exits {
+                t.Errorf("%d exits executed, want %d", fills, test.exits)
+            }
+        })
+    }
+}
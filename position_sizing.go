@@ -0,0 +1,180 @@
+package main
+
+import (
+    "log"
+    "math"
+    "sync"
+)
+
+// SizingMode selects how much SOL a copied buy commits
+type SizingMode string
+
+const (
+    // A fixed amount of SOL per trade
+    SizingFixedSOL SizingMode = "fixed_sol"
+    // A percentage of current portfolio equity per trade
+    SizingPercentEquity SizingMode = "percent_equity"
+    // Percent of equity scaled by how large the source trade is compared to
+    // the source wallet's average position
+    SizingConviction SizingMode = "conviction"
+    // Percent of equity scaled so each position risks about the same SOL
+    // given the token's observed price volatility
+    SizingVolatility SizingMode = "volatility"
+)
+
+// Number of price observations kept per token for volatility sizing
+const volatilityWindow = 50
+
+// A source wallet selling at least this share of its position is treated
+// as a full exit, so we don't keep dust
+const fullExitFraction = 0.99
+
+// PositionSizer decides our quantity for each signal instead of copying the
+// source wallet's quantity, and enforces per-token and per-wallet exposure
+// caps.
+type PositionSizer struct {
+    Config    Config
+    Portfolio *Portfolio
+
+    walletMetrics map[string]WalletMetrics
+    prices        map[string][]float64
+    mutex         sync.Mutex
+}
+
+func NewPositionSizer(config Config, portfolio *Portfolio) *PositionSizer {
+    return &PositionSizer{
+        Config:        config,
+        Portfolio:     portfolio,
+        walletMetrics: make(map[string]WalletMetrics),
+        prices:        make(map[string][]float64),
+    }
+}
+
+// SetWalletMetrics refreshes the metrics of the copied wallets, used for
+// conviction sizing
+func (ps *PositionSizer) SetWalletMetrics(wallets []WalletMetrics) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+    for _, wallet := range wallets {
+        ps.walletMetrics[wallet.WalletAddress] = wallet
+    }
+}
+
+// Size returns the signal with Quantity replaced by our own quantity, or
+// false when the trade should be skipped (caps reached, below the minimum
+// trade size, nothing to sell). Sells mirror the fraction of its position
+// the source wallet sold, applied to our lots from that wallet; a sell whose
+// fraction is unknown is skipped, since the source's quantity says nothing
+// about how much of our differently sized position to sell.
+func (ps *PositionSizer) Size(signal TradeSignal) (TradeSignal, bool) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+
+    if signal.Price <= 0 {
+        return signal, false
+    }
+    ps.observePrice(signal.Token, signal.Price)
+
+    if signal.Action == "sell" {
+        position := ps.Portfolio.SourcePosition(signal.Token, signal.WalletAddress)
+        if !position.IsPositive() {
+            return signal, false
+        }
+        switch {
+        case signal.SourceFraction >= fullExitFraction:
+            signal.Quantity = position.InexactFloat64()
+        case signal.SourceFraction > 0:
+            signal.Quantity = position.InexactFloat64() * signal.SourceFraction
+        default:
+            // Our exit rules still cover the position
+            log.Printf("Skipping sell of %s from %s: source wallet's prior balance unknown\n",
+                signal.Token, signal.WalletAddress)
+            return signal, false
+        }
+        return signal, true
+    }
+
+    price := signal.Price
+    equity := ps.equity()
+    var sizeSOL float64
+
+    switch ps.Config.SizingMode {
+    case SizingPercentEquity:
+        sizeSOL = equity * ps.Config.SizingEquityPct / 100
+    case SizingConviction:
+        sizeSOL = equity * ps.Config.SizingEquityPct / 100
+        if metrics, ok := ps.walletMetrics[signal.WalletAddress]; ok && metrics.AveragePositionSize > 0 {
+            conviction := signal.Quantity * price / metrics.AveragePositionSize
+            sizeSOL *= math.Max(0, math.Min(conviction, ps.Config.SizingMaxConviction))
+        }
+    case SizingVolatility:
+        sizeSOL = equity * ps.Config.SizingEquityPct / 100
+        if volatility := ps.volatility(signal.Token); volatility > 0 {
+            sizeSOL = equity * ps.Config.SizingVolTargetPct / 100 / volatility
+        }
+    default:
+        sizeSOL = ps.Config.SizingFixedSOL
+    }
+
+    // Per-token cap covers everything we hold in the token, whoever it came from
+    holdingSOL := ps.Portfolio.GetHoldings()[signal.Token].InexactFloat64() * price
+    sizeSOL = math.Min(sizeSOL, ps.Config.MaxTokenExposureSOL-holdingSOL)
+
+    // Per-wallet cap covers the cost of everything opened by copying the wallet
+    walletSOL := ps.Portfolio.SourceExposure(signal.WalletAddress).InexactFloat64()
+    sizeSOL = math.Min(sizeSOL, ps.Config.MaxWalletExposureSOL-walletSOL)
+
+    sizeSOL = math.Min(sizeSOL, ps.Portfolio.GetBalance().InexactFloat64())
+    if sizeSOL < ps.Config.MinTradeSOL {
+        log.Printf("Skipping %s of %s from %s: size %.4f SOL below minimum or caps reached\n",
+            signal.Action, signal.Token, signal.WalletAddress, sizeSOL)
+        return signal, false
+    }
+
+    signal.Quantity = sizeSOL / price
+    return signal, true
+}
+
+// equity is the SOL balance plus holdings marked at the last price
+// observed for each token
+func (ps *PositionSizer) equity() float64 {
+    equity := ps.Portfolio.GetBalance().InexactFloat64()
+    for token, quantity := range ps.Portfolio.GetHoldings() {
+        if observed := ps.prices[token]; len(observed) > 0 {
+            equity += quantity.InexactFloat64() * observed[len(observed)-1]
+        }
+    }
+    return equity
+}
+
+func (ps *PositionSizer) observePrice(token string, price float64) {
+    observed := append(ps.prices[token], price)
+    if len(observed) > volatilityWindow {
+        observed = observed[len(observed)-volatilityWindow:]
+    }
+    ps.prices[token] = observed
+}
+
+// volatility is the standard deviation of log returns between successive
+// observed prices of the token, or 0 with too few observations
+func (ps *PositionSizer) volatility(token string) float64 {
+    observed := ps.prices[token]
+    if len(observed) < 5 {
+        return 0
+    }
+
+    returns := make([]float64, 0, len(observed)-1)
+    var mean float64
+    for i := 1; i < len(observed); i++ {
+        r := math.Log(observed[i] / observed[i-1])
+        returns = append(returns, r)
+        mean += r
+    }
+    mean /= float64(len(returns))
+
+    var variance float64
+    for _, r := range returns {
+        variance += (r - mean) * (r - mean)
+    }
+    return math.Sqrt(variance / float64(len(returns)-1))
+}
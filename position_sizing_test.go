@@ -0,0 +1,228 @@
+package main
+
+import (
+    "math"
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestSizeSellMirrorsSourceFraction(t *testing.T) {
+    tests := []struct {
+        name     string
+        fraction float64
+        quantity float64
+        ok       bool
+    }{
+        {"full exit", 0.995, 100, true},
+        {"partial", 0.25, 25, true},
+        {"unknown fraction", 0, 0, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            portfolio := NewPortfolio(decimal.NewFromInt(10))
+            if !portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(100), Price: decimal.NewFromFloat(0.01)}) {
+                t.Fatal("buy failed")
+            }
+
+            sized, ok := NewPositionSizer(Config{}, portfolio).Size(TradeSignal{
+                WalletAddress:  "wallet",
+                Action:         "sell",
+                Token:          "token",
+                Quantity:       5000,
+                Price:          0.02,
+                SourceFraction: test.fraction,
+            })
+            if ok != test.ok || (ok && !approxEqual(sized.Quantity, test.quantity)) {
+                t.Errorf("got %g, %t; want %g, %t", sized.Quantity, ok, test.quantity, test.ok)
+            }
+        })
+    }
+}
+
+// sizingLot is a position held before the signal being sized
+type sizingLot struct {
+    token    string
+    wallet   string
+    quantity float64
+    price    float64
+}
+
+func TestSizeBuy(t *testing.T) {
+    tests := []struct {
+        name     string
+        config   func(*Config)
+        balance  float64
+        lots     []sizingLot
+        metrics  []WalletMetrics
+        prices   []float64 // Observed before the signal
+        quantity float64   // The source wallet's quantity
+        price    float64
+        want     float64
+        ok       bool
+    }{
+        {
+            name:     "fixed SOL",
+            balance:  50,
+            quantity: 1000,
+            price:    0.1,
+            want:     20,
+            ok:       true,
+        },
+        {
+            name:     "percent of equity",
+            config:   func(c *Config) { c.SizingMode = SizingPercentEquity },
+            balance:  50,
+            quantity: 1000,
+            price:    0.1,
+            want:     50,
+            ok:       true,
+        },
+        {
+            name:     "percent of equity marks holdings at the last price",
+            config:   func(c *Config) { c.SizingMode = SizingPercentEquity },
+            balance:  50,
+            lots:     []sizingLot{{"token", "other", 100, 0.1}},
+            quantity: 1000,
+            price:    0.2,
+            want:     30,
+            ok:       true,
+        },
+        {
+            name:     "conviction scales by the source position",
+            config:   func(c *Config) { c.SizingMode = SizingConviction },
+            balance:  50,
+            metrics:  []WalletMetrics{{WalletAddress: "wallet", AveragePositionSize: 1}},
+            quantity: 20,
+            price:    0.1,
+            want:     100,
+            ok:       true,
+        },
+        {
+            name:     "conviction is capped",
+            config:   func(c *Config) { c.SizingMode = SizingConviction },
+            balance:  50,
+            metrics:  []WalletMetrics{{WalletAddress: "wallet", AveragePositionSize: 1}},
+            quantity: 1000,
+            price:    0.1,
+            want:     150,
+            ok:       true,
+        },
+        {
+            name:     "conviction without wallet metrics",
+            config:   func(c *Config) { c.SizingMode = SizingConviction },
+            balance:  50,
+            quantity: 20,
+            price:    0.1,
+            want:     50,
+            ok:       true,
+        },
+        {
+            name:     "volatility targets equal risk",
+            config:   func(c *Config) { c.SizingMode = SizingVolatility },
+            balance:  50,
+            prices:   []float64{0.1, 0.2, 0.1, 0.2},
+            quantity: 1000,
+            price:    0.1,
+            // Log returns of +-ln 2 have a standard deviation of 2 ln 2 / sqrt 3
+            want: 0.5 / (2 * math.Ln2 / math.Sqrt(3)) / 0.1,
+            ok:   true,
+        },
+        {
+            name:     "volatility with too few prices",
+            config:   func(c *Config) { c.SizingMode = SizingVolatility },
+            balance:  50,
+            prices:   []float64{0.1},
+            quantity: 1000,
+            price:    0.1,
+            want:     50,
+            ok:       true,
+        },
+        {
+            name:     "per-token cap counts every wallet's holdings",
+            config:   func(c *Config) { c.MaxTokenExposureSOL = 3 },
+            balance:  50,
+            lots:     []sizingLot{{"token", "other", 20, 0.1}},
+            quantity: 1000,
+            price:    0.1,
+            want:     10,
+            ok:       true,
+        },
+        {
+            name:     "per-wallet cap counts every token",
+            config:   func(c *Config) { c.MaxWalletExposureSOL = 3 },
+            balance:  50,
+            lots:     []sizingLot{{"other", "wallet", 15, 0.1}},
+            quantity: 1000,
+            price:    0.1,
+            want:     15,
+            ok:       true,
+        },
+        {
+            name:     "balance cap",
+            balance:  1,
+            quantity: 1000,
+            price:    0.1,
+            want:     10,
+            ok:       true,
+        },
+        {
+            name:     "caps reached",
+            config:   func(c *Config) { c.MaxTokenExposureSOL = 2 },
+            balance:  50,
+            lots:     []sizingLot{{"token", "other", 20, 0.1}},
+            quantity: 1000,
+            price:    0.1,
+        },
+        {
+            name:     "below the minimum trade size",
+            config:   func(c *Config) { c.SizingFixedSOL = 0.005 },
+            balance:  50,
+            quantity: 1000,
+            price:    0.1,
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            config := Config{
+                SizingMode:           SizingFixedSOL,
+                SizingFixedSOL:       2,
+                SizingEquityPct:      10,
+                SizingMaxConviction:  3,
+                SizingVolTargetPct:   1,
+                MaxTokenExposureSOL:  100,
+                MaxWalletExposureSOL: 100,
+                MinTradeSOL:          0.01,
+            }
+            if test.config != nil {
+                test.config(&config)
+            }
+
+            portfolio := NewPortfolio(decimal.NewFromFloat(test.balance))
+            for _, lot := range test.lots {
+                fill := Fill{Quantity: decimal.NewFromFloat(lot.quantity), Price: decimal.NewFromFloat(lot.price)}
+                if !portfolio.Buy(lot.token, lot.wallet, fill) {
+                    t.Fatal("buy failed")
+                }
+            }
+            sizer := NewPositionSizer(config, portfolio)
+            sizer.SetWalletMetrics(test.metrics)
+            for _, price := range test.prices {
+                sizer.observePrice("token", price)
+            }
+
+            sized, ok := sizer.Size(TradeSignal{
+                WalletAddress: "wallet",
+                Action:        "buy",
+                Token:         "token",
+                Quantity:      test.quantity,
+                Price:         test.price,
+            })
+            if ok != test.ok || (ok && !approxEqual(sized.Quantity, test.want)) {
+                t.Errorf("got %g, %t; want %g, %t", sized.Quantity, ok, test.want, test.ok)
+            }
+        })
+    }
+}
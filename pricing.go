@@ -0,0 +1,340 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+var (
+    errNoPrice    = errors.New("no price available")
+    errStalePrice = errors.New("price is stale")
+)
+
+// PriceQuote is a token price in SOL and when it was observed
+type PriceQuote struct {
+    Price      decimal.Decimal
+    ObservedAt time.Time
+    Source     string
+}
+
+// PriceSource prices tokens in SOL
+type PriceSource interface {
+    Price(ctx context.Context, token string) (PriceQuote, error)
+}
+
+// poolRef is the last pool a token was seen trading on, with the price of
+// that trade
+type poolRef struct {
+    ProgramID  string
+    Pool       string
+    SOLVault   string
+    TokenVault string
+    LastPrice  float64
+    LastSeen   time.Time
+}
+
+// PoolPriceSource prices tokens from the reserves of the pool they last
+// traded on, as observed in copied signals. Constant product pools are
+// priced from their vault balances and Pump.fun bonding curves from their
+// virtual reserves. For other pools, and when the chain can't be read, the
+// last observed trade price is returned with its own timestamp so staleness
+// checks can reject it.
+type PoolPriceSource struct {
+    RPC      SolanaRPC
+    Decimals *MintDecimals
+
+    pools map[string]poolRef
+    mutex sync.Mutex
+}
+
+func NewPoolPriceSource(rpc SolanaRPC, decimals *MintDecimals) *PoolPriceSource {
+    return &PoolPriceSource{
+        RPC:      rpc,
+        Decimals: decimals,
+        pools:    make(map[string]poolRef),
+    }
+}
+
+// Observe records the pool and price of a copied wallet's swap
+func (pps *PoolPriceSource) Observe(signal TradeSignal) {
+    if signal.Pool == "" || signal.SourcePrice <= 0 {
+        return
+    }
+    seen := signal.SourceBlockTime
+    if seen.IsZero() {
+        seen = time.Now()
+    }
+
+    pps.mutex.Lock()
+    defer pps.mutex.Unlock()
+    if previous, ok := pps.pools[signal.Token]; ok && previous.LastSeen.After(seen) {
+        return
+    }
+    pps.pools[signal.Token] = poolRef{
+        ProgramID:  signal.ProgramID,
+        Pool:       signal.Pool,
+        SOLVault:   signal.Reserves.SOLVault,
+        TokenVault: signal.Reserves.TokenVault,
+        LastPrice:  signal.SourcePrice,
+        LastSeen:   seen,
+    }
+}
+
+func (pps *PoolPriceSource) Price(ctx context.Context, token string) (PriceQuote, error) {
+    pps.mutex.Lock()
+    ref, ok := pps.pools[token]
+    pps.mutex.Unlock()
+    if !ok {
+        return PriceQuote{}, errNoPrice
+    }
+
+    reserves, err := pps.reserves(ctx, token, ref)
+    if err == nil {
+        return PriceQuote{Price: decimal.NewFromFloat(reserves.SOL / reserves.Token), ObservedAt: time.Now(), Source: "pool"}, nil
+    }
+    return PriceQuote{Price: decimal.NewFromFloat(ref.LastPrice), ObservedAt: ref.LastSeen, Source: "last_trade"}, nil
+}
+
+// Reserves reads the current reserves of the pool the token last traded on,
+// for pools whose reserves set their price: constant product pools, and
+// Pump.fun bonding curves by their virtual reserves
+func (pps *PoolPriceSource) Reserves(ctx context.Context, token string) (PoolReserves, error) {
+    pps.mutex.Lock()
+    ref, ok := pps.pools[token]
+    pps.mutex.Unlock()
+    if !ok {
+        return PoolReserves{}, errNoPrice
+    }
+    return pps.reserves(ctx, token, ref)
+}
+
+func (pps *PoolPriceSource) reserves(ctx context.Context, token string, ref poolRef) (PoolReserves, error) {
+    reserves := PoolReserves{SOLVault: ref.SOLVault, TokenVault: ref.TokenVault}
+    switch ref.ProgramID {
+    case pumpFunProgramID:
+        sol, tokens, err := pps.bondingCurveReserves(ctx, token, ref.Pool)
+        if err != nil {
+            return PoolReserves{}, err
+        }
+        reserves.SOL, reserves.Token = sol, tokens
+    case raydiumAMMProgramID, raydiumCPMMProgramID:
+        if ref.SOLVault == "" || ref.TokenVault == "" {
+            return PoolReserves{}, errNoPrice
+        }
+        balances, err := pps.RPC.GetTokenAccountBalances(ctx, []string{ref.SOLVault, ref.TokenVault})
+        if err != nil {
+            return PoolReserves{}, err
+        }
+        reserves.SOL, reserves.Token = balances[0], balances[1]
+    default:
+        return PoolReserves{}, errNoPrice
+    }
+    if reserves.SOL <= 0 || reserves.Token <= 0 {
+        return PoolReserves{}, errNoPrice
+    }
+    return reserves, nil
+}
+
+// bondingCurveReserves reads a Pump.fun bonding curve account: an 8-byte
+// discriminator followed by virtual token and virtual SOL reserves as
+// little-endian u64s
+func (pps *PoolPriceSource) bondingCurveReserves(ctx context.Context, token, curve string) (float64, float64, error) {
+    data, err := pps.RPC.GetAccountData(ctx, curve)
+    if err != nil {
+        return 0, 0, err
+    }
+    if len(data) < 24 {
+        return 0, 0, fmt.Errorf("bonding curve %s too short", curve)
+    }
+    virtualTokens := binary.LittleEndian.Uint64(data[8:16])
+    virtualSOL := binary.LittleEndian.Uint64(data[16:24])
+
+    decimals, err := pps.Decimals.Get(ctx, token)
+    if err != nil {
+        return 0, 0, err
+    }
+    return float64(virtualSOL) / lamportsPerSOL, float64(virtualTokens) / math.Pow10(decimals), nil
+}
+
+// MintDecimals caches the decimals of each mint, which never change
+type MintDecimals struct {
+    RPC SolanaRPC
+
+    decimals map[string]int
+    mutex    sync.Mutex
+}
+
+func NewMintDecimals(rpc SolanaRPC) *MintDecimals {
+    return &MintDecimals{RPC: rpc, decimals: make(map[string]int)}
+}
+
+func (md *MintDecimals) Get(ctx context.Context, mint string) (int, error) {
+    md.mutex.Lock()
+    decimals, ok := md.decimals[mint]
+    md.mutex.Unlock()
+    if ok {
+        return decimals, nil
+    }
+
+    account, err := md.RPC.GetMintAccount(ctx, mint)
+    if err != nil {
+        return 0, err
+    }
+    md.mutex.Lock()
+    md.decimals[mint] = account.Decimals
+    md.mutex.Unlock()
+    return account.Decimals, nil
+}
+
+// QuotePriceSource prices a token by asking the Jupiter quote API how many
+// tokens ProbeSOL buys. The price includes the impact of a trade that size.
+type QuotePriceSource struct {
+    APIURL     string
+    ProbeSOL   float64
+    HTTPClient *http.Client
+    Decimals   *MintDecimals
+}
+
+func NewQuotePriceSource(config Config, decimals *MintDecimals) *QuotePriceSource {
+    return &QuotePriceSource{
+        APIURL:     strings.TrimRight(config.JupiterAPIURL, "/"),
+        ProbeSOL:   config.PriceProbeSOL,
+        HTTPClient: &http.Client{Timeout: config.RPCTimeout},
+        Decimals:   decimals,
+    }
+}
+
+func (qps *QuotePriceSource) Price(ctx context.Context, token string) (PriceQuote, error) {
+    decimals, err := qps.Decimals.Get(ctx, token)
+    if err != nil {
+        return PriceQuote{}, err
+    }
+
+    lamports := uint64(qps.ProbeSOL * lamportsPerSOL)
+    query := url.Values{}
+    query.Set("inputMint", wrappedSOLMint)
+    query.Set("outputMint", token)
+    query.Set("amount", strconv.FormatUint(lamports, 10))
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, qps.APIURL+"/quote?"+query.Encode(), nil)
+    if err != nil {
+        return PriceQuote{}, err
+    }
+    resp, err := qps.HTTPClient.Do(req)
+    if err != nil {
+        return PriceQuote{}, err
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return PriceQuote{}, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return PriceQuote{}, fmt.Errorf("quote HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+
+    var quote struct {
+        OutAmount string `json:"outAmount"`
+    }
+    if err := json.Unmarshal(body, &quote); err != nil {
+        return PriceQuote{}, fmt.Errorf("decoding quote: %w", err)
+    }
+    outAmount, err := strconv.ParseFloat(quote.OutAmount, 64)
+    if err != nil || outAmount <= 0 {
+        return PriceQuote{}, errNoPrice
+    }
+    tokens := outAmount / math.Pow10(decimals)
+    return PriceQuote{
+        Price:      decimal.NewFromFloat(qps.ProbeSOL / tokens),
+        ObservedAt: time.Now(),
+        Source:     "quote",
+    }, nil
+}
+
+// FallbackPriceSource asks each source in turn and returns the first quote
+// that is no older than MaxAge
+type FallbackPriceSource struct {
+    Sources []PriceSource
+    MaxAge  time.Duration
+}
+
+func (fps *FallbackPriceSource) Price(ctx context.Context, token string) (PriceQuote, error) {
+    lastErr := errNoPrice
+    for _, source := range fps.Sources {
+        quote, err := source.Price(ctx, token)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        if fps.MaxAge > 0 && time.Since(quote.ObservedAt) > fps.MaxAge {
+            lastErr = fmt.Errorf("%w: %s quote is %s old", errStalePrice, quote.Source, time.Since(quote.ObservedAt).Round(time.Second))
+            continue
+        }
+        return quote, nil
+    }
+    return PriceQuote{}, lastErr
+}
+
+// CachedPriceSource keeps each quote of Source for TTL
+type CachedPriceSource struct {
+    Source PriceSource
+    TTL    time.Duration
+
+    quotes map[string]cachedQuote
+    mutex  sync.Mutex
+}
+
+type cachedQuote struct {
+    quote     PriceQuote
+    fetchedAt time.Time
+}
+
+func NewCachedPriceSource(source PriceSource, ttl time.Duration) *CachedPriceSource {
+    return &CachedPriceSource{
+        Source: source,
+        TTL:    ttl,
+        quotes: make(map[string]cachedQuote),
+    }
+}
+
+func (cps *CachedPriceSource) Price(ctx context.Context, token string) (PriceQuote, error) {
+    cps.mutex.Lock()
+    cached, ok := cps.quotes[token]
+    cps.mutex.Unlock()
+    if ok && time.Since(cached.fetchedAt) < cps.TTL {
+        return cached.quote, nil
+    }
+
+    quote, err := cps.Source.Price(ctx, token)
+    if err != nil {
+        return PriceQuote{}, err
+    }
+    cps.mutex.Lock()
+    cps.quotes[token] = cachedQuote{quote: quote, fetchedAt: time.Now()}
+    cps.mutex.Unlock()
+    return quote, nil
+}
+
+// NewPriceSource builds the default chain: on-chain pool reserves first,
+// then the quote API, cached for PriceCacheTTL and rejected when older than
+// MaxPriceAge
+func NewPriceSource(config Config, pools *PoolPriceSource) PriceSource {
+    chain := &FallbackPriceSource{
+        Sources: []PriceSource{pools, NewQuotePriceSource(config, pools.Decimals)},
+        MaxAge:  config.MaxPriceAge,
+    }
+    return NewCachedPriceSource(chain, config.PriceCacheTTL)
+}
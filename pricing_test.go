@@ -0,0 +1,201 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// fakePriceSource returns the same quote or error for every token, counting
+// the calls
+type fakePriceSource struct {
+    price decimal.Decimal
+    age   time.Duration
+    err   error
+    calls int64
+}
+
+func (f *fakePriceSource) Price(ctx context.Context, token string) (PriceQuote, error) {
+    atomic.AddInt64(&f.calls, 1)
+    if f.err != nil {
+        return PriceQuote{}, f.err
+    }
+    return PriceQuote{Price: f.price, ObservedAt: time.Now().Add(-f.age), Source: "fake"}, nil
+}
+
+func TestCachedPriceSourceKeepsQuotesForTTL(t *testing.T) {
+    source := &fakePriceSource{price: decimal.NewFromInt(2)}
+    cached := NewCachedPriceSource(source, 50*time.Millisecond)
+
+    for i := 0; i < 3; i++ {
+        if quote, err := cached.Price(context.Background(), "token"); err != nil || !quote.Price.Equal(source.price) {
+            t.Fatalf("got %v, %v", quote.Price, err)
+        }
+    }
+    cached.Price(context.Background(), "other")
+    if calls := atomic.LoadInt64(&source.calls); calls != 2 {
+        t.Errorf("%d calls within the TTL, want one per token", calls)
+    }
+
+    time.Sleep(60 * time.Millisecond)
+    cached.Price(context.Background(), "token")
+    if calls := atomic.LoadInt64(&source.calls); calls != 3 {
+        t.Errorf("%d calls, want an expired quote fetched again", calls)
+    }
+
+    // Errors are not cached
+    source.err = errNoPrice
+    time.Sleep(60 * time.Millisecond)
+    for i := 0; i < 2; i++ {
+        if _, err := cached.Price(context.Background(), "token"); err != errNoPrice {
+            t.Fatalf("got %v, want errNoPrice", err)
+        }
+    }
+    if calls := atomic.LoadInt64(&source.calls); calls != 5 {
+        t.Errorf("%d calls, want every failed lookup retried", calls)
+    }
+}
+
+func TestFallbackPriceSourceOrder(t *testing.T) {
+    failing := errors.New("quote API down")
+    fresh := func(price int64) *fakePriceSource { return &fakePriceSource{price: decimal.NewFromInt(price)} }
+    stale := func(price int64) *fakePriceSource {
+        return &fakePriceSource{price: decimal.NewFromInt(price), age: 2 * time.Minute}
+    }
+
+    tests := []struct {
+        name    string
+        sources []*fakePriceSource
+        price   int64
+        err     error
+        calls   []int64
+    }{
+        {"first source wins", []*fakePriceSource{fresh(1), fresh(2)}, 1, nil, []int64{1, 0}},
+        {"failed source skipped", []*fakePriceSource{{err: errNoPrice}, fresh(2)}, 2, nil, []int64{1, 1}},
+        {"stale source skipped", []*fakePriceSource{stale(1), fresh(2)}, 2, nil, []int64{1, 1}},
+        {"all stale", []*fakePriceSource{stale(1), stale(2)}, 0, errStalePrice, []int64{1, 1}},
+        {"all failed", []*fakePriceSource{{err: errNoPrice}, {err: failing}}, 0, failing, []int64{1, 1}},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            chain := &FallbackPriceSource{MaxAge: time.Minute}
+            for _, source := range test.sources {
+                chain.Sources = append(chain.Sources, source)
+            }
+
+            quote, err := chain.Price(context.Background(), "token")
+            if test.err != nil {
+                if !errors.Is(err, test.err) {
+                    t.Fatalf("got %v, want %v", err, test.err)
+                }
+            } else if err != nil || !quote.Price.Equal(decimal.NewFromInt(test.price)) {
+                t.Fatalf("got %v, %v; want %d", quote.Price, err, test.price)
+            }
+            for i, source := range test.sources {
+                if source.calls != test.calls[i] {
+                    t.Errorf("source %d called %d times, want %d", i, source.calls, test.calls[i])
+                }
+            }
+        })
+    }
+}
+
+func TestPoolPriceSourceFallsBackToLastTrade(t *testing.T) {
+    rpc := newFakeRPC()
+    pools := NewPoolPriceSource(rpc, NewMintDecimals(rpc))
+    traded := time.Now().Add(-5 * time.Minute)
+    pools.Observe(TradeSignal{
+        Token:           "token",
+        SourcePrice:     0.002,
+        SourceBlockTime: traded,
+        ProgramID:       raydiumAMMProgramID,
+        Pool:            "pool",
+        Reserves:        PoolReserves{SOLVault: "sol-vault", TokenVault: "token-vault"},
+    })
+    chain := &FallbackPriceSource{Sources: []PriceSource{pools}, MaxAge: time.Minute}
+
+    // The vaults can't be read: the trade price keeps its own time and is
+    // too old to use
+    quote, err := pools.Price(context.Background(), "token")
+    if err != nil || quote.Source != "last_trade" || !quote.ObservedAt.Equal(traded) || !quote.Price.Equal(decimal.NewFromFloat(0.002)) {
+        t.Fatalf("got %+v, %v; want the last trade", quote, err)
+    }
+    if _, err := chain.Price(context.Background(), "token"); !errors.Is(err, errStalePrice) {
+        t.Fatalf("got %v, want a stale price", err)
+    }
+
+    rpc.balances["sol-vault"] = 30
+    rpc.balances["token-vault"] = 10000
+    quote, err = chain.Price(context.Background(), "token")
+    if err != nil || quote.Source != "pool" || !quote.Price.Equal(decimal.NewFromFloat(0.003)) {
+        t.Fatalf("got %+v, %v; want the pool's reserve price", quote, err)
+    }
+}
+
+func TestProcessGuardIgnoresOwnAndRejectedFills(t *testing.T) {
+    rpc := newFakeRPC()
+    pools := NewPoolPriceSource(rpc, NewMintDecimals(rpc))
+    prices := &FallbackPriceSource{Sources: []PriceSource{pools}, MaxAge: time.Minute}
+    quote := func(token string) (decimal.Decimal, error) {
+        quote, err := prices.Price(context.Background(), token)
+        return quote.Price, err
+    }
+    stats := NewRejectionStats()
+    portfolio := NewPortfolio(decimal.NewFromInt(10))
+    if !portfolio.Buy("token", "wallet", Fill{Quantity: decimal.NewFromInt(1000), Price: decimal.NewFromFloat(0.001)}) {
+        t.Fatal("buy failed")
+    }
+    pipeline := &SignalPipeline{
+        Guard:     NewSignalGuard(Config{MaxSignalAge: time.Minute, MaxPriceMovePct: 5}, quote, stats),
+        Positions: NewPositionManager(Config{}, portfolio, nil, nil),
+        Pools:     pools,
+    }
+
+    // Nothing else prices the token, so the guard has no quote. Had the fill
+    // been observed first, it would have been its own quote and passed.
+    pipeline.Process(context.Background(), TradeSignal{
+        WalletAddress:   "wallet",
+        Action:          "buy",
+        Token:           "token",
+        Quantity:        1000,
+        Price:           0.002,
+        SourceBlockTime: time.Now(),
+        SourcePrice:     0.002,
+        ProgramID:       raydiumAMMProgramID,
+        Pool:            "pool",
+    })
+    if rejected := stats.Snapshot()[rejectNoQuote]; rejected != 1 {
+        t.Fatalf("rejections %v, want no quote", stats.Snapshot())
+    }
+
+    // The fill is a price for what comes after
+    if quote, err := pools.Price(context.Background(), "token"); err != nil || quote.Source != "last_trade" {
+        t.Errorf("fill not observed: %+v, %v", quote, err)
+    }
+
+    // A replayed fill from an hour ago is rejected as stale
+    pipeline.Process(context.Background(), TradeSignal{
+        WalletAddress:   "wallet",
+        Action:          "buy",
+        Token:           "token",
+        Quantity:        1000,
+        Price:           0.004,
+        SourceBlockTime: time.Now().Add(-time.Hour),
+        SourcePrice:     0.004,
+    })
+    if rejected := stats.Snapshot()[rejectStaleSignal]; rejected != 1 {
+        t.Fatalf("rejections %v, want a stale signal", stats.Snapshot())
+    }
+
+    // Neither rejected fill is a price for the lot we hold
+    for _, lot := range portfolio.GetLots() {
+        if !lot.PeakPrice.Equal(decimal.NewFromFloat(0.001)) {
+            t.Errorf("lot %d peaked at %s, want its entry price", lot.ID, lot.PeakPrice)
+        }
+    }
+}
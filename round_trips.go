@@ -0,0 +1,125 @@
+package main
+
+import (
+    "sort"
+    "time"
+)
+
+// CostBasisMethod decides which open lots a sell closes
+type CostBasisMethod string
+
+const (
+    CostBasisFIFO    CostBasisMethod = "fifo"
+    CostBasisLIFO    CostBasisMethod = "lifo"
+    CostBasisAverage CostBasisMethod = "average"
+)
+
+// Quantities below this are treated as fully closed
+const lotDust = 1e-9
+
+// OpenLot is a quantity of a token that was bought and not yet sold
+type OpenLot struct {
+    Token     string
+    Quantity  float64
+    CostSOL   float64
+    OpenTime  time.Time
+    Signature string
+}
+
+// ReconstructRoundTrips pairs a wallet's SOL-quoted buy legs with later sell
+// legs of the same mint and returns one closed Trade per matched portion,
+// with realized PnL in SOL, plus the lots still open at the end. Sells of
+// tokens bought before the available history have nothing to match and are
+// ignored; token-to-token legs are skipped.
+func ReconstructRoundTrips(legs []SwapLeg, method CostBasisMethod) ([]Trade, []OpenLot) {
+    ordered := make([]SwapLeg, len(legs))
+    copy(ordered, legs)
+    sort.SliceStable(ordered, func(i, j int) bool {
+        if ordered[i].Slot != ordered[j].Slot {
+            return ordered[i].Slot < ordered[j].Slot
+        }
+        return ordered[i].BlockTime.Before(ordered[j].BlockTime)
+    })
+
+    lots := make(map[string][]OpenLot)
+    var trades []Trade
+
+    for _, leg := range ordered {
+        token := leg.Token()
+        quantity := leg.TokenAmount()
+        if quantity <= 0 {
+            continue
+        }
+
+        switch leg.Side() {
+        case "buy":
+            lot := OpenLot{
+                Token:     token,
+                Quantity:  quantity,
+                CostSOL:   leg.SOLAmount(),
+                OpenTime:  leg.BlockTime,
+                Signature: leg.Signature,
+            }
+            if method == CostBasisAverage && len(lots[token]) > 0 {
+                // Average cost keeps a single pooled lot per token
+                pooled := &lots[token][0]
+                pooled.Quantity += lot.Quantity
+                pooled.CostSOL += lot.CostSOL
+                continue
+            }
+            lots[token] = append(lots[token], lot)
+
+        case "sell":
+            remaining := quantity
+            for remaining > lotDust && len(lots[token]) > 0 {
+                index := 0
+                if method == CostBasisLIFO {
+                    index = len(lots[token]) - 1
+                }
+                lot := &lots[token][index]
+
+                matched := remaining
+                if lot.Quantity < matched {
+                    matched = lot.Quantity
+                }
+                cost := lot.CostSOL * matched / lot.Quantity
+                proceeds := leg.SOLAmount() * matched / quantity
+
+                trade := Trade{
+                    Signature:     leg.Signature,
+                    OpenSignature: lot.Signature,
+                    Slot:          leg.Slot,
+                    OpenTime:      lot.OpenTime,
+                    CloseTime:     leg.BlockTime,
+                    Profit:        proceeds - cost,
+                    PositionSize:  cost,
+                    Action:        "sell",
+                    Token:         token,
+                    Quantity:      matched,
+                    Price:         leg.Price(),
+                }
+                if cost > 0 {
+                    trade.ProfitPct = trade.Profit / cost * 100
+                }
+                trades = append(trades, trade)
+
+                lot.Quantity -= matched
+                lot.CostSOL -= cost
+                remaining -= matched
+                if lot.Quantity <= lotDust {
+                    lots[token] = append(lots[token][:index], lots[token][index+1:]...)
+                }
+            }
+        }
+    }
+
+    var open []OpenLot
+    for _, tokenLots := range lots {
+        open = append(open, tokenLots...)
+    }
+    sort.Slice(open, func(i, j int) bool {
+        return open[i].OpenTime.Before(open[j].OpenTime)
+    })
+
+    return trades, open
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+var roundTripStart = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func buyLeg(signature string, slot uint64, token string, quantity, sol float64) SwapLeg {
+    return SwapLeg{
+        Signature:    signature,
+        Slot:         slot,
+        BlockTime:    roundTripStart.Add(time.Duration(slot) * time.Second),
+        InputMint:    wrappedSOLMint,
+        OutputMint:   token,
+        InputAmount:  sol,
+        OutputAmount: quantity,
+    }
+}
+
+func sellLeg(signature string, slot uint64, token string, quantity, sol float64) SwapLeg {
+    return SwapLeg{
+        Signature:    signature,
+        Slot:         slot,
+        BlockTime:    roundTripStart.Add(time.Duration(slot) * time.Second),
+        InputMint:    token,
+        OutputMint:   wrappedSOLMint,
+        InputAmount:  quantity,
+        OutputAmount: sol,
+    }
+}
+
+// closedPortion is what a test expects of one matched Trade
+type closedPortion struct {
+    open     string
+    quantity float64
+    cost     float64
+    profit   float64
+}
+
+func TestReconstructRoundTrips(t *testing.T) {
+    tests := []struct {
+        name   string
+        method CostBasisMethod
+        legs   []SwapLeg
+        want   []closedPortion
+        open   []float64 // Quantities left open, oldest first
+    }{
+        {
+            name:   "partial sell across lots, FIFO",
+            method: CostBasisFIFO,
+            legs: []SwapLeg{
+                buyLeg("b1", 1, "tok", 100, 1),
+                buyLeg("b2", 2, "tok", 100, 2),
+                sellLeg("s1", 3, "tok", 150, 3),
+            },
+            want: []closedPortion{
+                {open: "b1", quantity: 100, cost: 1, profit: 1},
+                {open: "b2", quantity: 50, cost: 1, profit: 0},
+            },
+            open: []float64{50},
+        },
+        {
+            name:   "LIFO closes the newest lot first",
+            method: CostBasisLIFO,
+            legs: []SwapLeg{
+                buyLeg("b1", 1, "tok", 100, 1),
+                buyLeg("b2", 2, "tok", 100, 2),
+                sellLeg("s1", 3, "tok", 150, 3),
+            },
+            want: []closedPortion{
+                {open: "b2", quantity: 100, cost: 2, profit: 0},
+                {open: "b1", quantity: 50, cost: 0.5, profit: 0.5},
+            },
+            open: []float64{50},
+        },
+        {
+            name:   "average cost pools the buys",
+            method: CostBasisAverage,
+            legs: []SwapLeg{
+                buyLeg("b1", 1, "tok", 100, 1),
+                buyLeg("b2", 2, "tok", 100, 2),
+                sellLeg("s1", 3, "tok", 100, 2),
+            },
+            want: []closedPortion{
+                {open: "b1", quantity: 100, cost: 1.5, profit: 0.5},
+            },
+            open: []float64{100},
+        },
+        {
+            name:   "sell without an earlier buy is ignored",
+            method: CostBasisFIFO,
+            legs: []SwapLeg{
+                sellLeg("s0", 1, "tok", 50, 1),
+                buyLeg("b1", 2, "tok", 100, 1),
+                sellLeg("s1", 3, "other", 10, 1),
+            },
+            open: []float64{100},
+        },
+        {
+            name:   "dust left by a sell closes the lot",
+            method: CostBasisFIFO,
+            legs: []SwapLeg{
+                buyLeg("b1", 1, "tok", 100, 1),
+                sellLeg("s1", 2, "tok", 100-1e-10, 2),
+                sellLeg("s2", 3, "tok", 10, 1),
+            },
+            want: []closedPortion{
+                {open: "b1", quantity: 100 - 1e-10, cost: 1, profit: 1},
+            },
+        },
+        {
+            name:   "token-to-token legs are skipped",
+            method: CostBasisFIFO,
+            legs: []SwapLeg{
+                buyLeg("b1", 1, "tok", 100, 1),
+                {Signature: "x1", Slot: 2, InputMint: "tok", OutputMint: "other", InputAmount: 100, OutputAmount: 5},
+            },
+            open: []float64{100},
+        },
+        {
+            name:   "legs of one transaction keep their order within the slot",
+            method: CostBasisFIFO,
+            legs: []SwapLeg{
+                sellLeg("late", 9, "tok", 50, 1),
+                buyLeg("same", 5, "tok", 100, 1),
+                sellLeg("same", 5, "tok", 50, 2),
+            },
+            want: []closedPortion{
+                {open: "same", quantity: 50, cost: 0.5, profit: 1.5},
+                {open: "same", quantity: 50, cost: 0.5, profit: 0.5},
+            },
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            trades, open := ReconstructRoundTrips(test.legs, test.method)
+            if len(trades) != len(test.want) {
+                t.Fatalf("got %d trades, want %d: %+v", len(trades), len(test.want), trades)
+            }
+            for i, want := range test.want {
+                trade := trades[i]
+                if trade.OpenSignature != want.open || !approxEqual(trade.Quantity, want.quantity) ||
+                    !approxEqual(trade.PositionSize, want.cost) || !approxEqual(trade.Profit, want.profit) {
+                    t.Errorf("trade %d opened by %s: quantity %v cost %v profit %v; want %+v",
+                        i, trade.OpenSignature, trade.Quantity, trade.PositionSize, trade.Profit, want)
+                }
+                if trade.Action != "sell" || trade.CloseTime.Before(trade.OpenTime) {
+                    t.Errorf("trade %d is a %q closed at %s, opened at %s", i, trade.Action, trade.CloseTime, trade.OpenTime)
+                }
+            }
+
+            if len(open) != len(test.open) {
+                t.Fatalf("got %d open lots, want %d: %+v", len(open), len(test.open), open)
+            }
+            for i, quantity := range test.open {
+                if !approxEqual(open[i].Quantity, quantity) {
+                    t.Errorf("open lot %d has %v, want %v", i, open[i].Quantity, quantity)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// SolanaRPC is the part of the Solana JSON-RPC API the bot depends on.
+// RPCClient implements it; tests can substitute a fake.
+type SolanaRPC interface {
+    GetSignaturesForAddress(ctx context.Context, address string, opts SignaturesOptions) ([]SignatureInfo, error)
+    GetTransaction(ctx context.Context, signature string) (*SolanaTransaction, error)
+    // GetTransactions fetches several transactions in one JSON-RPC batch. The
+    // result is aligned with signatures; transactions the node doesn't have
+    // are nil, and any other error for an entry fails the whole call.
+    GetTransactions(ctx context.Context, signatures []string) ([]*SolanaTransaction, error)
+    GetMintAccount(ctx context.Context, mint string) (*MintAccount, error)
+    GetTokenLargestAccounts(ctx context.Context, mint string) ([]TokenAccountBalance, error)
+    // SendTransaction submits a signed, serialized transaction and returns
+    // its signature
+    SendTransaction(ctx context.Context, tx []byte) (string, error)
+    // GetSignatureStatus returns nil while the node has not seen signature
+    GetSignatureStatus(ctx context.Context, signature string) (*SignatureStatus, error)
+    // GetBlockHeight returns the current confirmed block height, against
+    // which a blockhash's last valid block height is compared
+    GetBlockHeight(ctx context.Context) (uint64, error)
+    // GetAccountData returns the raw data of an account
+    GetAccountData(ctx context.Context, address string) ([]byte, error)
+    // GetTokenAccountBalances reads several token accounts in one batch, in
+    // UI units and aligned with accounts
+    GetTokenAccountBalances(ctx context.Context, accounts []string) ([]float64, error)
+}
+
+// SignatureStatus is an entry of a getSignatureStatuses result
+type SignatureStatus struct {
+    Slot               uint64      `json:"slot"`
+    Err                interface{} `json:"err"`
+    ConfirmationStatus string      `json:"confirmationStatus"`
+}
+
+// MintAccount is the parsed state of an SPL token mint. Authorities are
+// empty once revoked; Supply is in UI units.
+type MintAccount struct {
+    MintAuthority   string
+    FreezeAuthority string
+    Supply          float64
+    Decimals        int
+}
+
+// TokenAccountBalance is an entry of a getTokenLargestAccounts result
+type TokenAccountBalance struct {
+    Address string
+    Amount  float64
+}
+
+// SignaturesOptions are the paging options of getSignaturesForAddress.
+// Before and Until are exclusive signature bounds and may be empty.
+type SignaturesOptions struct {
+    Before string
+    Until  string
+    Limit  int
+}
+
+// RPCError is an error object returned by the node in a JSON-RPC response
+type RPCError struct {
+    Code    int             `json:"code"`
+    Message string          `json:"message"`
+    Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+    return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether the node may answer the request if it is sent
+// again: rate limiting, a node behind the cluster, or a block or status not
+// available yet
+func (e *RPCError) Retryable() bool {
+    switch e.Code {
+    case 429, -32004, -32005, -32014:
+        return true
+    }
+    return false
+}
+
+// TransportError means the request never produced a JSON-RPC response:
+// the connection failed or the endpoint answered with a non-200 status.
+type TransportError struct {
+    StatusCode int
+    Err        error
+}
+
+func (e *TransportError) Error() string {
+    if e.StatusCode != 0 {
+        return fmt.Sprintf("RPC transport error: HTTP %d: %v", e.StatusCode, e.Err)
+    }
+    return fmt.Sprintf("RPC transport error: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+    return e.Err
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *TransportError) Retryable() bool {
+    return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+var (
+    errTransactionNotFound = errors.New("transaction not found")
+    errAccountNotFound     = errors.New("account not found")
+)
+
+type rpcRequest struct {
+    JSONRPC string        `json:"jsonrpc"`
+    ID      uint64        `json:"id"`
+    Method  string        `json:"method"`
+    Params  []interface{} `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+    ID     uint64          `json:"id"`
+    Result json.RawMessage `json:"result"`
+    Error  *RPCError       `json:"error"`
+}
+
+// RPCClient is a JSON-RPC client for a pool of Solana nodes with a
+// token-bucket rate limit and exponential backoff on 429 and 5xx.
+type RPCClient struct {
+    Endpoints   *EndpointPool
+    MaxRetries  int
+    BaseBackoff time.Duration
+    MaxBackoff  time.Duration
+    Limiter     *TokenBucket
+    nextID      uint64
+}
+
+func NewRPCClient(config Config, endpoints *EndpointPool) *RPCClient {
+    return &RPCClient{
+        Endpoints:   endpoints,
+        MaxRetries:  config.RPCMaxRetries,
+        BaseBackoff: 250 * time.Millisecond,
+        MaxBackoff:  10 * time.Second,
+        Limiter:     NewTokenBucket(config.RPCRateLimit, config.RPCBurst),
+    }
+}
+
+// Call invokes method and decodes its result into result
+func (c *RPCClient) Call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+    request := c.newRequest(method, params)
+    body, err := c.post(ctx, request)
+    if err != nil {
+        return err
+    }
+
+    var response rpcResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return &TransportError{Err: fmt.Errorf("decoding response: %w", err)}
+    }
+    if response.Error != nil {
+        return response.Error
+    }
+    if result == nil {
+        return nil
+    }
+    return json.Unmarshal(response.Result, result)
+}
+
+// CallBatch sends requests as one JSON-RPC batch and returns the responses
+// in request order.
+func (c *RPCClient) CallBatch(ctx context.Context, requests []rpcRequest) ([]rpcResponse, error) {
+    body, err := c.post(ctx, requests)
+    if err != nil {
+        return nil, err
+    }
+
+    var responses []rpcResponse
+    if err := json.Unmarshal(body, &responses); err != nil {
+        // A node rejecting the whole batch answers with a single error object
+        var single rpcResponse
+        if json.Unmarshal(body, &single) == nil && single.Error != nil {
+            return nil, single.Error
+        }
+        return nil, &TransportError{Err: fmt.Errorf("decoding batch response: %w", err)}
+    }
+
+    byID := make(map[uint64]rpcResponse, len(responses))
+    for _, response := range responses {
+        byID[response.ID] = response
+    }
+    ordered := make([]rpcResponse, len(requests))
+    for i, request := range requests {
+        response, ok := byID[request.ID]
+        if !ok {
+            response = rpcResponse{ID: request.ID, Error: &RPCError{Code: -32603, Message: "missing from batch response"}}
+        }
+        ordered[i] = response
+    }
+    return ordered, nil
+}
+
+func (c *RPCClient) newRequest(method string, params []interface{}) rpcRequest {
+    return rpcRequest{
+        JSONRPC: "2.0",
+        ID:      atomic.AddUint64(&c.nextID, 1),
+        Method:  method,
+        Params:  params,
+    }
+}
+
+// post sends payload through the endpoint pool, retrying retryable
+// transport errors with exponential backoff and jitter once every endpoint
+// has failed. A Retry-After header from the node takes precedence.
+func (c *RPCClient) post(ctx context.Context, payload interface{}) ([]byte, error) {
+    reqBody, err := json.Marshal(payload)
+    if err != nil {
+        return nil, err
+    }
+
+    for attempt := 0; ; attempt++ {
+        if err := c.Limiter.Wait(ctx); err != nil {
+            return nil, err
+        }
+
+        body, retryAfter, err := c.Endpoints.Send(ctx, reqBody)
+        if err == nil {
+            return body, nil
+        }
+
+        transportErr, ok := err.(*TransportError)
+        if !ok || !transportErr.Retryable() || attempt >= c.MaxRetries || ctx.Err() != nil {
+            return nil, err
+        }
+
+        delay := retryAfter
+        if delay == 0 {
+            delay = c.backoff(attempt)
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(delay):
+        }
+    }
+}
+
+// backoff is the delay before retry attempt+1: exponential with jitter,
+// capped at MaxBackoff
+func (c *RPCClient) backoff(attempt int) time.Duration {
+    delay := c.BaseBackoff << uint(attempt)
+    if delay > c.MaxBackoff || delay <= 0 {
+        delay = c.MaxBackoff
+    }
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (c *RPCClient) GetSignaturesForAddress(ctx context.Context, address string, opts SignaturesOptions) ([]SignatureInfo, error) {
+    options := map[string]interface{}{"commitment": "confirmed"}
+    if opts.Limit > 0 {
+        options["limit"] = opts.Limit
+    }
+    if opts.Before != "" {
+        options["before"] = opts.Before
+    }
+    if opts.Until != "" {
+        options["until"] = opts.Until
+    }
+
+    var signatures []SignatureInfo
+    err := c.Call(ctx, "getSignaturesForAddress", []interface{}{address, options}, &signatures)
+    return signatures, err
+}
+
+// jsonParsed gives us account keys and token balances with owners resolved
+func transactionParams(signature string) []interface{} {
+    return []interface{}{signature, map[string]interface{}{
+        "encoding":                       "jsonParsed",
+        "commitment":                     "confirmed",
+        "maxSupportedTransactionVersion": 0,
+    }}
+}
+
+func (c *RPCClient) GetTransaction(ctx context.Context, signature string) (*SolanaTransaction, error) {
+    var tx *SolanaTransaction
+    if err := c.Call(ctx, "getTransaction", transactionParams(signature), &tx); err != nil {
+        return nil, err
+    }
+    if tx == nil {
+        return nil, errTransactionNotFound
+    }
+    return tx, nil
+}
+
+// GetTransactions retries the entries of the batch that failed with a
+// retryable RPC error, in a smaller batch each time, and fails if any entry
+// still has an error. Only a null result is returned as nil.
+func (c *RPCClient) GetTransactions(ctx context.Context, signatures []string) ([]*SolanaTransaction, error) {
+    if len(signatures) == 0 {
+        return nil, nil
+    }
+
+    txs := make([]*SolanaTransaction, len(signatures))
+    pending := make([]int, len(signatures))
+    for i := range signatures {
+        pending[i] = i
+    }
+
+    for attempt := 0; ; attempt++ {
+        requests := make([]rpcRequest, len(pending))
+        for i, index := range pending {
+            requests[i] = c.newRequest("getTransaction", transactionParams(signatures[index]))
+        }
+
+        responses, err := c.CallBatch(ctx, requests)
+        if err != nil {
+            return nil, err
+        }
+
+        var retry []int
+        var lastErr error
+        for i, response := range responses {
+            index := pending[i]
+            if response.Error != nil {
+                if !response.Error.Retryable() {
+                    return nil, fmt.Errorf("transaction %s: %w", signatures[index], response.Error)
+                }
+                retry = append(retry, index)
+                lastErr = fmt.Errorf("transaction %s: %w", signatures[index], response.Error)
+                continue
+            }
+            if len(response.Result) == 0 {
+                continue
+            }
+            var tx *SolanaTransaction
+            if err := json.Unmarshal(response.Result, &tx); err != nil {
+                return nil, fmt.Errorf("decoding transaction %s: %w", signatures[index], err)
+            }
+            txs[index] = tx
+        }
+
+        if len(retry) == 0 {
+            return txs, nil
+        }
+        if attempt >= c.MaxRetries {
+            return nil, lastErr
+        }
+        pending = retry
+
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(c.backoff(attempt)):
+        }
+    }
+}
+
+// GetMintAccount reads a mint with getAccountInfo in jsonParsed encoding
+func (c *RPCClient) GetMintAccount(ctx context.Context, mint string) (*MintAccount, error) {
+    var result struct {
+        Value *struct {
+            Data struct {
+                Parsed struct {
+                    Type string `json:"type"`
+                    Info struct {
+                        MintAuthority   *string `json:"mintAuthority"`
+                        FreezeAuthority *string `json:"freezeAuthority"`
+                        Supply          string  `json:"supply"`
+                        Decimals        int     `json:"decimals"`
+                    } `json:"info"`
+                } `json:"parsed"`
+            } `json:"data"`
+        } `json:"value"`
+    }
+    params := []interface{}{mint, map[string]interface{}{"encoding": "jsonParsed", "commitment": "confirmed"}}
+    if err := c.Call(ctx, "getAccountInfo", params, &result); err != nil {
+        return nil, err
+    }
+    if result.Value == nil {
+        return nil, errAccountNotFound
+    }
+
+    parsed := result.Value.Data.Parsed
+    if parsed.Type != "mint" {
+        return nil, fmt.Errorf("account %s is not a token mint", mint)
+    }
+    supply, err := strconv.ParseFloat(parsed.Info.Supply, 64)
+    if err != nil {
+        return nil, fmt.Errorf("decoding supply of %s: %w", mint, err)
+    }
+
+    account := &MintAccount{
+        Supply:   supply / math.Pow10(parsed.Info.Decimals),
+        Decimals: parsed.Info.Decimals,
+    }
+    if parsed.Info.MintAuthority != nil {
+        account.MintAuthority = *parsed.Info.MintAuthority
+    }
+    if parsed.Info.FreezeAuthority != nil {
+        account.FreezeAuthority = *parsed.Info.FreezeAuthority
+    }
+    return account, nil
+}
+
+// GetTokenLargestAccounts returns the 20 largest token accounts of a mint,
+// largest first
+func (c *RPCClient) GetTokenLargestAccounts(ctx context.Context, mint string) ([]TokenAccountBalance, error) {
+    var result struct {
+        Value []struct {
+            Address        string `json:"address"`
+            UIAmountString string `json:"uiAmountString"`
+        } `json:"value"`
+    }
+    params := []interface{}{mint, map[string]interface{}{"commitment": "confirmed"}}
+    if err := c.Call(ctx, "getTokenLargestAccounts", params, &result); err != nil {
+        return nil, err
+    }
+
+    accounts := make([]TokenAccountBalance, 0, len(result.Value))
+    for _, entry := range result.Value {
+        amount, err := strconv.ParseFloat(entry.UIAmountString, 64)
+        if err != nil {
+            return nil, fmt.Errorf("decoding balance of %s: %w", entry.Address, err)
+        }
+        accounts = append(accounts, TokenAccountBalance{Address: entry.Address, Amount: amount})
+    }
+    return accounts, nil
+}
+
+func (c *RPCClient) SendTransaction(ctx context.Context, tx []byte) (string, error) {
+    params := []interface{}{base64.StdEncoding.EncodeToString(tx), map[string]interface{}{
+        "encoding":            "base64",
+        "preflightCommitment": "confirmed",
+    }}
+
+    var signature string
+    err := c.Call(ctx, "sendTransaction", params, &signature)
+    return signature, err
+}
+
+func (c *RPCClient) GetSignatureStatus(ctx context.Context, signature string) (*SignatureStatus, error) {
+    var result struct {
+        Value []*SignatureStatus `json:"value"`
+    }
+    if err := c.Call(ctx, "getSignatureStatuses", []interface{}{[]string{signature}}, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Value) == 0 {
+        return nil, nil
+    }
+    return result.Value[0], nil
+}
+
+func (c *RPCClient) GetBlockHeight(ctx context.Context) (uint64, error) {
+    var height uint64
+    params := []interface{}{map[string]interface{}{"commitment": "confirmed"}}
+    if err := c.Call(ctx, "getBlockHeight", params, &height); err != nil {
+        return 0, err
+    }
+    return height, nil
+}
+
+func (c *RPCClient) GetAccountData(ctx context.Context, address string) ([]byte, error) {
+    var result struct {
+        Value *struct {
+            Data []string `json:"data"`
+        } `json:"value"`
+    }
+    params := []interface{}{address, map[string]interface{}{"encoding": "base64", "commitment": "confirmed"}}
+    if err := c.Call(ctx, "getAccountInfo", params, &result); err != nil {
+        return nil, err
+    }
+    if result.Value == nil || len(result.Value.Data) == 0 {
+        return nil, errAccountNotFound
+    }
+    return base64.StdEncoding.DecodeString(result.Value.Data[0])
+}
+
+func (c *RPCClient) GetTokenAccountBalances(ctx context.Context, accounts []string) ([]float64, error) {
+    requests := make([]rpcRequest, len(accounts))
+    for i, account := range accounts {
+        requests[i] = c.newRequest("getTokenAccountBalance", []interface{}{account, map[string]interface{}{"commitment": "confirmed"}})
+    }
+
+    responses, err := c.CallBatch(ctx, requests)
+    if err != nil {
+        return nil, err
+    }
+
+    balances := make([]float64, len(responses))
+    for i, response := range responses {
+        if response.Error != nil {
+            return nil, fmt.Errorf("balance of %s: %w", accounts[i], response.Error)
+        }
+        var result struct {
+            Value struct {
+                UIAmountString string `json:"uiAmountString"`
+            } `json:"value"`
+        }
+        if err := json.Unmarshal(response.Result, &result); err != nil {
+            return nil, fmt.Errorf("decoding balance of %s: %w", accounts[i], err)
+        }
+        balances[i], err = strconv.ParseFloat(result.Value.UIAmountString, 64)
+        if err != nil {
+            return nil, fmt.Errorf("decoding balance of %s: %w", accounts[i], err)
+        }
+    }
+    return balances, nil
+}
+
+// TokenBucket is a rate limiter allowing rate requests per second on
+// average with bursts of up to burst requests. A zero rate disables it.
+type TokenBucket struct {
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+    mutex  sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+    if burst < 1 {
+        burst = 1
+    }
+    return &TokenBucket{
+        rate:   rate,
+        burst:  float64(burst),
+        tokens: float64(burst),
+        last:   time.Now(),
+    }
+}
+
+// Wait blocks until a token is available or ctx is done
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+    if tb == nil || tb.rate <= 0 {
+        return nil
+    }
+
+    for {
+        tb.mutex.Lock()
+        now := time.Now()
+        tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+        if tb.tokens > tb.burst {
+            tb.tokens = tb.burst
+        }
+        tb.last = now
+
+        if tb.tokens >= 1 {
+            tb.tokens--
+            tb.mutex.Unlock()
+            return nil
+        }
+        wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+        tb.mutex.Unlock()
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(wait):
+        }
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+type rpcTestRequest struct {
+    ID     uint64            `json:"id"`
+    Method string            `json:"method"`
+    Params []json.RawMessage `json:"params"`
+}
+
+// rpcHandler answers one JSON-RPC call with a result or an error
+type rpcHandler func(method string, params []json.RawMessage) (interface{}, *RPCError)
+
+// newRPCServer serves single and batched JSON-RPC requests with handle
+func newRPCServer(t *testing.T, handle rpcHandler) *httptest.Server {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        var batch []rpcTestRequest
+        single := false
+        if json.Unmarshal(body, &batch) != nil {
+            var request rpcTestRequest
+            if err := json.Unmarshal(body, &request); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            batch, single = []rpcTestRequest{request}, true
+        }
+
+        responses := make([]map[string]interface{}, len(batch))
+        for i, request := range batch {
+            response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+            result, rpcErr := handle(request.Method, request.Params)
+            if rpcErr != nil {
+                response["error"] = rpcErr
+            } else {
+                response["result"] = result
+            }
+            responses[i] = response
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if single {
+            json.NewEncoder(w).Encode(responses[0])
+            return
+        }
+        json.NewEncoder(w).Encode(responses)
+    }))
+    t.Cleanup(server.Close)
+    return server
+}
+
+// newTestRPCClient returns a client for urls with equal weights, no hedging
+// and millisecond backoff
+func newTestRPCClient(urls ...string) *RPCClient {
+    config := Config{RPCTimeout: 5 * time.Second, RPCMaxRetries: 3}
+    for _, url := range urls {
+        config.RPCEndpoints = append(config.RPCEndpoints, RPCEndpointConfig{URL: url, Weight: 1})
+    }
+    client := NewRPCClient(config, NewEndpointPool(config))
+    client.BaseBackoff = time.Millisecond
+    client.MaxBackoff = 5 * time.Millisecond
+    return client
+}
+
+func signatureParam(t *testing.T, params []json.RawMessage) string {
+    t.Helper()
+    var signature string
+    if len(params) == 0 || json.Unmarshal(params[0], &signature) != nil {
+        t.Fatalf("getTransaction without a signature: %s", params)
+    }
+    return signature
+}
+
+func TestGetTransactionsRetriesRateLimitedEntries(t *testing.T) {
+    var mutex sync.Mutex
+    attempts := make(map[string]int)
+    server := newRPCServer(t, func(method string, params []json.RawMessage) (interface{}, *RPCError) {
+        signature := signatureParam(t, params)
+        mutex.Lock()
+        attempts[signature]++
+        attempt := attempts[signature]
+        mutex.Unlock()
+
+        switch signature {
+        case "missing":
+            return nil, nil
+        case "throttled":
+            if attempt < 3 {
+                return nil, &RPCError{Code: -32005, Message: "Node is behind"}
+            }
+        }
+        return map[string]interface{}{"slot": 42, "meta": map[string]interface{}{"err": nil}}, nil
+    })
+
+    txs, err := newTestRPCClient(server.URL).GetTransactions(context.Background(), []string{"landed", "missing", "throttled"})
+    if err != nil {
+        t.Fatalf("GetTransactions: %v", err)
+    }
+    if len(txs) != 3 || txs[0] == nil || txs[1] != nil || txs[2] == nil {
+        t.Fatalf("got %v, want a transaction, nil and a transaction", txs)
+    }
+    if txs[2].Slot != 42 {
+        t.Errorf("retried transaction has slot %d", txs[2].Slot)
+    }
+    if attempts["landed"] != 1 || attempts["missing"] != 1 || attempts["throttled"] != 3 {
+        t.Errorf("attempts %v, want only the throttled entry retried", attempts)
+    }
+}
+
+func TestGetTransactionsFailsOnEntryError(t *testing.T) {
+    tests := []struct {
+        name string
+        err  *RPCError
+    }{
+        {"non-retryable", &RPCError{Code: -32602, Message: "Invalid param: WrongSize"}},
+        {"retries exhausted", &RPCError{Code: 429, Message: "Too many requests"}},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            server := newRPCServer(t, func(method string, params []json.RawMessage) (interface{}, *RPCError) {
+                if signatureParam(t, params) == "bad" {
+                    return nil, test.err
+                }
+                return map[string]interface{}{"slot": 1}, nil
+            })
+
+            txs, err := newTestRPCClient(server.URL).GetTransactions(context.Background(), []string{"good", "bad"})
+            var rpcErr *RPCError
+            if !errors.As(err, &rpcErr) || rpcErr.Code != test.err.Code {
+                t.Fatalf("got %v, %v; want RPC error %d", txs, err, test.err.Code)
+            }
+        })
+    }
+}
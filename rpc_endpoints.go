@@ -0,0 +1,369 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// RPCEndpointConfig is one entry of SOLANA_RPC_URLS
+type RPCEndpointConfig struct {
+    URL    string
+    Weight int
+}
+
+// RPCEndpoint is a node in the pool together with its health and counters.
+// Label names it in logs and stats, since the URL may carry an API key.
+type RPCEndpoint struct {
+    URL    string
+    Label  string
+    Weight int
+
+    healthy     bool
+    slot        uint64
+    slotLag     uint64
+    lastChecked time.Time
+    lastError   string
+    requests    uint64
+    errors      uint64
+    latencyEWMA time.Duration
+    mutex       sync.Mutex
+}
+
+// EndpointStats is a snapshot of an endpoint for monitoring
+type EndpointStats struct {
+    Endpoint     string    `json:"endpoint"`
+    Weight       int       `json:"weight"`
+    Healthy      bool      `json:"healthy"`
+    SlotLag      uint64    `json:"slot_lag"`
+    Requests     uint64    `json:"requests"`
+    Errors       uint64    `json:"errors"`
+    AvgLatencyMs float64   `json:"avg_latency_ms"`
+    LastError    string    `json:"last_error,omitempty"`
+    LastChecked  time.Time `json:"last_checked"`
+}
+
+// Weight given to the newest sample in the latency moving average
+const latencyEWMAAlpha = 0.2
+
+func (ep *RPCEndpoint) record(latency time.Duration, err error) {
+    ep.mutex.Lock()
+    defer ep.mutex.Unlock()
+    ep.requests++
+    if err != nil {
+        ep.errors++
+        ep.lastError = err.Error()
+    }
+    if ep.latencyEWMA == 0 {
+        ep.latencyEWMA = latency
+    } else {
+        ep.latencyEWMA = time.Duration(latencyEWMAAlpha*float64(latency) + (1-latencyEWMAAlpha)*float64(ep.latencyEWMA))
+    }
+}
+
+func (ep *RPCEndpoint) isHealthy() bool {
+    ep.mutex.Lock()
+    defer ep.mutex.Unlock()
+    return ep.healthy
+}
+
+// EndpointPool spreads requests over several RPC endpoints by weight,
+// skipping endpoints that fail health checks or lag behind the best slot.
+// A request that fails at the transport level fails over to the next
+// endpoint, and one that is slower than HedgeDelay is raced against a
+// second endpoint.
+type EndpointPool struct {
+    Endpoints      []*RPCEndpoint
+    HTTPClient     *http.Client
+    HedgeDelay     time.Duration
+    HealthInterval time.Duration
+    MaxSlotLag     uint64
+}
+
+func NewEndpointPool(config Config) *EndpointPool {
+    pool := &EndpointPool{
+        HTTPClient:     &http.Client{Timeout: config.RPCTimeout},
+        HedgeDelay:     config.RPCHedgeDelay,
+        HealthInterval: config.RPCHealthInterval,
+        MaxSlotLag:     config.RPCMaxSlotLag,
+    }
+    labels := make(map[string]int)
+    for _, endpoint := range config.RPCEndpoints {
+        label := endpointLabel(endpoint.URL)
+        labels[label]++
+        if labels[label] > 1 {
+            label = fmt.Sprintf("%s #%d", label, labels[label])
+        }
+        pool.Endpoints = append(pool.Endpoints, &RPCEndpoint{
+            URL:     endpoint.URL,
+            Label:   label,
+            Weight:  endpoint.Weight,
+            healthy: true,
+        })
+    }
+    return pool
+}
+
+// endpointLabel reduces an endpoint URL to its scheme and host. Providers
+// put API keys in the query string or the path, so neither is shown.
+func endpointLabel(rawURL string) string {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Host == "" {
+        return "invalid endpoint URL"
+    }
+    return u.Scheme + "://" + u.Host
+}
+
+// StartHealthChecks checks every endpoint now and then every HealthInterval
+func (p *EndpointPool) StartHealthChecks() {
+    go func() {
+        for {
+            p.CheckHealth(context.Background())
+            time.Sleep(p.HealthInterval)
+        }
+    }()
+}
+
+// CheckHealth calls getHealth and getSlot on every endpoint. An endpoint is
+// healthy when both succeed and its slot is within MaxSlotLag of the
+// highest slot reported by any endpoint.
+func (p *EndpointPool) CheckHealth(ctx context.Context) {
+    var wg sync.WaitGroup
+    for _, ep := range p.Endpoints {
+        wg.Add(1)
+        go func(ep *RPCEndpoint) {
+            defer wg.Done()
+
+            var health string
+            err := p.call(ctx, ep, "getHealth", &health)
+            var slot uint64
+            if err == nil {
+                err = p.call(ctx, ep, "getSlot", &slot)
+            }
+
+            ep.mutex.Lock()
+            defer ep.mutex.Unlock()
+            ep.lastChecked = time.Now()
+            ep.healthy = err == nil
+            if err != nil {
+                ep.lastError = err.Error()
+                return
+            }
+            ep.slot = slot
+        }(ep)
+    }
+    wg.Wait()
+
+    var maxSlot uint64
+    for _, ep := range p.Endpoints {
+        ep.mutex.Lock()
+        if ep.healthy && ep.slot > maxSlot {
+            maxSlot = ep.slot
+        }
+        ep.mutex.Unlock()
+    }
+    for _, ep := range p.Endpoints {
+        ep.mutex.Lock()
+        if ep.healthy {
+            ep.slotLag = maxSlot - ep.slot
+            if p.MaxSlotLag > 0 && ep.slotLag > p.MaxSlotLag {
+                ep.healthy = false
+                log.Printf("RPC endpoint %s is %d slots behind, marking unhealthy\n", ep.Label, ep.slotLag)
+            }
+        }
+        ep.mutex.Unlock()
+    }
+}
+
+// call makes a single parameterless health-check request to ep
+func (p *EndpointPool) call(ctx context.Context, ep *RPCEndpoint, method string, result interface{}) error {
+    reqBody, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: 1, Method: method})
+    if err != nil {
+        return err
+    }
+    body, _, err := p.sendTo(ctx, ep, reqBody)
+    if err != nil {
+        return err
+    }
+
+    var response rpcResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return err
+    }
+    if response.Error != nil {
+        return response.Error
+    }
+    return json.Unmarshal(response.Result, result)
+}
+
+// candidates orders the healthy endpoints by weighted random choice,
+// followed by the unhealthy ones as a last resort
+func (p *EndpointPool) candidates() []*RPCEndpoint {
+    var healthy, unhealthy []*RPCEndpoint
+    totalWeight := 0
+    for _, ep := range p.Endpoints {
+        if ep.isHealthy() {
+            healthy = append(healthy, ep)
+            totalWeight += ep.Weight
+        } else {
+            unhealthy = append(unhealthy, ep)
+        }
+    }
+
+    ordered := make([]*RPCEndpoint, 0, len(p.Endpoints))
+    for len(healthy) > 0 {
+        index := 0
+        if totalWeight > 0 {
+            pick := rand.Intn(totalWeight)
+            for i, ep := range healthy {
+                pick -= ep.Weight
+                if pick < 0 {
+                    index = i
+                    break
+                }
+            }
+        }
+        totalWeight -= healthy[index].Weight
+        ordered = append(ordered, healthy[index])
+        healthy = append(healthy[:index], healthy[index+1:]...)
+    }
+    return append(ordered, unhealthy...)
+}
+
+type sendResult struct {
+    body       []byte
+    retryAfter time.Duration
+    err        error
+}
+
+// Send posts reqBody to the pool. It starts on the first candidate, fails
+// over to the next one on a retryable transport error, and after HedgeDelay
+// without an answer sends a hedged copy to the next candidate. The first
+// successful response wins and the others are cancelled.
+func (p *EndpointPool) Send(ctx context.Context, reqBody []byte) ([]byte, time.Duration, error) {
+    candidates := p.candidates()
+    if len(candidates) == 0 {
+        return nil, 0, &TransportError{Err: errors.New("no RPC endpoints configured")}
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    results := make(chan sendResult, len(candidates))
+    next, inflight := 0, 0
+    launch := func() {
+        ep := candidates[next]
+        next++
+        inflight++
+        go func() {
+            body, retryAfter, err := p.sendTo(ctx, ep, reqBody)
+            results <- sendResult{body: body, retryAfter: retryAfter, err: err}
+        }()
+    }
+    launch()
+
+    var hedge <-chan time.Time
+    if p.HedgeDelay > 0 && len(candidates) > 1 {
+        timer := time.NewTimer(p.HedgeDelay)
+        defer timer.Stop()
+        hedge = timer.C
+    }
+
+    var last sendResult
+    for inflight > 0 {
+        select {
+        case result := <-results:
+            inflight--
+            if result.err == nil {
+                return result.body, 0, nil
+            }
+            last = result
+            if transportErr, ok := result.err.(*TransportError); !ok || !transportErr.Retryable() {
+                return nil, result.retryAfter, result.err
+            }
+            if next < len(candidates) {
+                launch()
+            }
+        case <-hedge:
+            hedge = nil
+            if next < len(candidates) {
+                launch()
+            }
+        }
+    }
+    return nil, last.retryAfter, last.err
+}
+
+func (p *EndpointPool) sendTo(ctx context.Context, ep *RPCEndpoint, reqBody []byte) ([]byte, time.Duration, error) {
+    start := time.Now()
+    body, retryAfter, err := p.post(ctx, ep.URL, reqBody)
+    // A hedged request cancelled because another endpoint won is not an error
+    if ctx.Err() == nil {
+        ep.record(time.Since(start), err)
+    }
+    return body, retryAfter, err
+}
+
+func (p *EndpointPool) post(ctx context.Context, endpointURL string, reqBody []byte) ([]byte, time.Duration, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, bytes.NewReader(reqBody))
+    if err != nil {
+        return nil, 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := p.HTTPClient.Do(req)
+    if err != nil {
+        // The client's errors quote the full URL
+        if urlErr, ok := err.(*url.Error); ok {
+            urlErr.URL = endpointLabel(urlErr.URL)
+        }
+        return nil, 0, &TransportError{Err: err}
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, 0, &TransportError{Err: err}
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        var retryAfter time.Duration
+        if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+            retryAfter = time.Duration(seconds) * time.Second
+        }
+        return nil, retryAfter, &TransportError{StatusCode: resp.StatusCode, Err: errors.New(string(bytes.TrimSpace(body)))}
+    }
+
+    return body, 0, nil
+}
+
+// Stats returns a snapshot of every endpoint's health and counters
+func (p *EndpointPool) Stats() []EndpointStats {
+    stats := make([]EndpointStats, 0, len(p.Endpoints))
+    for _, ep := range p.Endpoints {
+        ep.mutex.Lock()
+        stats = append(stats, EndpointStats{
+            Endpoint:     ep.Label,
+            Weight:       ep.Weight,
+            Healthy:      ep.healthy,
+            SlotLag:      ep.slotLag,
+            Requests:     ep.requests,
+            Errors:       ep.errors,
+            AvgLatencyMs: float64(ep.latencyEWMA) / float64(time.Millisecond),
+            LastError:    ep.lastError,
+            LastChecked:  ep.lastChecked,
+        })
+        ep.mutex.Unlock()
+    }
+    return stats
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// newNodeServer simulates a node at slot that answers getHealth with
+// healthErr and every other call with result
+func newNodeServer(t *testing.T, slot uint64, healthErr *RPCError) *httptest.Server {
+    return newRPCServer(t, func(method string, params []json.RawMessage) (interface{}, *RPCError) {
+        switch method {
+        case "getHealth":
+            if healthErr != nil {
+                return nil, healthErr
+            }
+            return "ok", nil
+        case "getSlot":
+            return slot, nil
+        }
+        return "result", nil
+    })
+}
+
+func newTestEndpointPool(hedgeDelay time.Duration, endpoints ...RPCEndpointConfig) *EndpointPool {
+    return NewEndpointPool(Config{
+        RPCEndpoints:  endpoints,
+        RPCTimeout:    2 * time.Second,
+        RPCHedgeDelay: hedgeDelay,
+        RPCMaxSlotLag: 50,
+    })
+}
+
+func sendTestRequest(t *testing.T, pool *EndpointPool) (string, error) {
+    t.Helper()
+    body, _, err := pool.Send(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"getBalance"}`))
+    if err != nil {
+        return "", err
+    }
+    var response rpcResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        t.Fatal(err)
+    }
+    var result string
+    json.Unmarshal(response.Result, &result)
+    return result, nil
+}
+
+func TestCheckHealthMarksLaggingAndFailingEndpoints(t *testing.T) {
+    synced := newNodeServer(t, 1000, nil)
+    behind := newNodeServer(t, 980, nil)
+    lagging := newNodeServer(t, 900, nil)
+    failing := newNodeServer(t, 1000, &RPCError{Code: -32005, Message: "Node is unhealthy"})
+
+    pool := newTestEndpointPool(0,
+        RPCEndpointConfig{URL: synced.URL, Weight: 1},
+        RPCEndpointConfig{URL: behind.URL, Weight: 1},
+        RPCEndpointConfig{URL: lagging.URL, Weight: 1},
+        RPCEndpointConfig{URL: failing.URL, Weight: 1},
+    )
+    pool.CheckHealth(context.Background())
+
+    want := []struct {
+        healthy bool
+        slotLag uint64
+    }{{true, 0}, {true, 20}, {false, 100}, {false, 0}}
+    for i, stats := range pool.Stats() {
+        if stats.Healthy != want[i].healthy || stats.SlotLag != want[i].slotLag {
+            t.Errorf("endpoint %d: healthy %t lag %d, want %t lag %d", i, stats.Healthy, stats.SlotLag, want[i].healthy, want[i].slotLag)
+        }
+    }
+    if !strings.Contains(pool.Stats()[3].LastError, "-32005") {
+        t.Errorf("failing endpoint's last error is %q", pool.Stats()[3].LastError)
+    }
+
+    // Unhealthy endpoints are only tried after the healthy ones
+    for i := 0; i < 20; i++ {
+        candidates := pool.candidates()
+        if !candidates[0].isHealthy() || !candidates[1].isHealthy() || candidates[2].isHealthy() || candidates[3].isHealthy() {
+            t.Fatal("unhealthy endpoint ordered before a healthy one")
+        }
+    }
+}
+
+func TestSendFailsOverOnTransportError(t *testing.T) {
+    throttled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "rate limited", http.StatusTooManyRequests)
+    }))
+    defer throttled.Close()
+    healthy := newNodeServer(t, 1000, nil)
+
+    // A zero weight always orders the healthy node second
+    pool := newTestEndpointPool(0,
+        RPCEndpointConfig{URL: throttled.URL, Weight: 1},
+        RPCEndpointConfig{URL: healthy.URL, Weight: 0},
+    )
+
+    for i := 0; i < 3; i++ {
+        result, err := sendTestRequest(t, pool)
+        if err != nil || result != "result" {
+            t.Fatalf("Send: %q, %v", result, err)
+        }
+    }
+    stats := pool.Stats()
+    if stats[0].Requests != 3 || stats[0].Errors != 3 {
+        t.Errorf("throttled endpoint: %d requests, %d errors", stats[0].Requests, stats[0].Errors)
+    }
+    if stats[1].Requests != 3 || stats[1].Errors != 0 {
+        t.Errorf("healthy endpoint: %d requests, %d errors", stats[1].Requests, stats[1].Errors)
+    }
+}
+
+func TestSendHedgesSlowEndpoint(t *testing.T) {
+    slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-r.Context().Done():
+        case <-time.After(300 * time.Millisecond):
+        }
+        w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"slow"}`))
+    }))
+    defer slow.Close()
+    fast := newNodeServer(t, 1000, nil)
+
+    pool := newTestEndpointPool(20*time.Millisecond,
+        RPCEndpointConfig{URL: slow.URL, Weight: 1},
+        RPCEndpointConfig{URL: fast.URL, Weight: 0},
+    )
+
+    start := time.Now()
+    result, err := sendTestRequest(t, pool)
+    if err != nil || result != "result" {
+        t.Fatalf("Send: %q, %v", result, err)
+    }
+    if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+        t.Errorf("hedged request took %s", elapsed)
+    }
+    // The slow request was cancelled, which is not the endpoint's fault
+    if stats := pool.Stats()[0]; stats.Errors != 0 {
+        t.Errorf("slow endpoint counted %d errors", stats.Errors)
+    }
+}
+
+func TestEndpointStatsHideAPIKeys(t *testing.T) {
+    down := httptest.NewServer(http.NotFoundHandler())
+    down.Close()
+
+    pool := newTestEndpointPool(0,
+        RPCEndpointConfig{URL: down.URL + "/?api-key=secret-key", Weight: 1},
+        RPCEndpointConfig{URL: down.URL + "/secret-token/", Weight: 1},
+    )
+    if _, err := sendTestRequest(t, pool); err == nil || strings.Contains(err.Error(), "secret") {
+        t.Errorf("Send error %v", err)
+    }
+
+    stats := pool.Stats()
+    if stats[0].Endpoint != down.URL || stats[1].Endpoint != down.URL+" #2" {
+        t.Errorf("endpoints labelled %q and %q", stats[0].Endpoint, stats[1].Endpoint)
+    }
+    body, err := json.Marshal(stats)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(string(body), "secret") {
+        t.Errorf("stats leak the key: %s", body)
+    }
+    if stats[0].Errors == 0 || stats[0].LastError == "" {
+        t.Errorf("failed request not recorded: %+v", stats[0])
+    }
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+    "context"
     "log"
+    "sort"
+    "sync"
     "time"
-
-    "github.com/shopspring/decimal"
 )
 
 type TradeSignal struct {
@@ -13,76 +14,199 @@ type TradeSignal struct {
     Token         string
     Quantity      float64
     Price         float64
+    Signature     string  // Source transaction; empty for signals we originate
+    Slot          uint64
+
+    // The source wallet's fill, to judge whether we are still in time
+    SourceBlockTime time.Time
+    SourcePrice     float64
+
+    // For sells, the share of its position the source wallet sold
+    SourceFraction float64
+
+    // The pool the source wallet traded against, as it stood after its swap
+    ProgramID string
+    Pool      string
+    Reserves  PoolReserves
+
+    // For consensus buys, every top wallet that bought within the window
+    ContributingWallets []string
+
+    // Exits we originate sell one lot and name the rule that fired, with
+    // the lot's take-profit tiers taken once sold
+    LotID      int64
+    Reason     string
+    TiersTaken int
 }
 
+// Emitted signatures are remembered for this long to de-duplicate the
+// streaming and polling paths
+const emittedSignalTTL = 24 * time.Hour
+
+// Signatures are polled in pages of this size until the cursor is reached
+const signalPageSize = 1000
+
 type TradeSignalModule struct {
-    DB     *Database
+    DB     Store
     Config Config
+    Data   *DataAcquisitionModule
+
+    PageSize int
+
+    emitted          map[string]time.Time
+    walletMetrics    map[string]WalletMetrics
+    consensusPending map[string][]consensusBuy
+    consensusFired   map[string]time.Time
+    mutex            sync.Mutex
 }
 
-func InitializeTradeSignalModule(db *Database, config Config) *TradeSignalModule {
+func InitializeTradeSignalModule(db Store, config Config, data *DataAcquisitionModule) *TradeSignalModule {
     return &TradeSignalModule{
-        DB:     db,
-        Config: config,
+        DB:      db,
+        Config:  config,
+        Data:    data,
+        emitted: make(map[string]time.Time),
+
+        PageSize: signalPageSize,
+
+        walletMetrics:    make(map[string]WalletMetrics),
+        consensusPending: make(map[string][]consensusBuy),
+        consensusFired:   make(map[string]time.Time),
     }
 }
 
-func (tsm *TradeSignalModule) GenerateTradeSignals(wallets []WalletMetrics) ([]TradeSignal, error) {
-    var signals []TradeSignal
+// GenerateTradeSignals polls each wallet for new swaps and hands the signals
+// they produce to process. A wallet's cursor only advances once process has
+// returned for all of its signals, so a crash mid-cycle replays them rather
+// than losing them; ClaimSignal keeps the replay from trading twice.
+func (tsm *TradeSignalModule) GenerateTradeSignals(ctx context.Context, wallets []WalletMetrics, process func(TradeSignal)) error {
+    tsm.SetWalletMetrics(wallets)
 
     for _, wallet := range wallets {
-        // Fetch recent trades for the wallet to generate signals
-        trades, err := tsm.FetchRecentTrades(wallet.WalletAddress)
+        // Fetch the wallet's new swaps to generate signals
+        legs, newest, err := tsm.FetchRecentTrades(ctx, wallet.WalletAddress)
         if err != nil {
             log.Println("Error fetching trades for wallet:", wallet.WalletAddress, err)
             continue
         }
 
-        for _, trade := range trades {
-            signal := TradeSignal{
-                WalletAddress: wallet.WalletAddress,
-                Action:        trade.Action, // "buy" or "sell"
-                Token:         trade.Token,
-                Quantity:      trade.Quantity,
-                Price:         trade.Price,
+        for _, leg := range legs {
+            signal, ok := tsm.SignalFromLeg(leg)
+            if !ok {
+                continue
             }
-            signals = append(signals, signal)
+            process(signal)
+        }
+
+        if newest == "" {
+            continue
+        }
+        if err := tsm.DB.SaveSignalCursor(wallet.WalletAddress, newest); err != nil {
+            log.Println("Error saving signal cursor for wallet:", wallet.WalletAddress, err)
         }
     }
 
-    return signals, nil
+    return nil
 }
 
-func (tsm *TradeSignalModule) FetchRecentTrades(walletAddress string) ([]Trade, error) {
-    // Implement fetching recent trades for a wallet
-    // For paper trading, return mock trades based on some logic
-
-    // Placeholder: Return mock trades
-    currentTime := time.Now()
-    mockTrades := []Trade{
-        {
-            OpenTime:      currentTime.Add(-2 * time.Hour),
-            CloseTime:     currentTime.Add(-1 * time.Hour),
-            Profit:        15.0,
-            ProfitPct:     7.5,
-            PositionSize:  200.0,
-            Action:        "buy",
-            Token:         "SHITCOIN",
-            Quantity:      100.0,
-            Price:         2.0,
-        },
-        {
-            OpenTime:      currentTime.Add(-90 * time.Minute),
-            CloseTime:     currentTime.Add(-30 * time.Minute),
-            Profit:        -5.0,
-            ProfitPct:     -2.5,
-            PositionSize:  200.0,
-            Action:        "sell",
-            Token:         "SHITCOIN",
-            Quantity:      50.0,
-            Price:         1.9,
-        },
+// SignalFromLeg turns a swap leg of a copied wallet into a signal. Legs that
+// are not SOL-quoted give no signal, and neither does a leg that already
+// produced one, whether it arrived by streaming or by polling. Buys go
+// through consensus aggregation and only produce a signal once enough top
+// wallets agree.
+func (tsm *TradeSignalModule) SignalFromLeg(leg SwapLeg) (TradeSignal, bool) {
+    if leg.Side() == "" {
+        return TradeSignal{}, false
+    }
+
+    tsm.mutex.Lock()
+    defer tsm.mutex.Unlock()
+    key := leg.Wallet + ":" + leg.Signature + ":" + leg.Token()
+    if _, ok := tsm.emitted[key]; ok {
+        return TradeSignal{}, false
+    }
+    now := time.Now()
+    tsm.emitted[key] = now
+    for k, at := range tsm.emitted {
+        if now.Sub(at) > emittedSignalTTL {
+            delete(tsm.emitted, k)
+        }
+    }
+
+    if leg.Side() == "buy" {
+        return tsm.aggregateBuy(leg)
+    }
+    return signalFromLeg(leg), true
+}
+
+func signalFromLeg(leg SwapLeg) TradeSignal {
+    return TradeSignal{
+        WalletAddress: leg.Wallet,
+        Action:        leg.Side(),
+        Token:         leg.Token(),
+        Quantity:      leg.TokenAmount(),
+        Price:         leg.Price(),
+        Signature:     leg.Signature,
+        Slot:          leg.Slot,
+
+        SourceBlockTime: leg.BlockTime,
+        SourcePrice:     leg.Price(),
+        SourceFraction:  leg.SoldFraction(),
+
+        ProgramID: leg.ProgramID,
+        Pool:      leg.Pool,
+        Reserves:  leg.Reserves,
+    }
+}
+
+// FetchRecentTrades returns the wallet's swap legs since the last signature
+// processed for it, oldest first, and the signature the cursor should move
+// to once they have been processed, empty when there is nothing new. The
+// first time a wallet is seen there are no legs: its history is not copied.
+func (tsm *TradeSignalModule) FetchRecentTrades(ctx context.Context, walletAddress string) ([]SwapLeg, string, error) {
+    lastSignature, err := tsm.DB.GetSignalCursor(walletAddress)
+    if err != nil {
+        return nil, "", err
+    }
+
+    if lastSignature == "" {
+        signatures, err := tsm.Data.RPC.GetSignaturesForAddress(ctx, walletAddress, SignaturesOptions{Limit: 1})
+        if err != nil || len(signatures) == 0 {
+            return nil, "", err
+        }
+        return nil, signatures[0].Signature, nil
+    }
+
+    // Page back from the newest signature until the cursor is reached
+    var signatures []SignatureInfo
+    before := ""
+    for {
+        page, err := tsm.Data.RPC.GetSignaturesForAddress(ctx, walletAddress, SignaturesOptions{
+            Before: before,
+            Until:  lastSignature,
+            Limit:  tsm.PageSize,
+        })
+        if err != nil {
+            return nil, "", err
+        }
+        signatures = append(signatures, page...)
+        if len(page) < tsm.PageSize {
+            break
+        }
+        before = page[len(page)-1].Signature
+    }
+    if len(signatures) == 0 {
+        return nil, "", nil
+    }
+
+    legs, err := tsm.Data.fetchSwapLegs(ctx, walletAddress, signatures)
+    if err != nil {
+        return nil, "", err
     }
 
-    return mockTrades, nil
+    // Signatures come newest first
+    sort.SliceStable(legs, func(i, j int) bool {
+        return legs[i].Slot < legs[j].Slot
+    })
+    return legs, signatures[0].Signature, nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Rejection reasons reported on the dashboard
+const (
+    rejectStaleSignal = "stale_signal"
+    rejectPriceMoved  = "price_moved"
+    rejectNoQuote     = "no_quote"
+)
+
+// SignalGuard drops copied buys we are too late for: signals whose source
+// transaction is older than MaxAge, and signals where the current quote has
+// moved more than MaxPriceMovePct away from the source wallet's fill. Sells
+// always pass, since an exit is worth following even late. Without a Quote
+// source the price check is skipped.
+type SignalGuard struct {
+    MaxAge          time.Duration
+    MaxPriceMovePct float64
+    Quote           func(token string) (decimal.Decimal, error)
+    Stats           *RejectionStats
+}
+
+func NewSignalGuard(config Config, quote func(token string) (decimal.Decimal, error), stats *RejectionStats) *SignalGuard {
+    return &SignalGuard{
+        MaxAge:          config.MaxSignalAge,
+        MaxPriceMovePct: config.MaxPriceMovePct,
+        Quote:           quote,
+        Stats:           stats,
+    }
+}
+
+// Check returns nil if the signal may be executed, or an error naming the
+// reason it was rejected. Rejections are counted in Stats.
+func (g *SignalGuard) Check(signal TradeSignal) error {
+    if signal.Action != "buy" {
+        return nil
+    }
+
+    if g.MaxAge > 0 && !signal.SourceBlockTime.IsZero() {
+        if age := time.Since(signal.SourceBlockTime); age > g.MaxAge {
+            return g.reject(rejectStaleSignal, "signal for %s is %s old", signal.Token, age.Round(time.Second))
+        }
+    }
+
+    if g.Quote != nil && g.MaxPriceMovePct > 0 && signal.SourcePrice > 0 {
+        quote, err := g.Quote(signal.Token)
+        if err != nil {
+            return g.reject(rejectNoQuote, "no quote for %s: %v", signal.Token, err)
+        }
+        movePct := (quote.InexactFloat64() - signal.SourcePrice) / signal.SourcePrice * 100
+        if math.Abs(movePct) > g.MaxPriceMovePct {
+            return g.reject(rejectPriceMoved, "price of %s moved %.2f%% since source fill", signal.Token, movePct)
+        }
+    }
+
+    return nil
+}
+
+// Fresh reports whether the signal's source fill is recent enough to stand
+// for the current price: its time is known and no older than MaxAge
+func (g *SignalGuard) Fresh(signal TradeSignal) bool {
+    if signal.SourceBlockTime.IsZero() {
+        return false
+    }
+    return g.MaxAge <= 0 || time.Since(signal.SourceBlockTime) <= g.MaxAge
+}
+
+func (g *SignalGuard) reject(reason, format string, args ...interface{}) error {
+    g.Stats.Record(reason)
+    return fmt.Errorf("%s: %s", reason, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestSignalGuardCheck(t *testing.T) {
+    quotes := map[string]float64{"up": 1.2, "down": 0.8, "steady": 1.04}
+    stats := NewRejectionStats()
+    guard := NewSignalGuard(Config{MaxSignalAge: time.Minute, MaxPriceMovePct: 5}, func(token string) (decimal.Decimal, error) {
+        quote, ok := quotes[token]
+        if !ok {
+            return decimal.Zero, errors.New("no route")
+        }
+        return decimal.NewFromFloat(quote), nil
+    }, stats)
+
+    now := time.Now()
+    tests := []struct {
+        name   string
+        signal TradeSignal
+        reason string // Empty when the signal passes
+    }{
+        {
+            name:   "fresh buy at the source price",
+            signal: TradeSignal{Action: "buy", Token: "steady", SourceBlockTime: now.Add(-10 * time.Second), SourcePrice: 1},
+        },
+        {
+            name:   "stale buy",
+            signal: TradeSignal{Action: "buy", Token: "steady", SourceBlockTime: now.Add(-2 * time.Minute), SourcePrice: 1},
+            reason: rejectStaleSignal,
+        },
+        {
+            name:   "price moved up",
+            signal: TradeSignal{Action: "buy", Token: "up", SourceBlockTime: now, SourcePrice: 1},
+            reason: rejectPriceMoved,
+        },
+        {
+            name:   "price moved down",
+            signal: TradeSignal{Action: "buy", Token: "down", SourceBlockTime: now, SourcePrice: 1},
+            reason: rejectPriceMoved,
+        },
+        {
+            name:   "no quote",
+            signal: TradeSignal{Action: "buy", Token: "unlisted", SourceBlockTime: now, SourcePrice: 1},
+            reason: rejectNoQuote,
+        },
+        {
+            name:   "unknown block time skips the age check",
+            signal: TradeSignal{Action: "buy", Token: "steady", SourcePrice: 1},
+        },
+        {
+            name:   "stale sell passes",
+            signal: TradeSignal{Action: "sell", Token: "steady", SourceBlockTime: now.Add(-time.Hour), SourcePrice: 1},
+        },
+        {
+            name:   "sell after the price moved passes",
+            signal: TradeSignal{Action: "sell", Token: "down", SourceBlockTime: now, SourcePrice: 1},
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            err := guard.Check(test.signal)
+            switch {
+            case test.reason == "" && err != nil:
+                t.Errorf("rejected: %v", err)
+            case test.reason != "" && (err == nil || !strings.HasPrefix(err.Error(), test.reason)):
+                t.Errorf("got %v, want a %s rejection", err, test.reason)
+            }
+        })
+    }
+
+    want := map[string]int64{rejectStaleSignal: 1, rejectPriceMoved: 2, rejectNoQuote: 1}
+    snapshot := stats.Snapshot()
+    if len(snapshot) != len(want) {
+        t.Errorf("rejection counts %v, want %v", snapshot, want)
+    }
+    for reason, count := range want {
+        if snapshot[reason] != count {
+            t.Errorf("%d %s rejections, want %d", snapshot[reason], reason, count)
+        }
+    }
+}
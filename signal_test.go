@@ -0,0 +1,65 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "testing"
+)
+
+func TestGenerateTradeSignalsAdvancesCursorAfterProcessing(t *testing.T) {
+    const wallet = "6EWo2Tiv3M7cWrfz6QdffBo7zrhvjGLFSotQkHpWQym7"
+    rpc := newFakeRPC()
+    for i := 25; i > 0; i-- {
+        signature := fmt.Sprintf("sig-%02d", i)
+        rpc.signatures = append(rpc.signatures, SignatureInfo{Signature: signature, Slot: uint64(i)})
+        rpc.transactions[signature] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    }
+    rpc.transactions["sig-20"] = loadTransactionFixture(t, "raydium_amm_sell.json")
+
+    store := NewMemoryStore()
+    if err := store.SaveSignalCursor(wallet, "sig-03"); err != nil {
+        t.Fatal(err)
+    }
+    tsm := InitializeTradeSignalModule(store, Config{}, InitializeDataAcquisition(store, Config{RPCBatchSize: 10}, rpc))
+    tsm.PageSize = 10
+
+    var signals []TradeSignal
+    err := tsm.GenerateTradeSignals(context.Background(), []WalletMetrics{{WalletAddress: wallet}}, func(signal TradeSignal) {
+        if cursor, _ := store.GetSignalCursor(wallet); cursor != "sig-03" {
+            t.Errorf("cursor moved to %s before the signal was processed", cursor)
+        }
+        signals = append(signals, signal)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // sig-04 to sig-25 span three pages
+    if calls := rpc.callCount("getSignaturesForAddress"); calls != 3 {
+        t.Errorf("%d getSignaturesForAddress calls, want 3", calls)
+    }
+    if len(signals) != 1 || signals[0].Action != "sell" {
+        t.Fatalf("signals %+v, want the fixture's sell", signals)
+    }
+    if cursor, _ := store.GetSignalCursor(wallet); cursor != "sig-25" {
+        t.Errorf("cursor %s, want sig-25", cursor)
+    }
+}
+
+func TestGenerateTradeSignalsKeepsCursorOnFetchError(t *testing.T) {
+    rpc := newFakeRPC()
+    for _, signature := range []string{"sig-3", "sig-2", "sig-1"} {
+        rpc.signatures = append(rpc.signatures, SignatureInfo{Signature: signature})
+        rpc.transactions[signature] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    }
+    rpc.transactionErrors["sig-3"] = &RPCError{Code: -32005, Message: "Node is behind"}
+
+    store := NewMemoryStore()
+    store.SaveSignalCursor("wallet", "sig-1")
+    tsm := InitializeTradeSignalModule(store, Config{}, InitializeDataAcquisition(store, Config{RPCBatchSize: 10}, rpc))
+
+    tsm.GenerateTradeSignals(context.Background(), []WalletMetrics{{WalletAddress: "wallet"}}, func(TradeSignal) {})
+    if cursor, _ := store.GetSignalCursor("wallet"); cursor != "sig-1" {
+        t.Errorf("cursor moved to %s past unfetched signatures", cursor)
+    }
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Store is everything the bot persists. Database implements it on Postgres
+// and MemoryStore in memory, for running the trading cycle without a
+// database.
+type Store interface {
+    // Wallet metrics and their daily PnL trend. Upserting also appends a
+    // snapshot to the wallet's history.
+    UpsertWalletMetrics(wm WalletMetrics) error
+    TopWallets(minTradeCount int, minWinRate float64, limit int) ([]WalletMetrics, error)
+    InsertDailyPnL(walletAddress string, dailyPnLs []DailyPnL) error
+    GetDailyPnL(walletAddress string) ([]DailyPnL, error)
+
+    // Metrics history and the trends fitted through it. Downsampling keeps
+    // only the last snapshot of each wallet per UTC day among those
+    // recorded before the given time, and returns how many it removed.
+    WalletMetricsHistory(walletAddress string, since time.Time) ([]WalletMetricsSnapshot, error)
+    MetricTrends(metric TrendMetric, since time.Time, minSnapshots int) ([]MetricTrend, error)
+    DownsampleWalletMetricsHistory(before time.Time) (int64, error)
+
+    // Wallet history: sync cursors, swap legs and the round trips built
+    // from them
+    GetWalletCursor(walletAddress string) (WalletCursor, error)
+    SaveWalletCursor(cursor WalletCursor) error
+    SaveSwapLegs(legs []SwapLeg) error
+    SaveSyncPage(legs []SwapLeg, cursor WalletCursor) error
+    LoadSwapLegs(walletAddress string, since time.Time) ([]SwapLeg, error)
+    SaveRoundTrips(walletAddress string, method CostBasisMethod, trades []Trade) error
+    LoadRoundTrips(walletAddress string, from, to time.Time) ([]Trade, error)
+
+    // SaveWalletUpdate writes one metrics pass of a wallet atomically
+    SaveWalletUpdate(update WalletUpdate) error
+
+    // Signals: per-wallet cursors and the processed set
+    GetSignalCursor(walletAddress string) (string, error)
+    SaveSignalCursor(walletAddress, signature string) error
+    ClaimSignal(signal TradeSignal) (bool, error)
+
+    // Token safety reports
+    GetTokenReport(mint string) (*TokenReport, error)
+    SaveTokenReport(report TokenReport) error
+
+    // Portfolio state
+    CreatePortfolio(name string, balance decimal.Decimal) (int64, error)
+    LoadPortfolio(name string) (*Portfolio, error)
+    SavePortfolioChange(portfolioID int64, change PortfolioChange) error
+}
+
+// WalletUpdate is everything one metrics pass writes for a wallet, with
+// the sync cursor past the history it was computed from
+type WalletUpdate struct {
+    Metrics   WalletMetrics // Including its DailyPnLTrend
+    CostBasis CostBasisMethod
+    Trades    []Trade
+    Cursor    WalletCursor
+}
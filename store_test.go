@@ -0,0 +1,422 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/jackc/pgx/v4/pgxpool"
+    "github.com/shopspring/decimal"
+)
+
+func TestMemoryStore(t *testing.T) {
+    testStore(t, NewMemoryStore())
+}
+
+// TestDatabaseStore runs the same suite against Postgres. SOLBOT_TEST_DSN
+// must name a database the test may wipe: every migration is rolled back
+// and applied again first.
+func TestDatabaseStore(t *testing.T) {
+    dsn := os.Getenv("SOLBOT_TEST_DSN")
+    if dsn == "" {
+        t.Skip("SOLBOT_TEST_DSN not set")
+    }
+    testStore(t, testDatabase(t, dsn))
+}
+
+func testDatabase(tb testing.TB, dsn string) *Database {
+    pool, err := pgxpool.Connect(context.Background(), dsn)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    tb.Cleanup(pool.Close)
+
+    db := &Database{Pool: pool}
+    if err := ensureMigrationsTable(db); err != nil {
+        tb.Fatal(err)
+    }
+    applied, err := AppliedMigrations(db)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    if err := MigrateDown(db, len(applied)); err != nil {
+        tb.Fatal(err)
+    }
+    if err := MigrateUp(db, 0); err != nil {
+        tb.Fatal(err)
+    }
+    return db
+}
+
+// testStore checks the behaviour callers rely on from every Store
+func testStore(t *testing.T, store Store) {
+    t.Run("ClaimSignal", func(t *testing.T) {
+        signal := TradeSignal{Signature: "sig", WalletAddress: "wallet", Token: "token", Action: "buy", Slot: 1}
+        for i, want := range []bool{true, false} {
+            claimed, err := store.ClaimSignal(signal)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if claimed != want {
+                t.Errorf("claim %d returned %t, want %t", i+1, claimed, want)
+            }
+        }
+
+        // Another token swapped in the same transaction is a separate signal
+        signal.Token = "other"
+        if claimed, err := store.ClaimSignal(signal); err != nil || !claimed {
+            t.Errorf("claim of another token returned %t, %v", claimed, err)
+        }
+    })
+
+    t.Run("SaveSwapLegs", func(t *testing.T) {
+        at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+        first := SwapLeg{Signature: "b", Slot: 20, BlockTime: at, Wallet: "legs", InputMint: wrappedSOLMint, OutputMint: "x", InputAmount: 1, OutputAmount: 100}
+        second := SwapLeg{Signature: "b", Slot: 20, BlockTime: at, Wallet: "legs", InputMint: "x", OutputMint: "y", InputAmount: 100, OutputAmount: 5}
+        earlier := SwapLeg{Signature: "a", Slot: 10, BlockTime: at.Add(-time.Minute), Wallet: "legs", InputMint: "y", OutputMint: wrappedSOLMint, InputAmount: 5, OutputAmount: 2}
+
+        // The page is written twice, as a resync after a crash would
+        for i := 0; i < 2; i++ {
+            if err := store.SaveSwapLegs([]SwapLeg{first, second}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := store.SaveSwapLegs([]SwapLeg{earlier}); err != nil {
+            t.Fatal(err)
+        }
+
+        legs, err := store.LoadSwapLegs("legs", time.Time{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := []SwapLeg{earlier, first, second}
+        if len(legs) != len(want) {
+            t.Fatalf("loaded %d legs, want %d", len(legs), len(want))
+        }
+        for i := range want {
+            if legs[i].Signature != want[i].Signature || legs[i].InputMint != want[i].InputMint || !legs[i].BlockTime.Equal(want[i].BlockTime) {
+                t.Errorf("leg %d is %+v, want %+v", i, legs[i], want[i])
+            }
+        }
+
+        legs, err = store.LoadSwapLegs("legs", at)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(legs) != 2 {
+            t.Errorf("loaded %d legs since %s, want 2", len(legs), at)
+        }
+    })
+
+    t.Run("LoadRoundTrips", func(t *testing.T) {
+        day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+        trades := []Trade{
+            {Signature: "s1", Token: "t", OpenTime: day.Add(-time.Hour), CloseTime: day, Quantity: 1, Price: 1, PositionSize: 1},
+            {Signature: "s2", Token: "t", OpenTime: day, CloseTime: day.Add(12 * time.Hour), Quantity: 2, Price: 1, PositionSize: 2},
+            {Signature: "s3", Token: "t", OpenTime: day, CloseTime: day.Add(24 * time.Hour), Quantity: 3, Price: 1, PositionSize: 3},
+        }
+        if err := store.SaveRoundTrips("trips", CostBasisFIFO, trades); err != nil {
+            t.Fatal(err)
+        }
+
+        cases := []struct {
+            name     string
+            from, to time.Time
+            want     []string
+        }{
+            {"everything", time.Time{}, time.Time{}, []string{"s1", "s2", "s3"}},
+            {"from is inclusive", day.Add(12 * time.Hour), time.Time{}, []string{"s2", "s3"}},
+            {"to is exclusive", day, day.Add(24 * time.Hour), []string{"s1", "s2"}},
+            {"empty window", day.Add(time.Hour), day.Add(2 * time.Hour), nil},
+        }
+        for _, c := range cases {
+            loaded, err := store.LoadRoundTrips("trips", c.from, c.to)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            for _, trade := range loaded {
+                got = append(got, trade.Signature)
+            }
+            if len(got) != len(c.want) {
+                t.Errorf("%s: loaded %v, want %v", c.name, got, c.want)
+                continue
+            }
+            for i := range got {
+                if got[i] != c.want[i] {
+                    t.Errorf("%s: loaded %v, want %v", c.name, got, c.want)
+                    break
+                }
+            }
+        }
+
+        // Saving again replaces the wallet's round trips
+        if err := store.SaveRoundTrips("trips", CostBasisFIFO, trades[:1]); err != nil {
+            t.Fatal(err)
+        }
+        if loaded, err := store.LoadRoundTrips("trips", time.Time{}, time.Time{}); err != nil || len(loaded) != 1 {
+            t.Errorf("loaded %d round trips after replacing them, %v", len(loaded), err)
+        }
+    })
+
+    t.Run("Portfolio", func(t *testing.T) {
+        id, err := store.CreatePortfolio("conformance", decimal.NewFromInt(10))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := store.CreatePortfolio("conformance", decimal.NewFromInt(10)); err == nil {
+            t.Error("created the same portfolio twice")
+        }
+
+        opened := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+        lot := Lot{
+            ID:              1,
+            Token:           "token",
+            SourceWallet:    "wallet",
+            Quantity:        decimal.NewFromInt(60),
+            InitialQuantity: decimal.NewFromInt(100),
+            EntryPrice:      decimal.RequireFromString("0.01"),
+            OpenedAt:        opened,
+            PeakPrice:       decimal.RequireFromString("0.02"),
+            TiersTaken:      1,
+        }
+        closed := Lot{ID: 2, Token: "gone", SourceWallet: "wallet", Quantity: decimal.NewFromInt(5), InitialQuantity: decimal.NewFromInt(5), EntryPrice: decimal.NewFromInt(1), OpenedAt: opened}
+        changes := []PortfolioChange{
+            {Balance: decimal.NewFromInt(5), SavedLots: []Lot{lot, closed}},
+            {
+                Balance:     decimal.RequireFromString("9.5"),
+                ClosedLots:  []int64{closed.ID},
+                Transaction: &Transaction{
+                    Timestamp: opened.Add(time.Hour),
+                    Action:    "sell",
+                    Token:     "gone",
+                    Quantity:  decimal.NewFromInt(5),
+                    Price:     decimal.RequireFromString("0.9"),
+                    Fee:       decimal.RequireFromString("0.000005"),
+                    Total:     decimal.RequireFromString("4.5"),
+                    Reason:    exitStopLoss,
+                },
+            },
+            {Balance: decimal.RequireFromString("10.5"), CashFlow: &CashFlow{Timestamp: opened.Add(2 * time.Hour), Amount: decimal.NewFromInt(1), ValueBefore: decimal.NewFromInt(11)}},
+        }
+        for _, change := range changes {
+            if err := store.SavePortfolioChange(id, change); err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        restored, err := store.LoadPortfolio("conformance")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if restored == nil {
+            t.Fatal("portfolio not found")
+        }
+        if restored.ID != id || !restored.Balance.Equal(decimal.RequireFromString("10.5")) || !restored.InitialCapital.Equal(decimal.NewFromInt(10)) {
+            t.Errorf("restored id %d, balance %s, initial capital %s", restored.ID, restored.Balance, restored.InitialCapital)
+        }
+        lots := restored.GetLots()
+        if len(lots) != 1 {
+            t.Fatalf("restored lots %+v, want only the open one", lots)
+        }
+        got := lots[0]
+        if got.ID != lot.ID || !got.Quantity.Equal(lot.Quantity) || !got.InitialQuantity.Equal(lot.InitialQuantity) ||
+            !got.EntryPrice.Equal(lot.EntryPrice) || !got.PeakPrice.Equal(lot.PeakPrice) || got.TiersTaken != lot.TiersTaken || !got.OpenedAt.Equal(opened) {
+            t.Errorf("restored lot %+v, want %+v", got, lot)
+        }
+        if len(restored.TransactionLog) != 1 || restored.TransactionLog[0].Reason != exitStopLoss || !restored.TransactionLog[0].Fee.Equal(decimal.RequireFromString("0.000005")) {
+            t.Errorf("restored transactions %+v", restored.TransactionLog)
+        }
+        if !restored.NetDeposits().Equal(decimal.NewFromInt(11)) {
+            t.Errorf("restored net deposits %s, want 11", restored.NetDeposits())
+        }
+
+        if missing, err := store.LoadPortfolio("missing"); err != nil || missing != nil {
+            t.Errorf("loading a missing portfolio returned %v, %v", missing, err)
+        }
+    })
+
+    t.Run("SaveWalletUpdate", func(t *testing.T) {
+        update := walletUpdate("updated", 3, 2)
+        if err := store.SaveWalletUpdate(update); err != nil {
+            t.Fatal(err)
+        }
+
+        trades, err := store.LoadRoundTrips("updated", time.Time{}, time.Time{})
+        if err != nil || len(trades) != 2 {
+            t.Errorf("loaded %d round trips, %v", len(trades), err)
+        }
+        pnl, err := store.GetDailyPnL("updated")
+        if err != nil || len(pnl) != 3 {
+            t.Errorf("loaded %d days of PnL, %v", len(pnl), err)
+        }
+        history, err := store.WalletMetricsHistory("updated", time.Time{})
+        if err != nil || len(history) != 1 || history[0].WinRate != update.Metrics.WinRate {
+            t.Errorf("loaded history %+v, %v", history, err)
+        }
+        if cursor, err := store.GetWalletCursor("updated"); err != nil || cursor != update.Cursor {
+            t.Errorf("loaded cursor %+v, %v; want %+v", cursor, err, update.Cursor)
+        }
+    })
+
+    t.Run("MetricTrends", func(t *testing.T) {
+        since := time.Now().Add(-time.Hour)
+        for _, winRate := range []float64{40, 50, 60} {
+            if err := store.UpsertWalletMetrics(WalletMetrics{WalletAddress: "rising", TradeCount: 10, WinRate: winRate}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        // A win rate that couldn't be computed is left out of the trend
+        for _, winRate := range []float64{70, math.NaN(), 80} {
+            if err := store.UpsertWalletMetrics(WalletMetrics{WalletAddress: "gappy", TradeCount: 10, WinRate: winRate}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := store.UpsertWalletMetrics(WalletMetrics{WalletAddress: "new", TradeCount: 10, WinRate: 90}); err != nil {
+            t.Fatal(err)
+        }
+
+        trends, err := store.MetricTrends(TrendWinRate, since, 2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        byWallet := make(map[string]MetricTrend)
+        for _, trend := range trends {
+            byWallet[trend.WalletAddress] = trend
+        }
+        if len(byWallet) != 2 {
+            t.Errorf("trends for %v, want rising and gappy", byWallet)
+        }
+        if trend := byWallet["rising"]; trend.Snapshots != 3 || trend.First != 40 || trend.Latest != 60 {
+            t.Errorf("rising trend %+v", trend)
+        }
+        if trend := byWallet["gappy"]; trend.Snapshots != 2 || trend.First != 70 || trend.Latest != 80 || math.IsNaN(trend.SlopePerDay) {
+            t.Errorf("gappy trend %+v", trend)
+        }
+
+        if _, err := store.MetricTrends(TrendMetric("balance"), since, 2); err == nil {
+            t.Error("unknown metric accepted")
+        }
+    })
+
+    t.Run("DownsampleWalletMetricsHistory", func(t *testing.T) {
+        for _, winRate := range []float64{10, 20, 30} {
+            if err := store.UpsertWalletMetrics(WalletMetrics{WalletAddress: "thinned", TradeCount: 10, WinRate: winRate}); err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        // Nothing is old enough yet
+        if _, err := store.DownsampleWalletMetricsHistory(time.Now().Add(-48 * time.Hour)); err != nil {
+            t.Fatal(err)
+        }
+        if history, err := store.WalletMetricsHistory("thinned", time.Time{}); err != nil || len(history) != 3 {
+            t.Fatalf("kept %d snapshots, %v; want all 3", len(history), err)
+        }
+
+        removed, err := store.DownsampleWalletMetricsHistory(time.Now().Add(48 * time.Hour))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if removed < 2 {
+            t.Errorf("removed %d snapshots, want at least the 2 older ones", removed)
+        }
+        history, err := store.WalletMetricsHistory("thinned", time.Time{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(history) != 1 || history[0].WinRate != 30 {
+            t.Errorf("kept %+v, want only the latest snapshot", history)
+        }
+    })
+}
+
+// walletUpdate builds a metrics pass of a wallet with the given number of
+// days of PnL and round trips
+func walletUpdate(walletAddress string, days, trades int) WalletUpdate {
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    update := WalletUpdate{
+        Metrics:   WalletMetrics{WalletAddress: walletAddress, TradeCount: trades, WinRate: 55, AveragePositionSize: 1},
+        CostBasis: CostBasisFIFO,
+        Cursor:    WalletCursor{WalletAddress: walletAddress, NewestSignature: "newest", OldestSignature: "oldest", BackfillComplete: true},
+    }
+    for i := 0; i < days; i++ {
+        update.Metrics.DailyPnLTrend = append(update.Metrics.DailyPnLTrend, DailyPnL{Date: start.AddDate(0, 0, i), PnL: float64(i)})
+    }
+    for i := 0; i < trades; i++ {
+        closeTime := start.Add(time.Duration(i) * time.Hour)
+        update.Trades = append(update.Trades, Trade{
+            Signature:    fmt.Sprintf("%s-%d", walletAddress, i),
+            Token:        "token",
+            OpenTime:     closeTime.Add(-time.Minute),
+            CloseTime:    closeTime,
+            Quantity:     1,
+            Price:        1,
+            PositionSize: 1,
+        })
+    }
+    return update
+}
+
+// BenchmarkSaveWalletUpdate writes a metrics pass of 1,000 wallets, with a
+// month of daily PnL and 50 round trips each, the way the pipeline did
+// before WalletUpdate (a write per table and a round trip per PnL day) and
+// as one batched transaction per wallet. Postgres is benchmarked when
+// SOLBOT_TEST_DSN is set.
+func BenchmarkSaveWalletUpdate(b *testing.B) {
+    stores := map[string]func(b *testing.B) Store{
+        "memory": func(b *testing.B) Store { return NewMemoryStore() },
+    }
+    if dsn := os.Getenv("SOLBOT_TEST_DSN"); dsn != "" {
+        stores["postgres"] = func(b *testing.B) Store { return testDatabase(b, dsn) }
+    }
+
+    updates := make([]WalletUpdate, 1000)
+    for i := range updates {
+        updates[i] = walletUpdate(fmt.Sprintf("wallet-%d", i), 30, 50)
+    }
+
+    for name, newStore := range stores {
+        b.Run(name+"/per_row", func(b *testing.B) {
+            store := newStore(b)
+            b.ResetTimer()
+            for n := 0; n < b.N; n++ {
+                for _, update := range updates {
+                    if err := saveWalletUpdatePerRow(store, update); err != nil {
+                        b.Fatal(err)
+                    }
+                }
+            }
+        })
+        b.Run(name+"/batched", func(b *testing.B) {
+            store := newStore(b)
+            b.ResetTimer()
+            for n := 0; n < b.N; n++ {
+                for _, update := range updates {
+                    if err := store.SaveWalletUpdate(update); err != nil {
+                        b.Fatal(err)
+                    }
+                }
+            }
+        })
+    }
+}
+
+func saveWalletUpdatePerRow(store Store, update WalletUpdate) error {
+    walletAddress := update.Metrics.WalletAddress
+    if err := store.SaveRoundTrips(walletAddress, update.CostBasis, update.Trades); err != nil {
+        return err
+    }
+    if err := store.UpsertWalletMetrics(update.Metrics); err != nil {
+        return err
+    }
+    for _, pnl := range update.Metrics.DailyPnLTrend {
+        if err := store.InsertDailyPnL(walletAddress, []DailyPnL{pnl}); err != nil {
+            return err
+        }
+    }
+    return store.SaveWalletCursor(update.Cursor)
+}
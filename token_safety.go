@@ -0,0 +1,217 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+)
+
+// Rejection reasons of the token safety filter
+const (
+    rejectMintAuthority   = "mint_authority"
+    rejectFreezeAuthority = "freeze_authority"
+    rejectConcentration   = "holder_concentration"
+    rejectTokenTooNew     = "token_too_new"
+    rejectLowLiquidity    = "low_liquidity"
+    rejectSafetyUnknown   = "safety_check_failed"
+)
+
+// Pages of mint signatures walked at most to establish a token's age
+const tokenAgeMaxPages = 5
+
+// TokenSafetyRules are the conditions a mint must meet before we copy a buy
+// of it. Zero values disable the numeric rules.
+type TokenSafetyRules struct {
+    RequireMintRevoked   bool
+    RequireFreezeRevoked bool
+    // Share of supply the TopHolders largest accounts may hold, not counting
+    // the pool's own vault
+    MaxTopHolderPct float64
+    TopHolders      int
+    MinTokenAge     time.Duration
+    // SOL held by the pool the source wallet traded against
+    MinLiquiditySOL float64
+}
+
+// TokenReport is what we know about a mint's safety, cached in the
+// token_safety table. CreatedBefore is a lower bound of the mint's creation
+// time: its oldest signature seen, or the oldest one needed to show the
+// token is older than the minimum age.
+type TokenReport struct {
+    Mint            string
+    MintAuthority   string
+    FreezeAuthority string
+    Supply          float64
+    LargestAccounts []TokenAccountBalance
+    CreatedBefore   time.Time
+    CheckedAt       time.Time
+}
+
+// TopHolderPct is the share of supply held by the n largest accounts other
+// than exclude
+func (r TokenReport) TopHolderPct(n int, exclude string) float64 {
+    if r.Supply <= 0 {
+        return 0
+    }
+    var held float64
+    counted := 0
+    for _, account := range r.LargestAccounts {
+        if counted >= n {
+            break
+        }
+        if account.Address == exclude {
+            continue
+        }
+        held += account.Amount
+        counted++
+    }
+    return held / r.Supply * 100
+}
+
+// TokenSafetyFilter vets the mint of every copied buy against Rules. Reports
+// are fetched over RPC and cached per mint in Postgres for TTL; liquidity is
+// taken from the signal itself since it changes with every swap. Sells
+// always pass.
+type TokenSafetyFilter struct {
+    RPC   SolanaRPC
+    DB    Store
+    Rules TokenSafetyRules
+    TTL   time.Duration
+    Stats *RejectionStats
+}
+
+func NewTokenSafetyFilter(db Store, config Config, rpc SolanaRPC, stats *RejectionStats) *TokenSafetyFilter {
+    return &TokenSafetyFilter{
+        RPC:   rpc,
+        DB:    db,
+        Rules: config.TokenSafety,
+        TTL:   config.TokenSafetyTTL,
+        Stats: stats,
+    }
+}
+
+// Check returns nil if the signal's token passes the rules, or an error
+// naming the rule it failed. A token we could not vet is rejected.
+func (tsf *TokenSafetyFilter) Check(ctx context.Context, signal TradeSignal) error {
+    if signal.Action != "buy" {
+        return nil
+    }
+    rules := tsf.Rules
+
+    if rules.MinLiquiditySOL > 0 && signal.Reserves.SOL < rules.MinLiquiditySOL {
+        return tsf.reject(rejectLowLiquidity, "pool %s of %s holds %.2f SOL", signal.Pool, signal.Token, signal.Reserves.SOL)
+    }
+
+    report, err := tsf.Report(ctx, signal.Token)
+    if err != nil {
+        return tsf.reject(rejectSafetyUnknown, "vetting %s: %v", signal.Token, err)
+    }
+
+    if rules.RequireMintRevoked && report.MintAuthority != "" {
+        return tsf.reject(rejectMintAuthority, "%s can still be minted by %s", signal.Token, report.MintAuthority)
+    }
+    if rules.RequireFreezeRevoked && report.FreezeAuthority != "" {
+        return tsf.reject(rejectFreezeAuthority, "%s can be frozen by %s", signal.Token, report.FreezeAuthority)
+    }
+    if rules.MaxTopHolderPct > 0 {
+        if pct := report.TopHolderPct(rules.TopHolders, signal.Reserves.TokenVault); pct > rules.MaxTopHolderPct {
+            return tsf.reject(rejectConcentration, "top %d holders of %s own %.1f%%", rules.TopHolders, signal.Token, pct)
+        }
+    }
+    if rules.MinTokenAge > 0 {
+        if age := time.Since(report.CreatedBefore); age < rules.MinTokenAge {
+            return tsf.reject(rejectTokenTooNew, "%s is %s old", signal.Token, age.Round(time.Second))
+        }
+    }
+
+    return nil
+}
+
+func (tsf *TokenSafetyFilter) reject(reason, format string, args ...interface{}) error {
+    tsf.Stats.Record(reason)
+    return fmt.Errorf("%s: %s", reason, fmt.Sprintf(format, args...))
+}
+
+// Report returns the mint's cached report, refreshing it over RPC when it
+// is missing or older than TTL
+func (tsf *TokenSafetyFilter) Report(ctx context.Context, mint string) (TokenReport, error) {
+    if tsf.DB != nil {
+        cached, err := tsf.DB.GetTokenReport(mint)
+        if err != nil {
+            log.Println("Error reading token safety cache:", err)
+        } else if cached != nil && time.Since(cached.CheckedAt) < tsf.TTL {
+            return *cached, nil
+        }
+    }
+
+    report, err := tsf.fetchReport(ctx, mint)
+    if err != nil {
+        return TokenReport{}, err
+    }
+
+    if tsf.DB != nil {
+        if err := tsf.DB.SaveTokenReport(report); err != nil {
+            log.Println("Error saving token safety report:", err)
+        }
+    }
+    return report, nil
+}
+
+func (tsf *TokenSafetyFilter) fetchReport(ctx context.Context, mint string) (TokenReport, error) {
+    account, err := tsf.RPC.GetMintAccount(ctx, mint)
+    if err != nil {
+        return TokenReport{}, err
+    }
+    largest, err := tsf.RPC.GetTokenLargestAccounts(ctx, mint)
+    if err != nil {
+        return TokenReport{}, err
+    }
+    createdBefore, err := tsf.createdBefore(ctx, mint)
+    if err != nil {
+        return TokenReport{}, err
+    }
+
+    return TokenReport{
+        Mint:            mint,
+        MintAuthority:   account.MintAuthority,
+        FreezeAuthority: account.FreezeAuthority,
+        Supply:          account.Supply,
+        LargestAccounts: largest,
+        CreatedBefore:   createdBefore,
+        CheckedAt:       time.Now(),
+    }, nil
+}
+
+// createdBefore walks the mint's signatures back from the newest until one
+// is older than MinTokenAge or the history runs out, and returns the oldest
+// block time seen. Busy mints have too many signatures to reach their
+// creation, but only need walking far enough to prove their age.
+func (tsf *TokenSafetyFilter) createdBefore(ctx context.Context, mint string) (time.Time, error) {
+    oldest := time.Now()
+    if tsf.Rules.MinTokenAge <= 0 {
+        return oldest, nil
+    }
+    threshold := oldest.Add(-tsf.Rules.MinTokenAge)
+
+    limit := 1000
+    before := ""
+    for page := 0; page < tokenAgeMaxPages; page++ {
+        sigs, err := tsf.RPC.GetSignaturesForAddress(ctx, mint, SignaturesOptions{Before: before, Limit: limit})
+        if err != nil {
+            return time.Time{}, err
+        }
+        for _, sig := range sigs {
+            if sig.BlockTime != nil {
+                if blockTime := time.Unix(*sig.BlockTime, 0).UTC(); blockTime.Before(oldest) {
+                    oldest = blockTime
+                }
+            }
+        }
+        if len(sigs) < limit || oldest.Before(threshold) {
+            break
+        }
+        before = sigs[len(sigs)-1].Signature
+    }
+    return oldest, nil
+}
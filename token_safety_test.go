@@ -0,0 +1,193 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const (
+    testMint      = "7GCihgDB8fe6KNjn2MYtkzZcRjQy3t9GHdC8uHYmW2hr"
+    testPoolVault = "5Q544fKrFoe6tsEbD7S8EmxGTJYAKtTVhAW5Q5pge4j1"
+)
+
+// mintAccountFixture is a jsonParsed getAccountInfo result for a mint with
+// a supply of 1,000,000 tokens of 6 decimals
+func mintAccountFixture(mintAuthority, freezeAuthority string) json.RawMessage {
+    authority := func(address string) string {
+        if address == "" {
+            return "null"
+        }
+        return `"` + address + `"`
+    }
+    return json.RawMessage(fmt.Sprintf(`{
+        "context": {"apiVersion": "2.0.15", "slot": 301234567},
+        "value": {
+            "data": {
+                "parsed": {
+                    "info": {
+                        "decimals": 6,
+                        "freezeAuthority": %s,
+                        "isInitialized": true,
+                        "mintAuthority": %s,
+                        "supply": "1000000000000"
+                    },
+                    "type": "mint"
+                },
+                "program": "spl-token",
+                "space": 82
+            },
+            "executable": false,
+            "lamports": 1461600,
+            "owner": "TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA",
+            "rentEpoch": 18446744073709551615,
+            "space": 82
+        }
+    }`, authority(freezeAuthority), authority(mintAuthority)))
+}
+
+// largestAccountsFixture is a getTokenLargestAccounts result with the pool
+// vault first and the given UI amounts after it
+func largestAccountsFixture(vaultAmount string, amounts ...string) json.RawMessage {
+    entries := []string{fmt.Sprintf(`{"address": %q, "amount": "0", "decimals": 6, "uiAmount": 0, "uiAmountString": %q}`, testPoolVault, vaultAmount)}
+    for i, amount := range amounts {
+        entries = append(entries, fmt.Sprintf(`{"address": "holder%d", "amount": "0", "decimals": 6, "uiAmount": 0, "uiAmountString": %q}`, i, amount))
+    }
+    return json.RawMessage(`{"context": {"slot": 301234567}, "value": [` + strings.Join(entries, ",") + `]}`)
+}
+
+func TestTokenSafetyCheck(t *testing.T) {
+    rules := TokenSafetyRules{
+        RequireMintRevoked:   true,
+        RequireFreezeRevoked: true,
+        MaxTopHolderPct:      25,
+        TopHolders:           2,
+        MinTokenAge:          24 * time.Hour,
+        MinLiquiditySOL:      10,
+    }
+    old := time.Now().Add(-72 * time.Hour).Unix()
+
+    tests := []struct {
+        name      string
+        account   json.RawMessage
+        largest   json.RawMessage
+        createdAt int64
+        liquidity float64
+        reason    string
+    }{
+        {
+            // The pool vault holds most of the supply but does not count
+            name:      "passes",
+            account:   mintAccountFixture("", ""),
+            largest:   largestAccountsFixture("600000", "100000", "50000", "40000"),
+            createdAt: old,
+            liquidity: 80,
+        },
+        {
+            name:      "mint authority set",
+            account:   mintAccountFixture("CnYXwJWzH7CkAjmyWYKBXm9b2WW6ViAgt6VKnBvFKzHj", ""),
+            largest:   largestAccountsFixture("600000", "100000", "50000"),
+            createdAt: old,
+            liquidity: 80,
+            reason:    rejectMintAuthority,
+        },
+        {
+            name:      "freeze authority set",
+            account:   mintAccountFixture("", "CnYXwJWzH7CkAjmyWYKBXm9b2WW6ViAgt6VKnBvFKzHj"),
+            largest:   largestAccountsFixture("600000", "100000", "50000"),
+            createdAt: old,
+            liquidity: 80,
+            reason:    rejectFreezeAuthority,
+        },
+        {
+            name:      "concentrated holders",
+            account:   mintAccountFixture("", ""),
+            largest:   largestAccountsFixture("400000", "300000", "100000"),
+            createdAt: old,
+            liquidity: 80,
+            reason:    rejectConcentration,
+        },
+        {
+            name:      "too new",
+            account:   mintAccountFixture("", ""),
+            largest:   largestAccountsFixture("600000", "100000", "50000"),
+            createdAt: time.Now().Add(-time.Hour).Unix(),
+            liquidity: 80,
+            reason:    rejectTokenTooNew,
+        },
+        {
+            name:      "low liquidity",
+            account:   mintAccountFixture("", ""),
+            largest:   largestAccountsFixture("600000", "100000", "50000"),
+            createdAt: old,
+            liquidity: 2,
+            reason:    rejectLowLiquidity,
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            var calls int64
+            server := newRPCServer(t, func(method string, params []json.RawMessage) (interface{}, *RPCError) {
+                atomic.AddInt64(&calls, 1)
+                switch method {
+                case "getAccountInfo":
+                    return test.account, nil
+                case "getTokenLargestAccounts":
+                    return test.largest, nil
+                case "getSignaturesForAddress":
+                    return []map[string]interface{}{
+                        {"signature": "sig-2", "slot": 2, "blockTime": time.Now().Unix()},
+                        {"signature": "sig-1", "slot": 1, "blockTime": test.createdAt},
+                    }, nil
+                }
+                return nil, &RPCError{Code: -32601, Message: "Method not found"}
+            })
+
+            stats := NewRejectionStats()
+            filter := NewTokenSafetyFilter(NewMemoryStore(), Config{TokenSafety: rules, TokenSafetyTTL: time.Hour}, newTestRPCClient(server.URL), stats)
+            signal := TradeSignal{
+                Action:   "buy",
+                Token:    testMint,
+                Reserves: PoolReserves{SOL: test.liquidity, TokenVault: testPoolVault},
+            }
+
+            err := filter.Check(context.Background(), signal)
+            if test.reason == "" {
+                if err != nil {
+                    t.Fatalf("rejected: %v", err)
+                }
+            } else if err == nil || !strings.HasPrefix(err.Error(), test.reason+":") {
+                t.Fatalf("got %v, want rejection for %s", err, test.reason)
+            }
+            if test.reason != "" && stats.Snapshot()[test.reason] != 1 {
+                t.Errorf("rejection stats %v", stats.Snapshot())
+            }
+
+            // A second check within the TTL is served from the cache
+            before := atomic.LoadInt64(&calls)
+            filter.Check(context.Background(), signal)
+            if after := atomic.LoadInt64(&calls); after != before {
+                t.Errorf("%d RPC calls on a cached report", after-before)
+            }
+        })
+    }
+}
+
+func TestTokenSafetyRejectsUnvettedToken(t *testing.T) {
+    rpc := newFakeRPC()
+    stats := NewRejectionStats()
+    filter := NewTokenSafetyFilter(nil, Config{}, rpc, stats)
+
+    err := filter.Check(context.Background(), TradeSignal{Action: "buy", Token: testMint})
+    if err == nil || stats.Snapshot()[rejectSafetyUnknown] != 1 {
+        t.Errorf("unknown mint: %v, stats %v", err, stats.Snapshot())
+    }
+    if err := filter.Check(context.Background(), TradeSignal{Action: "sell", Token: testMint}); err != nil {
+        t.Errorf("sell rejected: %v", err)
+    }
+}
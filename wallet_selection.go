@@ -1,61 +1,173 @@
 package main
 
 import (
-    "context"
-    "log"
-
-    "github.com/jackc/pgx/v4/pgxpool"
+    "sort"
+    "time"
 )
 
 type WalletSelectionModule struct {
-    DB     *Database
+    DB     Store
     Config Config
 }
 
-func InitializeWalletSelection(db *Database, config Config) *WalletSelectionModule {
+func InitializeWalletSelection(db Store, config Config) *WalletSelectionModule {
     return &WalletSelectionModule{
         DB:     db,
         Config: config,
     }
 }
 
+// Wallets need more closed round trips than this to be selected
+const minSelectionTradeCount = 50
+
+// A trend is only fitted through at least this many snapshots
+const minTrendSnapshots = 3
+
+// TrendMetric is a wallet_metrics column whose history can be ranked
+type TrendMetric string
+
+const (
+    TrendWinRate          TrendMetric = "win_rate"
+    TrendAverageProfitPct TrendMetric = "average_profit_pct"
+    TrendAverageLossPct   TrendMetric = "average_loss_pct"
+    TrendTradeCount       TrendMetric = "trade_count"
+)
+
+func (tm TrendMetric) valid() bool {
+    switch tm {
+    case TrendWinRate, TrendAverageProfitPct, TrendAverageLossPct, TrendTradeCount:
+        return true
+    }
+    return false
+}
+
+// value reads the metric from a snapshot
+func (tm TrendMetric) value(wm WalletMetrics) float64 {
+    switch tm {
+    case TrendWinRate:
+        return wm.WinRate
+    case TrendAverageProfitPct:
+        return wm.AverageProfitPct
+    case TrendAverageLossPct:
+        return wm.AverageLossPct
+    case TrendTradeCount:
+        return float64(wm.TradeCount)
+    }
+    return 0
+}
+
+// WalletMetricsSnapshot is a wallet's metrics as recorded by one pass
+type WalletMetricsSnapshot struct {
+    WalletMetrics
+    RecordedAt time.Time
+}
+
+// MetricTrend is the least squares slope of one metric of a wallet over
+// its snapshots in a window, in metric units per day, with the first and
+// latest values seen
+type MetricTrend struct {
+    WalletAddress string
+    Metric        TrendMetric
+    Snapshots     int
+    SlopePerDay   float64
+    First         float64
+    Latest        float64
+}
+
 func (wsm *WalletSelectionModule) SelectTopWallets(limit int) ([]WalletMetrics, error) {
-    query := `
-        SELECT wallet_address, trade_count, win_rate, average_profit, 
-               average_profit_pct, average_loss, average_loss_pct, 
-               average_position_size, average_trade_duration
-        FROM wallet_metrics
-        WHERE trade_count > 50 AND win_rate > $1
-        ORDER BY win_rate DESC, average_profit_pct DESC
-        LIMIT $2;
-    `
-
-    rows, err := wsm.DB.Pool.Query(context.Background(), query, wsm.Config.TargetWinRate, limit)
+    return wsm.DB.TopWallets(minSelectionTradeCount, wsm.Config.TargetWinRate, limit)
+}
+
+// SelectWallets selects by win-rate trend when SelectionTrendWindow is
+// configured, and on the latest metrics otherwise
+func (wsm *WalletSelectionModule) SelectWallets(limit int) ([]WalletMetrics, error) {
+    if wsm.Config.SelectionTrendWindow > 0 {
+        return wsm.SelectTopWalletsByTrend(limit, wsm.Config.SelectionTrendWindow, wsm.Config.SelectionMaxDecayPerDay)
+    }
+    return wsm.SelectTopWallets(limit)
+}
+
+// DownsampleHistory thins metrics snapshots older than
+// MetricsHistoryFullDays to the last one of each wallet per day, which is
+// all a trend over days needs. The cutoff is a UTC midnight, so no day is
+// thinned partway. Thinning is opt-in: with MetricsHistoryFullDays 0 every
+// snapshot is kept.
+func (wsm *WalletSelectionModule) DownsampleHistory() (int64, error) {
+    if wsm.Config.MetricsHistoryFullDays <= 0 {
+        return 0, nil
+    }
+    year, month, day := time.Now().UTC().AddDate(0, 0, -wsm.Config.MetricsHistoryFullDays).Date()
+    return wsm.DB.DownsampleWalletMetricsHistory(time.Date(year, month, day, 0, 0, 0, 0, time.UTC))
+}
+
+// MetricsBetween recomputes a wallet's metrics from its stored round trips
+// closed in [from, to), without going back to RPC. A zero to means now.
+func (wsm *WalletSelectionModule) MetricsBetween(walletAddress string, from, to time.Time) (WalletMetrics, error) {
+    trades, err := wsm.DB.LoadRoundTrips(walletAddress, from, to)
+    if err != nil {
+        return WalletMetrics{}, err
+    }
+    return CalculateWalletMetrics(walletAddress, trades), nil
+}
+
+// MetricHistory returns the wallet's metrics snapshots over the last window
+func (wsm *WalletSelectionModule) MetricHistory(walletAddress string, window time.Duration) ([]WalletMetricsSnapshot, error) {
+    return wsm.DB.WalletMetricsHistory(walletAddress, time.Now().Add(-window))
+}
+
+// RankByTrend ranks wallets by how fast metric improved over the last
+// window, e.g. RankByTrend(TrendWinRate, 30*24*time.Hour, 100) for the
+// steepest win-rate slopes over 30 days. For TrendAverageLossPct, where
+// losses are negative, a rising slope means shrinking losses.
+func (wsm *WalletSelectionModule) RankByTrend(metric TrendMetric, window time.Duration, limit int) ([]MetricTrend, error) {
+    trends, err := wsm.DB.MetricTrends(metric, time.Now().Add(-window), minTrendSnapshots)
     if err != nil {
         return nil, err
     }
-    defer rows.Close()
-
-    var wallets []WalletMetrics
-    for rows.Next() {
-        var wm WalletMetrics
-        err := rows.Scan(
-            &wm.WalletAddress,
-            &wm.TradeCount,
-            &wm.WinRate,
-            &wm.AverageProfit,
-            &wm.AverageProfitPct,
-            &wm.AverageLoss,
-            &wm.AverageLossPct,
-            &wm.AveragePositionSize,
-            &wm.AverageTradeDuration,
-        )
-        if err != nil {
-            log.Println("Error scanning row:", err)
-            continue
+    sort.Slice(trends, func(i, j int) bool {
+        if trends[i].SlopePerDay != trends[j].SlopePerDay {
+            return trends[i].SlopePerDay > trends[j].SlopePerDay
         }
-        wallets = append(wallets, wm)
+        return trends[i].Latest > trends[j].Latest
+    })
+    if limit > 0 && len(trends) > limit {
+        trends = trends[:limit]
+    }
+    return trends, nil
+}
+
+// SelectTopWalletsByTrend selects like SelectTopWallets, then drops wallets
+// whose win rate fell faster than maxDecayPerDay points a day over the last
+// window and orders the rest by win-rate slope. Wallets without enough
+// history to fit a trend are kept, after those with one.
+func (wsm *WalletSelectionModule) SelectTopWalletsByTrend(limit int, window time.Duration, maxDecayPerDay float64) ([]WalletMetrics, error) {
+    wallets, err := wsm.SelectTopWallets(limit)
+    if err != nil {
+        return nil, err
+    }
+    trends, err := wsm.DB.MetricTrends(TrendWinRate, time.Now().Add(-window), minTrendSnapshots)
+    if err != nil {
+        return nil, err
+    }
+    slopes := make(map[string]float64, len(trends))
+    for _, trend := range trends {
+        slopes[trend.WalletAddress] = trend.SlopePerDay
     }
 
-    return wallets, nil
+    var selected []WalletMetrics
+    for _, wm := range wallets {
+        if slope, ok := slopes[wm.WalletAddress]; ok && slope < -maxDecayPerDay {
+            continue
+        }
+        selected = append(selected, wm)
+    }
+    sort.SliceStable(selected, func(i, j int) bool {
+        slopeI, okI := slopes[selected[i].WalletAddress]
+        slopeJ, okJ := slopes[selected[j].WalletAddress]
+        if okI != okJ {
+            return okI
+        }
+        return slopeI > slopeJ
+    })
+    return selected, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSelectWalletsDropsDecayingWinRates(t *testing.T) {
+    store := NewMemoryStore()
+    now := time.Now()
+    histories := map[string][]float64{
+        "steady":   {70, 70, 71},
+        "decaying": {90, 80, 72},
+        "rising":   {60, 66, 73},
+    }
+    for wallet, winRates := range histories {
+        for i, winRate := range winRates {
+            wm := WalletMetrics{WalletAddress: wallet, TradeCount: 100, WinRate: winRate}
+            store.walletMetrics[wallet] = wm
+            store.history[wallet] = append(store.history[wallet], WalletMetricsSnapshot{
+                WalletMetrics: wm,
+                RecordedAt:    now.AddDate(0, 0, i-len(winRates)),
+            })
+        }
+    }
+    // Too little history to fit a trend, so kept after the others
+    store.walletMetrics["new"] = WalletMetrics{WalletAddress: "new", TradeCount: 100, WinRate: 80}
+
+    config := Config{TargetWinRate: 60}
+    latest, err := InitializeWalletSelection(store, config).SelectWallets(10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(latest) != 4 {
+        t.Fatalf("selected %d wallets without a trend window, want all 4", len(latest))
+    }
+
+    config.SelectionTrendWindow = 30 * 24 * time.Hour
+    config.SelectionMaxDecayPerDay = 0.5
+    selected, err := InitializeWalletSelection(store, config).SelectWallets(10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for _, wm := range selected {
+        got = append(got, wm.WalletAddress)
+    }
+    want := []string{"rising", "steady", "new"}
+    if len(got) != len(want) {
+        t.Fatalf("selected %v, want %v", got, want)
+    }
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("selected %v, want %v", got, want)
+        }
+    }
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "sync"
+    "time"
+)
+
+// Signatures remembered for de-duplication are pruned after this long
+const streamSeenTTL = time.Hour
+
+// Page size of the getSignaturesForAddress walk that fills a gap, the RPC
+// maximum
+const streamGapPageSize = 1000
+
+type subscriptionRef struct {
+    wallet string
+    kind   string // "logs" or "account"
+}
+
+// walletStream is the streaming state of one tracked wallet. conn is the
+// connection its subscriptions were requested on. lastSignature and lastSlot
+// mark the newest transaction processed, which is where a gap fill resumes
+// from. baselining is set while setBaseline is looking for the first one.
+type walletStream struct {
+    conn          *wsConn
+    logsSub       uint64
+    accountSub    uint64
+    lastSignature string
+    lastSlot      uint64
+    baselining    bool
+}
+
+// WalletStreamer follows the tracked wallets over the RPC WebSocket. Every
+// wallet gets a logsSubscribe (one notification per transaction mentioning
+// it) and an accountSubscribe (one per change to its SOL balance). Decoded
+// swap legs are delivered on Legs as soon as they are seen.
+//
+// Holes are filled from getSignaturesForAddress: after every reconnect, and
+// whenever an account notification arrives for a slot that no logs
+// notification has covered within GapGrace, which means a notification was
+// dropped. A new wallet's baseline, where gap fills stop, is its newest
+// signature once its logs subscription is active, fetched again every
+// BaselineRetry until that succeeds.
+type WalletStreamer struct {
+    URL           string
+    Data          *DataAcquisitionModule
+    Legs          chan SwapLeg
+    PingInterval  time.Duration
+    GapGrace      time.Duration
+    GapPageSize   int
+    BaselineRetry time.Duration
+
+    mutex    sync.Mutex
+    conn     *wsConn
+    wallets  map[string]*walletStream
+    requests map[uint64]subscriptionRef
+    subs     map[uint64]subscriptionRef
+    seen     map[string]time.Time
+    nextID   uint64
+}
+
+func NewWalletStreamer(config Config, data *DataAcquisitionModule) *WalletStreamer {
+    return &WalletStreamer{
+        URL:           config.SolanaWSURL,
+        Data:          data,
+        Legs:          make(chan SwapLeg, 256),
+        PingInterval:  config.StreamPingInterval,
+        GapGrace:      config.StreamGapGrace,
+        GapPageSize:   streamGapPageSize,
+        BaselineRetry: time.Second,
+        wallets:       make(map[string]*walletStream),
+        requests:      make(map[uint64]subscriptionRef),
+        subs:          make(map[uint64]subscriptionRef),
+        seen:          make(map[string]time.Time),
+    }
+}
+
+// SetWallets replaces the set of streamed wallets, subscribing to new ones
+// and unsubscribing from those no longer tracked. New wallets get their
+// baseline once the subscription is confirmed.
+func (ws *WalletStreamer) SetWallets(ctx context.Context, wallets []string) {
+    wanted := make(map[string]bool, len(wallets))
+    for _, wallet := range wallets {
+        wanted[wallet] = true
+    }
+
+    ws.mutex.Lock()
+    conn := ws.conn
+    var added []string
+    for wallet := range wanted {
+        if _, ok := ws.wallets[wallet]; !ok {
+            ws.wallets[wallet] = &walletStream{}
+            added = append(added, wallet)
+        }
+    }
+    var unsubscribe []rpcRequest
+    for wallet, state := range ws.wallets {
+        if wanted[wallet] {
+            continue
+        }
+        if state.logsSub != 0 {
+            unsubscribe = append(unsubscribe, ws.newRequest("logsUnsubscribe", []interface{}{state.logsSub}))
+            delete(ws.subs, state.logsSub)
+        }
+        if state.accountSub != 0 {
+            unsubscribe = append(unsubscribe, ws.newRequest("accountUnsubscribe", []interface{}{state.accountSub}))
+            delete(ws.subs, state.accountSub)
+        }
+        delete(ws.wallets, wallet)
+    }
+    ws.mutex.Unlock()
+
+    if conn != nil {
+        for _, request := range unsubscribe {
+            ws.write(conn, request)
+        }
+    }
+
+    if conn != nil {
+        for _, wallet := range added {
+            ws.subscribe(conn, wallet)
+        }
+    }
+}
+
+// Run keeps the WebSocket session alive until ctx is done, reconnecting
+// with exponential backoff
+func (ws *WalletStreamer) Run(ctx context.Context) {
+    delay := time.Second
+    for ctx.Err() == nil {
+        connected, err := ws.session(ctx)
+        if connected {
+            delay = time.Second
+        }
+        log.Println("Wallet stream disconnected:", err)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delay):
+        }
+        if delay *= 2; delay > time.Minute {
+            delay = time.Minute
+        }
+    }
+}
+
+// session runs one connection: subscribe every wallet, fill whatever was
+// missed while disconnected, then read notifications until the connection
+// fails
+func (ws *WalletStreamer) session(ctx context.Context) (bool, error) {
+    conn, err := dialWebSocket(ctx, ws.URL)
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+
+    ws.mutex.Lock()
+    ws.conn = conn
+    ws.requests = make(map[uint64]subscriptionRef)
+    ws.subs = make(map[uint64]subscriptionRef)
+    wallets := make([]string, 0, len(ws.wallets))
+    for wallet, state := range ws.wallets {
+        state.logsSub, state.accountSub = 0, 0
+        wallets = append(wallets, wallet)
+    }
+    ws.mutex.Unlock()
+
+    defer func() {
+        ws.mutex.Lock()
+        if ws.conn == conn {
+            ws.conn = nil
+        }
+        ws.mutex.Unlock()
+    }()
+
+    log.Printf("Wallet stream connected, subscribing %d wallets\n", len(wallets))
+    for _, wallet := range wallets {
+        if err := ws.subscribe(conn, wallet); err != nil {
+            return true, err
+        }
+        go ws.fillGap(ctx, wallet)
+    }
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        ticker := time.NewTicker(ws.PingInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ctx.Done():
+                conn.Close()
+                return
+            case <-ticker.C:
+                conn.Ping()
+            }
+        }
+    }()
+
+    for {
+        conn.SetReadDeadline(time.Now().Add(3 * ws.PingInterval))
+        message, err := conn.ReadMessage()
+        if err != nil {
+            return true, err
+        }
+        ws.handleMessage(ctx, message)
+    }
+}
+
+func (ws *WalletStreamer) newRequest(method string, params []interface{}) rpcRequest {
+    ws.nextID++
+    return rpcRequest{JSONRPC: "2.0", ID: ws.nextID, Method: method, Params: params}
+}
+
+func (ws *WalletStreamer) write(conn *wsConn, request rpcRequest) error {
+    payload, err := json.Marshal(request)
+    if err != nil {
+        return err
+    }
+    return conn.WriteText(payload)
+}
+
+// subscribe requests both subscriptions of wallet on conn, unless they were
+// already requested there. SetWallets and a reconnecting session may both
+// try for a newly added wallet; a connection that is no longer current is
+// left to the session that replaced it.
+func (ws *WalletStreamer) subscribe(conn *wsConn, wallet string) error {
+    ws.mutex.Lock()
+    state, ok := ws.wallets[wallet]
+    if !ok || conn != ws.conn || state.conn == conn {
+        ws.mutex.Unlock()
+        return nil
+    }
+    state.conn = conn
+    logs := ws.newRequest("logsSubscribe", []interface{}{
+        map[string]interface{}{"mentions": []string{wallet}},
+        map[string]interface{}{"commitment": "confirmed"},
+    })
+    account := ws.newRequest("accountSubscribe", []interface{}{
+        wallet,
+        map[string]interface{}{"encoding": "base64", "commitment": "confirmed"},
+    })
+    ws.requests[logs.ID] = subscriptionRef{wallet: wallet, kind: "logs"}
+    ws.requests[account.ID] = subscriptionRef{wallet: wallet, kind: "account"}
+    ws.mutex.Unlock()
+
+    if err := ws.write(conn, logs); err != nil {
+        return err
+    }
+    return ws.write(conn, account)
+}
+
+func (ws *WalletStreamer) handleMessage(ctx context.Context, message []byte) {
+    var msg struct {
+        ID     uint64          `json:"id"`
+        Result json.RawMessage `json:"result"`
+        Error  *RPCError       `json:"error"`
+        Method string          `json:"method"`
+        Params struct {
+            Subscription uint64 `json:"subscription"`
+            Result       struct {
+                Context struct {
+                    Slot uint64 `json:"slot"`
+                } `json:"context"`
+                Value json.RawMessage `json:"value"`
+            } `json:"result"`
+        } `json:"params"`
+    }
+    if err := json.Unmarshal(message, &msg); err != nil {
+        log.Println("Error decoding stream message:", err)
+        return
+    }
+
+    ws.mutex.Lock()
+    defer ws.mutex.Unlock()
+
+    switch msg.Method {
+    case "":
+        // Response to a subscribe request (unsubscribe responses are not tracked)
+        ref, ok := ws.requests[msg.ID]
+        if !ok {
+            return
+        }
+        delete(ws.requests, msg.ID)
+        if msg.Error != nil {
+            log.Printf("Error subscribing %s for wallet %s: %v\n", ref.kind, ref.wallet, msg.Error)
+            return
+        }
+        var subscription uint64
+        if err := json.Unmarshal(msg.Result, &subscription); err != nil {
+            return
+        }
+        state, ok := ws.wallets[ref.wallet]
+        if !ok {
+            return
+        }
+        ws.subs[subscription] = ref
+        if ref.kind == "logs" {
+            state.logsSub = subscription
+            // Anything newer than the baseline is now either notified or
+            // found by a gap fill
+            if state.lastSignature == "" && !state.baselining {
+                state.baselining = true
+                go ws.setBaseline(ctx, ref.wallet)
+            }
+        } else {
+            state.accountSub = subscription
+        }
+
+    case "logsNotification":
+        ref, ok := ws.subs[msg.Params.Subscription]
+        if !ok {
+            return
+        }
+        var value struct {
+            Signature string      `json:"signature"`
+            Err       interface{} `json:"err"`
+        }
+        if err := json.Unmarshal(msg.Params.Result.Value, &value); err != nil || value.Err != nil {
+            return
+        }
+        go ws.processSignature(ctx, ref.wallet, value.Signature, msg.Params.Result.Context.Slot)
+
+    case "accountNotification":
+        ref, ok := ws.subs[msg.Params.Subscription]
+        if !ok {
+            return
+        }
+        go ws.checkGap(ctx, ref.wallet, msg.Params.Result.Context.Slot)
+    }
+}
+
+// processSignature decodes a transaction of the wallet once and publishes
+// its swap legs
+func (ws *WalletStreamer) processSignature(ctx context.Context, wallet, signature string, slot uint64) {
+    ws.mutex.Lock()
+    key := wallet + ":" + signature
+    if _, seen := ws.seen[key]; seen {
+        ws.mutex.Unlock()
+        return
+    }
+    now := time.Now()
+    ws.seen[key] = now
+    for k, at := range ws.seen {
+        if now.Sub(at) > streamSeenTTL {
+            delete(ws.seen, k)
+        }
+    }
+    if state, ok := ws.wallets[wallet]; ok && slot >= state.lastSlot {
+        state.lastSlot = slot
+        state.lastSignature = signature
+    }
+    ws.mutex.Unlock()
+
+    // A transaction announced at confirmed may take a moment to be served
+    var legs []SwapLeg
+    var err error
+    for attempt := 0; attempt < 3; attempt++ {
+        legs, err = ws.Data.FetchTransactionDetails(ctx, wallet, signature)
+        if err != errTransactionNotFound {
+            break
+        }
+        time.Sleep(time.Second)
+    }
+    if err != nil {
+        if _, ok := err.(*UnclassifiedError); ok {
+            log.Println("Skipping", err)
+        } else if err != errNotSwap && err != errFailedTransaction {
+            log.Println("Error decoding streamed transaction:", signature, err)
+        }
+        return
+    }
+
+    for _, leg := range legs {
+        select {
+        case ws.Legs <- leg:
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// checkGap runs for every account notification. The balance change at slot
+// must come from a transaction mentioning the wallet, so if no logs
+// notification has reached that slot after GapGrace one was lost.
+func (ws *WalletStreamer) checkGap(ctx context.Context, wallet string, slot uint64) {
+    select {
+    case <-ctx.Done():
+        return
+    case <-time.After(ws.GapGrace):
+    }
+
+    ws.mutex.Lock()
+    state, ok := ws.wallets[wallet]
+    missed := ok && state.lastSlot < slot
+    ws.mutex.Unlock()
+
+    if missed {
+        log.Printf("Slot gap for wallet %s at slot %d, filling from signatures\n", wallet, slot)
+        ws.fillGap(ctx, wallet)
+    }
+}
+
+// fillGap processes, oldest first, every signature newer than the last one
+// processed for the wallet, paging back from the tip as far as needed
+func (ws *WalletStreamer) fillGap(ctx context.Context, wallet string) {
+    ws.mutex.Lock()
+    state, ok := ws.wallets[wallet]
+    until := ""
+    if ok {
+        until = state.lastSignature
+    }
+    ws.mutex.Unlock()
+    if until == "" {
+        return
+    }
+
+    var signatures []SignatureInfo
+    before := ""
+    for {
+        page, err := ws.Data.RPC.GetSignaturesForAddress(ctx, wallet, SignaturesOptions{
+            Before: before,
+            Until:  until,
+            Limit:  ws.GapPageSize,
+        })
+        if err != nil {
+            log.Println("Error filling stream gap for wallet:", wallet, err)
+            return
+        }
+        signatures = append(signatures, page...)
+        if len(page) < ws.GapPageSize {
+            break
+        }
+        before = page[len(page)-1].Signature
+    }
+    for i := len(signatures) - 1; i >= 0; i-- {
+        if signatures[i].Err == nil {
+            ws.processSignature(ctx, wallet, signatures[i].Signature, signatures[i].Slot)
+        }
+    }
+}
+
+// setBaseline records the wallet's newest signature when it starts being
+// tracked, so gap fills never replay history from before that point. Gap
+// filling has nowhere to stop without it, so a failed lookup is retried
+// until the wallet is dropped, a notification sets it first or ctx is done.
+func (ws *WalletStreamer) setBaseline(ctx context.Context, wallet string) {
+    defer func() {
+        ws.mutex.Lock()
+        if state, ok := ws.wallets[wallet]; ok {
+            state.baselining = false
+        }
+        ws.mutex.Unlock()
+    }()
+
+    for {
+        signatures, err := ws.Data.RPC.GetSignaturesForAddress(ctx, wallet, SignaturesOptions{Limit: 1})
+        if err == nil {
+            ws.mutex.Lock()
+            if state, ok := ws.wallets[wallet]; ok && state.lastSignature == "" && len(signatures) > 0 {
+                state.lastSignature = signatures[0].Signature
+                state.lastSlot = signatures[0].Slot
+            }
+            ws.mutex.Unlock()
+            return
+        }
+        log.Println("Error fetching stream baseline for wallet:", wallet, err)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(ws.BaselineRetry):
+        }
+        ws.mutex.Lock()
+        state, ok := ws.wallets[wallet]
+        pending := ok && state.lastSignature == ""
+        ws.mutex.Unlock()
+        if !pending {
+            return
+        }
+    }
+}
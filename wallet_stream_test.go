@@ -0,0 +1,117 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "sync"
+    "time"
+    "testing"
+)
+
+func TestFillGapPagesBackToLastSignature(t *testing.T) {
+    rpc := newFakeRPC()
+    for i := 30; i > 0; i-- {
+        signature := fmt.Sprintf("sig-%02d", i)
+        rpc.signatures = append(rpc.signatures, SignatureInfo{Signature: signature, Slot: uint64(i)})
+        rpc.transactions[signature] = &SolanaTransaction{Meta: &TransactionMeta{}}
+    }
+
+    ws := NewWalletStreamer(Config{}, InitializeDataAcquisition(NewMemoryStore(), Config{}, rpc))
+    ws.GapPageSize = 10
+    ws.wallets["wallet"] = &walletStream{lastSignature: "sig-05", lastSlot: 5}
+
+    ws.fillGap(context.Background(), "wallet")
+
+    // sig-06 to sig-30 span three pages
+    if calls := rpc.callCount("getSignaturesForAddress"); calls != 3 {
+        t.Errorf("%d getSignaturesForAddress calls, want 3", calls)
+    }
+    if len(ws.seen) != 25 {
+        t.Errorf("processed %d signatures, want 25", len(ws.seen))
+    }
+    for i := 1; i <= 5; i++ {
+        if _, ok := ws.seen[fmt.Sprintf("wallet:sig-%02d", i)]; ok {
+            t.Errorf("sig-%02d predates the gap", i)
+        }
+    }
+    if state := ws.wallets["wallet"]; state.lastSignature != "sig-30" || state.lastSlot != 30 {
+        t.Errorf("stream resumes from %s at slot %d", state.lastSignature, state.lastSlot)
+    }
+}
+
+func TestSubscribeOncePerConnection(t *testing.T) {
+    client, server := net.Pipe()
+    defer client.Close()
+    go io.Copy(ioutil.Discard, server)
+    conn := &wsConn{conn: client, reader: bufio.NewReader(client)}
+
+    ws := NewWalletStreamer(Config{}, InitializeDataAcquisition(NewMemoryStore(), Config{}, newFakeRPC()))
+    ws.conn = conn
+    ws.wallets["wallet"] = &walletStream{}
+
+    // SetWallets and a reconnecting session both subscribe a new wallet
+    var wg sync.WaitGroup
+    for i := 0; i < 2; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if err := ws.subscribe(conn, "wallet"); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    if len(ws.requests) != 2 {
+        t.Fatalf("%d subscribe requests, want one logs and one account", len(ws.requests))
+    }
+
+    // A connection that has been replaced subscribes nothing
+    stale := &wsConn{conn: client, reader: bufio.NewReader(client)}
+    ws.wallets["other"] = &walletStream{}
+    if err := ws.subscribe(stale, "other"); err != nil || len(ws.requests) != 2 {
+        t.Fatalf("stale connection subscribed: %v, %d requests", err, len(ws.requests))
+    }
+}
+
+func TestBaselineRetriedAfterSubscribe(t *testing.T) {
+    rpc := newFakeRPC()
+    rpc.signatures = []SignatureInfo{{Signature: "sig-2", Slot: 2}, {Signature: "sig-1", Slot: 1}}
+    rpc.methodErrors["getSignaturesForAddress"] = errors.New("rate limited")
+
+    ws := NewWalletStreamer(Config{}, InitializeDataAcquisition(NewMemoryStore(), Config{}, rpc))
+    ws.BaselineRetry = time.Millisecond
+    ws.wallets["wallet"] = &walletStream{}
+    ws.requests[7] = subscriptionRef{wallet: "wallet", kind: "logs"}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ws.handleMessage(ctx, []byte(`{"jsonrpc":"2.0","id":7,"result":42}`))
+
+    baseline := func() string {
+        ws.mutex.Lock()
+        defer ws.mutex.Unlock()
+        return ws.wallets["wallet"].lastSignature
+    }
+    deadline := time.Now().Add(2 * time.Second)
+    for rpc.callCount("getSignaturesForAddress") < 2 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if baseline() != "" {
+        t.Fatal("baseline set while the lookup was failing")
+    }
+
+    rpc.mutex.Lock()
+    delete(rpc.methodErrors, "getSignaturesForAddress")
+    rpc.mutex.Unlock()
+    for baseline() == "" && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if got := baseline(); got != "sig-2" {
+        t.Fatalf("baseline %q, want sig-2", got)
+    }
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+const (
+    wsOpContinuation = 0x0
+    wsOpText         = 0x1
+    wsOpBinary       = 0x2
+    wsOpClose        = 0x8
+    wsOpPing         = 0x9
+    wsOpPong         = 0xA
+
+    wsAcceptGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+    wsMaxMessageSize = 16 << 20
+)
+
+var errWebSocketClosed = errors.New("websocket closed by peer")
+
+// wsConn is a minimal client side RFC 6455 connection: enough for JSON-RPC
+// subscriptions (text messages, fragmentation, ping/pong and close), without
+// extensions or compression.
+type wsConn struct {
+    conn       net.Conn
+    reader     *bufio.Reader
+    writeMutex sync.Mutex
+}
+
+// dialWebSocket opens a ws:// or wss:// connection and performs the upgrade
+// handshake
+func dialWebSocket(ctx context.Context, rawURL string) (*wsConn, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+
+    host := u.Host
+    if u.Port() == "" {
+        if u.Scheme == "wss" {
+            host = net.JoinHostPort(u.Hostname(), "443")
+        } else {
+            host = net.JoinHostPort(u.Hostname(), "80")
+        }
+    }
+
+    var conn net.Conn
+    switch u.Scheme {
+    case "ws":
+        conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+    case "wss":
+        conn, err = (&tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+    default:
+        return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    keyBytes := make([]byte, 16)
+    if _, err := rand.Read(keyBytes); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    key := base64.StdEncoding.EncodeToString(keyBytes)
+
+    req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", key)
+    req.Header.Set("Sec-WebSocket-Version", "13")
+
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    if err := req.Write(conn); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusSwitchingProtocols {
+        conn.Close()
+        return nil, fmt.Errorf("websocket upgrade failed: %s", resp.Status)
+    }
+
+    accept := sha1.Sum([]byte(key + wsAcceptGUID))
+    if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+        conn.Close()
+        return nil, errors.New("websocket upgrade failed: bad Sec-WebSocket-Accept")
+    }
+
+    conn.SetDeadline(time.Time{})
+    return &wsConn{conn: conn, reader: reader}, nil
+}
+
+// WriteText sends payload as a single masked text frame
+func (c *wsConn) WriteText(payload []byte) error {
+    return c.writeFrame(wsOpText, payload)
+}
+
+func (c *wsConn) Ping() error {
+    return c.writeFrame(wsOpPing, nil)
+}
+
+func (c *wsConn) Close() error {
+    c.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000: normal closure
+    return c.conn.Close()
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+    return c.conn.SetReadDeadline(t)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    header := []byte{0x80 | opcode}
+    switch length := len(payload); {
+    case length < 126:
+        header = append(header, 0x80|byte(length))
+    case length <= 0xFFFF:
+        header = append(header, 0x80|126, 0, 0)
+        binary.BigEndian.PutUint16(header[2:], uint16(length))
+    default:
+        header = append(header, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+        binary.BigEndian.PutUint64(header[2:], uint64(length))
+    }
+
+    // Client frames must be masked
+    mask := make([]byte, 4)
+    if _, err := rand.Read(mask); err != nil {
+        return err
+    }
+    header = append(header, mask...)
+    masked := make([]byte, len(payload))
+    for i, b := range payload {
+        masked[i] = b ^ mask[i%4]
+    }
+
+    _, err := c.conn.Write(append(header, masked...))
+    return err
+}
+
+// ReadMessage returns the next complete text or binary message, answering
+// pings along the way
+func (c *wsConn) ReadMessage() ([]byte, error) {
+    var message []byte
+    for {
+        fin, opcode, payload, err := c.readFrame()
+        if err != nil {
+            return nil, err
+        }
+
+        switch opcode {
+        case wsOpPing:
+            if err := c.writeFrame(wsOpPong, payload); err != nil {
+                return nil, err
+            }
+            continue
+        case wsOpPong:
+            continue
+        case wsOpClose:
+            return nil, errWebSocketClosed
+        case wsOpText, wsOpBinary, wsOpContinuation:
+            message = append(message, payload...)
+            if len(message) > wsMaxMessageSize {
+                return nil, errors.New("websocket message too large")
+            }
+            if fin {
+                return message, nil
+            }
+        default:
+            return nil, fmt.Errorf("unexpected websocket opcode %d", opcode)
+        }
+    }
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+        return false, 0, nil, err
+    }
+    fin := head[0]&0x80 != 0
+    opcode := head[0] & 0x0F
+    masked := head[1]&0x80 != 0
+
+    length := uint64(head[1] & 0x7F)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    if length > wsMaxMessageSize {
+        return false, 0, nil, errors.New("websocket frame too large")
+    }
+
+    var mask [4]byte
+    if masked {
+        if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+            return false, 0, nil, err
+        }
+    }
+
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(c.reader, payload); err != nil {
+        return false, 0, nil, err
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+    }
+    return fin, opcode, payload, nil
+}